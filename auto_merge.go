@@ -0,0 +1,114 @@
+package kv_bitcask
+
+import (
+	"log"
+	"time"
+)
+
+// 后台定期检查older文件中可以回收的数据比例，达到MergeRatio并且处于允许的时间段时自动merge
+func (db *DB) autoMerge() {
+	defer db.mergeWg.Done()
+
+	ticker := time.NewTicker(db.options.MergeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		if !inMergeWindows(db.options.MergeWindows, time.Now()) || !db.reachMergeRatio() {
+			continue
+		}
+		err := db.Merge()
+		if err != nil && err != ErrMergeIsProgress && err != ErrDBClosed {
+			log.Printf("bitcask: auto merge failed: %v", err)
+		}
+	}
+}
+
+// older文件中可以回收的数据比例是否达到了MergeRatio
+// 快照仍会读取的旧版本merge时会被保留，不计入可以回收的数据，否则快照存活期间每次检查都会重复merge
+func (db *DB) reachMergeRatio() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.isClosed || db.isMerging {
+		return false
+	}
+	pinnedSize := db.versions.pinnedSize()
+	var totalSize, reclaimSize int64
+	for fid, dataFile := range db.olderFiles {
+		size, err := dataFile.IOManager.Size()
+		if err != nil {
+			return false
+		}
+		totalSize += size
+		if reclaim := db.reclaimSize[fid] - pinnedSize[fid]; reclaim > 0 {
+			reclaimSize += reclaim
+		}
+	}
+	if totalSize == 0 || reclaimSize == 0 {
+		return false
+	}
+	return float32(reclaimSize)/float32(totalSize) >= db.options.MergeRatio
+}
+
+// t是否处于允许merge的时间段中，没有配置时间段时总是允许
+func inMergeWindows(windows []MergeWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := t.Sub(midnight)
+	for _, window := range windows {
+		if window.Start <= window.End {
+			if sinceMidnight >= window.Start && sinceMidnight < window.End {
+				return true
+			}
+		} else if sinceMidnight >= window.Start || sinceMidnight < window.End {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeLimiter 限制merge读取数据的速度，同时在数据库关闭时中断merge
+type mergeLimiter struct {
+	rate    int64 // 每秒最多读取的数据量，0表示不限制
+	start   time.Time
+	bytes   int64 // 已经读取的数据量
+	closeCh <-chan struct{}
+}
+
+func newMergeLimiter(rate int64, closeCh <-chan struct{}) *mergeLimiter {
+	return &mergeLimiter{rate: rate, start: time.Now(), closeCh: closeCh}
+}
+
+// 读取了n字节的数据，超过速度限制时等待，数据库已经关闭时返回ErrDBClosed
+func (ml *mergeLimiter) wait(n int64) error {
+	ml.bytes += n
+	var delay time.Duration
+	if ml.rate > 0 {
+		expected := time.Duration(float64(ml.bytes) / float64(ml.rate) * float64(time.Second))
+		delay = expected - time.Since(ml.start)
+	}
+	if delay <= 0 {
+		select {
+		case <-ml.closeCh:
+			return ErrDBClosed
+		default:
+			return nil
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ml.closeCh:
+		return ErrDBClosed
+	case <-timer.C:
+		return nil
+	}
+}
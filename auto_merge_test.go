@@ -0,0 +1,166 @@
+package kv_bitcask
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInMergeWindows(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2023, 1, 1, hour, min, 0, 0, time.Local)
+	}
+	assert.True(t, inMergeWindows(nil, at(12, 0)))
+
+	windows := []MergeWindow{
+		{Start: 2 * time.Hour, End: 4 * time.Hour},
+		{Start: 23 * time.Hour, End: time.Hour},
+	}
+	assert.True(t, inMergeWindows(windows, at(2, 0)))
+	assert.True(t, inMergeWindows(windows, at(3, 59)))
+	assert.False(t, inMergeWindows(windows, at(4, 0)))
+	assert.True(t, inMergeWindows(windows, at(23, 30)))
+	assert.True(t, inMergeWindows(windows, at(0, 30)))
+	assert.False(t, inMergeWindows(windows, at(1, 0)))
+	assert.False(t, inMergeWindows(windows, at(12, 0)))
+}
+
+func TestOpen_InvalidMergeOptions(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-1")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+
+	opts.MergeRatio = 1.5
+	_, err := Open(opts)
+	assert.Equal(t, ErrInvalidMergeRatio, err)
+
+	opts.MergeRatio = 0.5
+	opts.MergeWindows = []MergeWindow{{Start: 0, End: 25 * time.Hour}}
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidMergeWindow, err)
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MergeCheckInterval = 20 * time.Millisecond
+	opts.MergeRatio = 0.4
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	// 可以回收的数据比例没有达到阈值
+	time.Sleep(100 * time.Millisecond)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Files[0].ReclaimableSize)
+
+	// 覆盖所有数据之后，older文件中可以回收的数据比例超过阈值，自动merge之后低于阈值
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Eventually(t, func() bool {
+		db.mu.RLock()
+		isMerging := db.isMerging
+		db.mu.RUnlock()
+		return !isMerging && !db.reachMergeRatio()
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 2000, len(db.ListKeys()))
+}
+
+// 快照引用的旧版本不计入可以回收的数据，快照存活期间不会重复merge
+func TestDB_AutoMergeSnapshot(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-5")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MergeCheckInterval = time.Hour
+	opts.MergeRatio = 0.4
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	snap := db.Snapshot()
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.False(t, db.reachMergeRatio())
+	assert.Nil(t, db.Merge())
+	assert.False(t, db.reachMergeRatio())
+
+	snap.Release()
+	assert.True(t, db.reachMergeRatio())
+	assert.Nil(t, db.Merge())
+	assert.False(t, db.reachMergeRatio())
+}
+
+func TestDB_AutoMergeWindow(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-3")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MergeCheckInterval = 20 * time.Millisecond
+	opts.MergeRatio = 0.1
+	// 只允许在一个不包含当前时间的时间段内merge
+	now := time.Now()
+	sinceMidnight := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	start := (sinceMidnight + 2*time.Hour) % (24 * time.Hour)
+	opts.MergeWindows = []MergeWindow{{Start: start, End: (start + time.Hour) % (24 * time.Hour)}}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2000; j++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(j), utils.RandomValue(64)))
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.True(t, stat.ReclaimableSize > 0)
+}
+
+// 限速的 merge 进行中关闭数据库，merge 被中断，数据不受影响
+func TestDB_MergeRateLimitClose(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-4")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MergeRateLimit = 16 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- db.Merge()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	assert.Nil(t, db.Close())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, ErrDBClosed, <-errCh)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 2000, len(db2.ListKeys()))
+}
@@ -0,0 +1,247 @@
+package kv_bitcask
+
+import (
+	"io"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"kv-bitcask/index"
+	"kv-bitcask/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	backupTmpFileSuffix  = ".tmp"          // 复制文件时使用的临时文件后缀
+	backupSourceFileName = "backup-source" // 记录备份来源的数据目录，用来识别之前的备份
+)
+
+// backupFile 需要备份的一个文件
+type backupFile struct {
+	name   string   // 文件名
+	src    *os.File // 持有源文件的描述符，文件之后被merge删除也能继续读取
+	size   int64    // 需要复制的大小
+	linked bool     // 已经通过硬链接完成备份
+}
+
+// Backup 在线备份数据库到destDir，备份期间可以正常读写，备份出的目录可以直接用Open打开
+// older文件是只读的，优先使用硬链接，不在同一个文件系统时再复制；active文件复制到备份开始时写入的位置
+// destDir中已经存在的相同older文件（硬链接到同一个文件，或者大小和修改时间都一致）会被跳过，可以用同一个目录做增量备份
+// 备份期间会对destDir加锁，destDir不能是正在使用的数据库；destDir不为空时必须是之前对同一个数据库的备份
+func (db *DB) Backup(destDir string) error {
+	srcDir, err := filepath.Abs(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	dstDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+	if srcDir == dstDir {
+		return ErrBackupDirIsDataDir
+	}
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// 加锁之后再检查和修改目录中的文件，避免删除正在使用的数据库的文件
+	fileLock := utils.NewFileLock(filepath.Join(dstDir, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !hold {
+		return ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+	if err := checkBackupDir(srcDir, dstDir); err != nil {
+		return err
+	}
+
+	files, err := db.prepareBackup(dstDir)
+	defer func() {
+		for _, file := range files {
+			_ = file.src.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	// 复制不能硬链接的文件，此时不持有锁，不影响读写
+	wanted := make(map[string]bool)
+	for _, file := range files {
+		wanted[file.name] = true
+		if file.linked {
+			continue
+		}
+		if err := copyBackupFile(file, filepath.Join(dstDir, file.name)); err != nil {
+			return err
+		}
+	}
+
+	// 清理之前备份中残留的文件，例如已经被merge清理的数据文件、复制失败的临时文件，以及和新数据对应不上的持久化索引
+	dirEntries, err := os.ReadDir(dstDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		isDataFile := strings.HasSuffix(name, data.DataFileNameSuffix) || strings.HasSuffix(name, data.HintFileNameSuffix)
+		isStale := (isDataFile && !wanted[name]) || strings.HasSuffix(name, backupTmpFileSuffix)
+		if isStale || name == index.BPTreeFileName || name == mergeDirName {
+			if err := os.RemoveAll(filepath.Join(dstDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(dstDir)
+}
+
+// 检查备份目录为空，或者是之前对srcDir的备份，为空时写入备份来源
+func checkBackupDir(srcDir, dstDir string) error {
+	source, err := os.ReadFile(filepath.Join(dstDir, backupSourceFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && string(source) == srcDir {
+		return nil
+	}
+
+	dirEntries, err := os.ReadDir(dstDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if entry.Name() != fileLockName {
+			return ErrBackupDirNotEmpty
+		}
+	}
+
+	file, err := os.Create(filepath.Join(dstDir, backupSourceFileName))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err := file.WriteString(srcDir); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// 持有读锁确定备份的内容：持久化active文件并记录当前写入的位置，打开或者硬链接所有需要备份的文件
+// 持有读锁期间不会有新的写入，也不会有merge替换文件，备份的是同一时刻的一致数据
+func (db *DB) prepareBackup(dstDir string) ([]*backupFile, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.isClosed {
+		return nil, ErrDBClosed
+	}
+	if db.activeFile == nil {
+		return nil, nil
+	}
+	if err := db.activeFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	var files []*backupFile
+	addFile := func(fileName string, size int64, canLink bool) error {
+		src, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		file := &backupFile{name: filepath.Base(fileName), src: src, size: size}
+		files = append(files, file)
+		if size < 0 {
+			stat, err := src.Stat()
+			if err != nil {
+				return err
+			}
+			file.size = stat.Size()
+		}
+		if canLink {
+			file.linked, err = linkBackupFile(file, filepath.Join(dstDir, file.name))
+		}
+		return err
+	}
+
+	// older文件和对应的hint文件都不会再被修改
+	for fid := range db.olderFiles {
+		if err := addFile(data.GetDataFileName(db.options.DirPath, fid), -1, true); err != nil {
+			return files, err
+		}
+		hintFileName := data.GetHintFileName(db.options.DirPath, fid)
+		if _, err := os.Stat(hintFileName); err == nil {
+			if err := addFile(hintFileName, -1, true); err != nil {
+				return files, err
+			}
+		}
+	}
+
+	// active文件之后还会继续写入，只复制当前写入的部分
+	activeFileName := data.GetDataFileName(db.options.DirPath, db.activeFile.FileId)
+	if err := addFile(activeFileName, db.activeFile.WriteOff, false); err != nil {
+		return files, err
+	}
+	return files, nil
+}
+
+// 尝试通过硬链接备份文件，目标文件已经是相同的文件时直接跳过，无法硬链接时返回false
+func linkBackupFile(file *backupFile, dstPath string) (bool, error) {
+	srcStat, err := file.src.Stat()
+	if err != nil {
+		return false, err
+	}
+	if dstStat, err := os.Stat(dstPath); err == nil {
+		if os.SameFile(srcStat, dstStat) {
+			return true, nil
+		}
+		// 之前复制过的文件，大小和修改时间一致说明是同一个文件
+		if dstStat.Size() == srcStat.Size() && dstStat.ModTime().Equal(srcStat.ModTime()) {
+			return true, nil
+		}
+		if err := os.Remove(dstPath); err != nil {
+			return false, err
+		}
+	}
+	// 不在同一个文件系统等情况下无法硬链接，之后复制
+	if err := os.Link(file.src.Name(), dstPath); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// 复制文件的前size个字节，先写入临时文件再重命名，避免留下不完整的文件
+func copyBackupFile(file *backupFile, dstPath string) error {
+	tmpPath := dstPath + backupTmpFileSuffix
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(file.src, 0, file.size))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	// 保留源文件的修改时间，增量备份时用于判断文件是否变化
+	srcStat, err := file.src.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmpPath, srcStat.ModTime(), srcStat.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dstPath)
+}
@@ -0,0 +1,220 @@
+package kv_bitcask
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDB_Backup(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-1")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 数据库为空
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, db.Backup(backupDir))
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Backup(backupDir))
+	assert.Equal(t, ErrBackupDirIsDataDir, db.Backup(dir))
+
+	// 备份之后的写入不在备份中
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(64)))
+
+	// 备份结束后释放目录锁，可以直接打开
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		val, err := backupDB.Get(utils.GetTestKey(i))
+		if i < 100 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		expected, _ := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, expected, val)
+	}
+	assert.Nil(t, backupDB.Close())
+
+	assert.Nil(t, db.Close())
+	assert.Equal(t, ErrDBClosed, db.Backup(backupDir))
+}
+
+// 增量备份，已经备份过的 older 文件会被跳过，merge 清理的文件会从备份中删除
+func TestDB_BackupIncremental(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+	defer os.RemoveAll(backupDir)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Backup(backupDir))
+
+	// older 文件通过硬链接备份
+	olderFile := data.GetDataFileName(backupDir, 0)
+	srcStat, err := os.Stat(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	dstStat, err := os.Stat(olderFile)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(srcStat, dstStat))
+
+	// 复制的文件大小和修改时间一致时跳过
+	assert.Nil(t, os.Remove(olderFile))
+	assert.Nil(t, copyBackupFile(&backupFile{src: mustOpen(t, data.GetDataFileName(dir, 0)), size: srcStat.Size()}, olderFile))
+	dstStat, _ = os.Stat(olderFile)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Backup(backupDir))
+	stat, err := os.Stat(olderFile)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(dstStat, stat))
+
+	// merge 之后再次备份
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Backup(backupDir))
+
+	srcFiles, _ := filepath.Glob(filepath.Join(dir, "*"+data.DataFileNameSuffix))
+	dstFiles, _ := filepath.Glob(filepath.Join(backupDir, "*"+data.DataFileNameSuffix))
+	assert.Equal(t, len(srcFiles), len(dstFiles))
+
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = backupDB.Close()
+	}()
+	assert.Equal(t, 1000, len(backupDB.ListKeys()))
+	for i := 1000; i < 2000; i++ {
+		val, err := backupDB.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		expected, _ := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, expected, val)
+	}
+}
+
+// 备份期间有并发的写入
+func TestDB_BackupConcurrentWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-3")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+	defer os.RemoveAll(backupDir)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 2000; i < 6000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+	}()
+	assert.Nil(t, db.Backup(backupDir))
+	wg.Wait()
+
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = backupDB.Close()
+	}()
+
+	// 备份中是某一时刻之前的全部写入
+	keys := backupDB.ListKeys()
+	assert.True(t, len(keys) >= 2000)
+	for i, key := range keys {
+		assert.Equal(t, utils.GetTestKey(i), key)
+	}
+}
+
+func mustOpen(t *testing.T, name string) *os.File {
+	file, err := os.Open(name)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = file.Close()
+	})
+	return file
+}
+
+// 备份目录是正在使用的数据库，或者是其他不为空的目录时拒绝备份，不会删除其中的文件
+func TestDB_BackupDirNotBackup(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-4")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(64)))
+
+	otherOpts := DefaultOptions
+	otherDir, _ := os.MkdirTemp("", "bitcask-go-backup-other")
+	otherOpts.DirPath = otherDir
+	otherDB, err := Open(otherOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, otherDB.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Equal(t, ErrDatabaseIsUsing, db.Backup(otherDir))
+
+	// 关闭之后目录不为空，也不是之前的备份
+	assert.Nil(t, otherDB.Close())
+	assert.Equal(t, ErrBackupDirNotEmpty, db.Backup(otherDir))
+	otherDB, err = Open(otherOpts)
+	assert.Nil(t, err)
+	defer destroyDB(otherDB)
+	keys := otherDB.ListKeys()
+	assert.Equal(t, 100, len(keys))
+
+	// 其他数据库的备份目录
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, otherDB.Backup(backupDir))
+	assert.Equal(t, ErrBackupDirNotEmpty, db.Backup(backupDir))
+	assert.Nil(t, otherDB.Backup(backupDir))
+
+	// 打开备份期间不能再次备份
+	backupOpts := otherOpts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrDatabaseIsUsing, otherDB.Backup(backupDir))
+	assert.Nil(t, backupDB.Close())
+}
@@ -0,0 +1,160 @@
+package kv_bitcask
+
+import (
+	"kv-bitcask/data"
+	"sync"
+)
+
+// 批次完成标识记录的key
+var batchFinishedKey = []byte("batch.finished")
+
+// batchRecord 加载索引时暂存的批次记录
+type batchRecord struct {
+	logRecord *data.LogRecord
+	pos       *data.LogRecordPos
+}
+
+// WriteBatch 原子批量写入数据，保证一个批次中的数据要么全部生效，要么全部不生效
+type WriteBatch struct {
+	options       WriteBatchOptions
+	mu            *sync.Mutex
+	db            *DB
+	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
+}
+
+// NewWriteBatch 初始化WriteBatch
+func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
+	return &WriteBatch{
+		options:       opts,
+		mu:            new(sync.Mutex),
+		db:            db,
+		pendingWrites: make(map[string]*data.LogRecord),
+	}
+}
+
+// Put 批量写数据
+func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if err := wb.db.checkKeySize(key); err != nil {
+		return err
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	// 暂存LogRecord
+	logRecord := &data.LogRecord{Key: key, Value: value}
+	wb.pendingWrites[string(key)] = logRecord
+	return nil
+}
+
+// Delete 批量删除数据
+func (wb *WriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	// 数据不存在则直接返回，同时丢弃批次中暂存的写入
+	logRecordPos := wb.db.index.Get(key)
+	if logRecordPos == nil {
+		delete(wb.pendingWrites, string(key))
+		return nil
+	}
+
+	// 暂存LogRecord
+	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	wb.pendingWrites[string(key)] = logRecord
+	return nil
+}
+
+// Commit 提交批次，将暂存的数据全部写到数据文件，并更新内存索引
+func (wb *WriteBatch) Commit() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if len(wb.pendingWrites) == 0 {
+		return nil
+	}
+	if uint(len(wb.pendingWrites)) > wb.options.MaxBatchNum {
+		return ErrExceedMaxBatchNum
+	}
+
+	// 加锁保证批次提交的串行化
+	wb.db.mu.Lock()
+	if wb.db.isClosed {
+		wb.db.mu.Unlock()
+		return ErrDBClosed
+	}
+	written, err := wb.db.commitBatch(wb.pendingWrites)
+	wb.db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	// 释放锁之后再等待持久化，并发提交的批次可以共享同一次fsync
+	if wb.options.SyncWrites {
+		return wb.db.syncer.wait(written)
+	}
+	return nil
+}
+
+// 以一个批次原子地写入数据并更新索引，返回写入的位置，调用方需持有db.mu写锁
+func (db *DB) commitBatch(pendingWrites map[string]*data.LogRecord) (uint64, error) {
+	if db.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	// 获取最新的序列号
+	db.seqNo++
+	seqNo := db.seqNo
+
+	// 写数据到数据文件当中
+	positions := make(map[string]*data.LogRecordPos)
+	for _, record := range pendingWrites {
+		logRecordPos, err := db.appendLogRecord(&data.LogRecord{
+			Key:    record.Key,
+			Value:  record.Value,
+			Type:   record.Type,
+			SeqNo:  seqNo,
+			Expire: record.Expire,
+		})
+		if err != nil {
+			return 0, err
+		}
+		logRecordPos.Expire = record.Expire
+		logRecordPos.Version = seqNo
+		positions[string(record.Key)] = logRecordPos
+	}
+
+	// 写一条标识批次完成的数据，只有读到该标识的批次才会在重启时生效
+	finishedRecord := &data.LogRecord{
+		Key:   batchFinishedKey,
+		Type:  data.LogRecordBatchFinished,
+		SeqNo: seqNo,
+	}
+	finishedPos, err := db.appendLogRecord(finishedRecord)
+	if err != nil {
+		return 0, err
+	}
+	db.addReclaimSize(finishedPos)
+
+	// 更新内存索引
+	for _, record := range pendingWrites {
+		pos := positions[string(record.Key)]
+		oldPos := db.index.Get(record.Key)
+		db.saveVersion(record.Key, seqNo, oldPos)
+		db.addReclaimSize(oldPos)
+		if record.Type == data.LogRecordDeleted {
+			db.index.Delete(record.Key)
+			db.addReclaimSize(pos)
+		} else if ok := db.index.Put(record.Key, pos); !ok {
+			return 0, ErrIndexUpdateFailed
+		}
+	}
+	return db.writtenBytes, nil
+}
@@ -0,0 +1,219 @@
+package kv_bitcask
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_WriteBatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 写数据之后并不提交
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 正常提交数据
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.NotNil(t, val1)
+	assert.Nil(t, err)
+
+	// 删除有效的数据
+	wb2 := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb2.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = wb2.Commit()
+	assert.Nil(t, err)
+
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// key 为空
+	err = wb2.Put(nil, utils.RandomValue(10))
+	assert.Equal(t, ErrKeyIsEmpty, err)
+}
+
+func TestDB_WriteBatchRestart(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(2), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	err = wb.Put(utils.GetTestKey(11), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	// 单独的 Put 也会占用一个提交序列号
+	assert.Equal(t, uint64(3), db.seqNo)
+
+	// 重启
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	val, err = db2.Get(utils.GetTestKey(11))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 校验序列号
+	assert.Equal(t, uint64(3), db2.seqNo)
+}
+
+func TestDB_WriteBatchNotFinished(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-3")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	// 模拟提交过程中崩溃，只写入了部分数据，没有写入完成标识
+	db.mu.Lock()
+	_, err = db.appendLogRecord(&data.LogRecord{Key: utils.GetTestKey(2), Value: utils.RandomValue(10), SeqNo: 1})
+	assert.Nil(t, err)
+	_, err = db.appendLogRecord(&data.LogRecord{Key: utils.GetTestKey(1), Type: data.LogRecordDeleted, SeqNo: 1})
+	assert.Nil(t, err)
+	db.mu.Unlock()
+
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 没有完成的批次不生效
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	_, err = db2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 新的批次使用更大的序列号
+	assert.Equal(t, uint64(1), db2.seqNo)
+	wb := db2.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(3), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	_, err = db3.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db3.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+func TestDB_WriteBatchMaxNum(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-4")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	wbOpts := DefaultWriteBatchOptions
+	wbOpts.MaxBatchNum = 10
+	wb := db.NewWriteBatch(wbOpts)
+	for i := 0; i < 11; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Equal(t, ErrExceedMaxBatchNum, err)
+}
+
+func TestDB_WriteBatchMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-5")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 批次数据跨越多个数据文件
+	wbOpts := DefaultWriteBatchOptions
+	wbOpts.MaxBatchNum = 100000
+	wb := db.NewWriteBatch(wbOpts)
+	for i := 0; i < 20000; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	for i := 0; i < 10000; i++ {
+		err := wb.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	for i := 0; i < 10000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 10000; i < 20000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
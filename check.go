@@ -0,0 +1,157 @@
+package kv_bitcask
+
+import (
+	"fmt"
+	"io"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CheckProblem 检查时发现的一处损坏
+type CheckProblem struct {
+	FileName string // 数据文件名
+	FileId   uint32 // 数据文件ID，文件名无法解析时为0
+	Offset   int64  // 损坏数据的起始位置，文件级别的问题为-1
+	Length   int64  // 损坏的数据长度，即跳过的字节数
+	Err      error  // 损坏的原因
+}
+
+func (p CheckProblem) String() string {
+	if p.Offset < 0 {
+		return fmt.Sprintf("%s: %v", p.FileName, p.Err)
+	}
+	return fmt.Sprintf("%s offset %d: %v (%d bytes)", p.FileName, p.Offset, p.Err, p.Length)
+}
+
+// CheckReport 数据目录的检查结果
+type CheckReport struct {
+	Files    int            // 检查的数据文件数量
+	Records  int64          // 完好的记录数量
+	Bytes    int64          // 检查的数据总大小
+	Problems []CheckProblem // 发现的所有问题，按文件和位置排序
+}
+
+// OK 没有发现任何问题
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Check 离线检查数据目录中的所有数据文件，读取每一条记录并校验CRC，不会修改任何文件
+// 检查时数据库不能处于打开状态，否则活跃文件末尾正在写入的记录可能被误报为截断
+func Check(dirPath string) (*CheckReport, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, data.DataFileNameSuffix) {
+			continue
+		}
+
+		// 文件名必须和data.GetDataFileName按ID拼出的一致，否则loadDataFiles解析出ID之后找不到该文件
+		var fileId uint32
+		id, parseErr := strconv.ParseUint(strings.TrimSuffix(name, data.DataFileNameSuffix), 10, 32)
+		if parseErr == nil {
+			fileId = uint32(id)
+		}
+		if parseErr != nil || filepath.Base(data.GetDataFileName(dirPath, fileId)) != name {
+			report.Problems = append(report.Problems, CheckProblem{
+				FileName: name, FileId: fileId, Offset: -1, Err: ErrInvalidDataFileName,
+			})
+		}
+
+		if err := checkDataFile(filepath.Join(dirPath, name), fileId, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// 检查一个数据文件，结果累加到report中
+func checkDataFile(fileName string, fileId uint32, report *CheckReport) error {
+	// 使用MMap只读打开，不会修改文件
+	ioManager, err := fio.NewIOManager(fileName, fio.MemoryMap)
+	if err != nil {
+		return err
+	}
+	dataFile := &data.DataFile{FileId: fileId, IOManager: ioManager}
+	defer dataFile.Close()
+
+	fileSize, err := ioManager.Size()
+	if err != nil {
+		return err
+	}
+	report.Files++
+	report.Bytes += fileSize
+
+	onRecord := func(offset, size int64) error {
+		report.Records++
+		return nil
+	}
+	onProblem := func(offset, length int64, err error) {
+		report.Problems = append(report.Problems, CheckProblem{
+			FileName: filepath.Base(fileName), FileId: fileId, Offset: offset, Length: length, Err: err,
+		})
+	}
+	return scanDataFile(dataFile, fileSize, onRecord, onProblem)
+}
+
+// 逐条读取数据文件中的记录，每条完好的记录调用onRecord，遇到损坏时调用onProblem，并向后查找下一条完好的记录继续读取
+func scanDataFile(dataFile *data.DataFile, fileSize int64,
+	onRecord func(offset, size int64) error, onProblem func(offset, length int64, err error)) error {
+	var offset int64
+	for offset < fileSize {
+		_, size, err := dataFile.ReadLogRecord(offset)
+		if err == nil {
+			if err := onRecord(offset, size); err != nil {
+				return err
+			}
+			offset += size
+			continue
+		}
+		// 文件中间读到全0的header，正常写入的文件不会出现
+		if err == io.EOF {
+			err = ErrUnexpectedZeroBytes
+		} else if !data.IsCorrupted(err) {
+			return err
+		}
+
+		next, err2 := nextValidRecord(dataFile, offset, size, fileSize, err)
+		if err2 != nil {
+			return err2
+		}
+		onProblem(offset, next-offset, err)
+		offset = next
+	}
+	return nil
+}
+
+// 查找offset之后下一条完好记录的位置，找不到时返回文件大小
+// CRC校验失败时记录的长度通常是正确的，先尝试直接跳过这条记录，否则逐字节向后查找
+func nextValidRecord(dataFile *data.DataFile, offset, size, fileSize int64, cause error) (int64, error) {
+	if cause == data.ErrInvalidCRC {
+		if offset+size == fileSize {
+			return fileSize, nil
+		}
+		if _, _, err := dataFile.ReadLogRecord(offset + size); err == nil {
+			return offset + size, nil
+		}
+	}
+	for next := offset + 1; next < fileSize; next++ {
+		_, _, err := dataFile.ReadLogRecord(next)
+		if err == nil {
+			return next, nil
+		}
+		if err != io.EOF && !data.IsCorrupted(err) {
+			return 0, err
+		}
+	}
+	return fileSize, nil
+}
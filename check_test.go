@@ -0,0 +1,153 @@
+package kv_bitcask
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"kv-bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 写入100条数据后关闭，返回数据目录
+func prepareCheckDir(t *testing.T) string {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-check")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Close())
+	return dir
+}
+
+// 数据文件中每条记录的起始位置
+func recordOffsets(t *testing.T, dirPath string, fileId uint32) []int64 {
+	dataFile, err := data.OpenDataFile(dirPath, fileId, fio.MemoryMap)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+	var offsets []int64
+	var offset int64
+	for {
+		_, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			break
+		}
+		offsets = append(offsets, offset)
+		offset += size
+	}
+	return offsets
+}
+
+func TestCheck(t *testing.T) {
+	dir := prepareCheckDir(t)
+	defer os.RemoveAll(dir)
+
+	report, err := Check(dir)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, int64(100), report.Records)
+	assert.Equal(t, dataFileSize(t, dir, 0), report.Bytes)
+}
+
+func TestCheck_InvalidCRC(t *testing.T) {
+	dir := prepareCheckDir(t)
+	defer os.RemoveAll(dir)
+
+	offsets := recordOffsets(t, dir, 0)
+	corruptDataFile(t, dir, 0, offsets[11]-1)
+	before, err := os.ReadFile(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+
+	report, err := Check(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(99), report.Records)
+	assert.Equal(t, []CheckProblem{
+		{FileName: "000000000.data", Offset: offsets[10], Length: offsets[11] - offsets[10], Err: data.ErrInvalidCRC},
+	}, report.Problems)
+
+	// 检查不会修改文件
+	after, err := os.ReadFile(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(before, after))
+}
+
+func TestCheck_Truncated(t *testing.T) {
+	dir := prepareCheckDir(t)
+	defer os.RemoveAll(dir)
+
+	validSize := dataFileSize(t, dir, 0)
+	record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn-key"), Value: utils.RandomValue(128)})
+	appendToDataFile(t, dir, 0, record[:len(record)-10])
+
+	report, err := Check(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), report.Records)
+	assert.Equal(t, []CheckProblem{
+		{FileName: "000000000.data", Offset: validSize, Length: int64(len(record) - 10), Err: data.ErrLogRecordTruncated},
+	}, report.Problems)
+}
+
+func TestCheck_InvalidHeader(t *testing.T) {
+	dir := prepareCheckDir(t)
+	defer os.RemoveAll(dir)
+
+	// 损坏的header之后还有完好的记录，检查会跳过损坏的部分继续读取
+	offsets := recordOffsets(t, dir, 0)
+	fileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	garbage := bytes.Repeat([]byte{0xff}, 64)
+	buf = append(append(append([]byte{}, buf[:offsets[50]]...), garbage...), buf[offsets[50]:]...)
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+
+	report, err := Check(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), report.Records)
+	assert.Equal(t, []CheckProblem{
+		{FileName: "000000000.data", Offset: offsets[50], Length: int64(len(garbage)), Err: data.ErrInvalidLogRecordHeader},
+	}, report.Problems)
+}
+
+func TestCheck_ZeroBytes(t *testing.T) {
+	dir := prepareCheckDir(t)
+	defer os.RemoveAll(dir)
+
+	offsets := recordOffsets(t, dir, 0)
+	fileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf = append(append(append([]byte{}, buf[:offsets[20]]...), make([]byte, 16)...), buf[offsets[20]:]...)
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+
+	report, err := Check(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), report.Records)
+	assert.Equal(t, []CheckProblem{
+		{FileName: "000000000.data", Offset: offsets[20], Length: 16, Err: ErrUnexpectedZeroBytes},
+	}, report.Problems)
+}
+
+func TestCheck_InvalidFileName(t *testing.T) {
+	dir := prepareCheckDir(t)
+	defer os.RemoveAll(dir)
+
+	buf, err := os.ReadFile(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "1.data"), buf, 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "backup.data"), nil, 0644))
+
+	report, err := Check(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Files)
+	assert.Equal(t, int64(200), report.Records)
+	assert.Equal(t, []CheckProblem{
+		{FileName: "1.data", FileId: 1, Offset: -1, Err: ErrInvalidDataFileName},
+		{FileName: "backup.data", Offset: -1, Err: ErrInvalidDataFileName},
+	}, report.Problems)
+}
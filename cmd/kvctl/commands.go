@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	bitcask "kv-bitcask"
+	"sort"
+)
+
+// errUsage 命令的参数错误
+var errUsage = errors.New("usage error")
+
+// app 命令执行时的上下文
+type app struct {
+	db         *bitcask.DB
+	dir        string
+	out        io.Writer
+	errOut     io.Writer
+	jsonOutput bool
+	base64     bool
+}
+
+type command struct {
+	usage string
+	desc  string
+	run   func(a *app, args []string) error
+}
+
+// offlineCommands 不需要打开数据库的命令
+var offlineCommands = map[string]bool{"verify": true, "repair": true}
+
+// readOnlyCommands 不会写入数据的命令，以只读方式打开数据库，可以和正在运行的只读实例同时使用
+var readOnlyCommands = map[string]bool{"get": true, "scan": true, "stat": true, "dump": true, "backup": true}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"get":    {"get <key>", "读取key的value", (*app).get},
+		"put":    {"put [--ttl duration] <key> <value>", "写入key-value", (*app).put},
+		"del":    {"del <key>", "删除key", (*app).del},
+		"scan":   {"scan [--prefix p] [--limit n] [--reverse]", "按顺序遍历key和value", (*app).scan},
+		"stat":   {"stat", "查看数据库的统计信息", (*app).stat},
+		"merge":  {"merge", "执行merge，清理无效的数据", (*app).merge},
+		"backup": {"backup <dir>", "在线备份到指定目录", (*app).backup},
+		"dump":   {"dump", "输出所有的key和value", (*app).dump},
+		"verify": {"verify", "离线检查所有数据文件，有数据损坏时返回非0的退出码", (*app).verify},
+		"repair": {"repair", "离线修复数据文件，跳过损坏的数据，原始文件和报告保存到repair-<时间>目录", (*app).repair},
+	}
+}
+
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-45s %s\n", commands[name].usage, commands[name].desc)
+	}
+}
+
+// 执行一条命令，args[0]是命令名
+func (a *app) exec(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+	return cmd.run(a, args[1:])
+}
+
+// 解析命令的参数，需要的位置参数数量不一致时返回errUsage
+func (a *app) parseFlags(flags *flag.FlagSet, args []string, nArgs int) error {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if flags.NArg() != nArgs {
+		return fmt.Errorf("%w: usage: %s", errUsage, commands[flags.Name()].usage)
+	}
+	return nil
+}
+
+func (a *app) get(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	key, err := a.decode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	value, err := a.db.Get(key)
+	if err != nil {
+		return err
+	}
+	ttl, err := a.db.TTL(key)
+	if err != nil {
+		return err
+	}
+
+	if !a.jsonOutput {
+		fmt.Fprintln(a.out, a.encode(value))
+		return nil
+	}
+	result := &record{Key: a.encode(key), Value: a.encode(value)}
+	if ttl != bitcask.NoExpiration {
+		result.TTL = ttl.Milliseconds()
+	}
+	return a.printJSON(result)
+}
+
+func (a *app) put(args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := flags.Duration("ttl", 0, "过期时间")
+	if err := a.parseFlags(flags, args, 2); err != nil {
+		return err
+	}
+	key, err := a.decode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	value, err := a.decode(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *ttl != 0 {
+		err = a.db.PutWithTTL(key, value, *ttl)
+	} else {
+		err = a.db.Put(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	return a.printOK()
+}
+
+func (a *app) del(args []string) error {
+	flags := flag.NewFlagSet("del", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	key, err := a.decode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := a.db.Delete(key); err != nil {
+		return err
+	}
+	return a.printOK()
+}
+
+func (a *app) scan(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "只遍历指定前缀的key")
+	limit := flags.Int("limit", 0, "最多输出的数量，0表示不限制")
+	reverse := flags.Bool("reverse", false, "反向遍历")
+	if err := a.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	prefixBytes, err := a.decode(*prefix)
+	if err != nil {
+		return err
+	}
+	return a.iterate(bitcask.IteratorOptions{Prefix: prefixBytes, Reverse: *reverse}, *limit)
+}
+
+func (a *app) dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	return a.iterate(bitcask.DefaultIteratorOptions, 0)
+}
+
+// 遍历输出key和value，文本格式每行输出key和value，以tab分隔
+func (a *app) iterate(opts bitcask.IteratorOptions, limit int) error {
+	iterator := a.db.NewIterator(opts)
+	defer iterator.Close()
+	for count := 0; iterator.Valid() && (limit <= 0 || count < limit); iterator.Next() {
+		value, err := iterator.Value()
+		if err != nil {
+			return fmt.Errorf("read key %q: %w", a.encode(iterator.Key()), err)
+		}
+		if a.jsonOutput {
+			if err := a.printJSON(&record{Key: a.encode(iterator.Key()), Value: a.encode(value)}); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(a.out, "%s\t%s\n", a.encode(iterator.Key()), a.encode(value))
+		}
+		count++
+	}
+	return nil
+}
+
+func (a *app) stat(args []string) error {
+	flags := flag.NewFlagSet("stat", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	stat, err := a.db.Stat()
+	if err != nil {
+		return err
+	}
+
+	if a.jsonOutput {
+		result := &statResult{
+			KeyNum:          stat.KeyNum,
+			DataFileNum:     stat.DataFileNum,
+			ReclaimableSize: stat.ReclaimableSize,
+			DiskSize:        stat.DiskSize,
+			Files:           make([]fileStatResult, 0, len(stat.Files)),
+		}
+		for _, file := range stat.Files {
+			result.Files = append(result.Files, fileStatResult(file))
+		}
+		return a.printJSON(result)
+	}
+	fmt.Fprintf(a.out, "keys:             %d\n", stat.KeyNum)
+	fmt.Fprintf(a.out, "data files:       %d\n", stat.DataFileNum)
+	fmt.Fprintf(a.out, "reclaimable size: %d\n", stat.ReclaimableSize)
+	fmt.Fprintf(a.out, "disk size:        %d\n", stat.DiskSize)
+	for _, file := range stat.Files {
+		fmt.Fprintf(a.out, "  file %09d: size %d, reclaimable %d (%.1f%%)\n",
+			file.FileId, file.Size, file.ReclaimableSize, file.DeadRatio*100)
+	}
+	return nil
+}
+
+func (a *app) merge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if err := a.db.Merge(); err != nil {
+		return err
+	}
+	return a.printOK()
+}
+
+func (a *app) backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	if err := a.db.Backup(flags.Arg(0)); err != nil {
+		return err
+	}
+	return a.printOK()
+}
+
+// checkResult verify的结果
+type checkResult struct {
+	Files    int            `json:"files"`
+	Records  int64          `json:"records"`
+	Bytes    int64          `json:"bytes"`
+	Problems []checkProblem `json:"problems"`
+}
+
+// checkProblem 一处损坏，offset为-1时表示文件名不符合格式
+type checkProblem struct {
+	File   string `json:"file"`
+	FileId uint32 `json:"file_id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Error  string `json:"error"`
+}
+
+// errVerifyFailed 数据文件有损坏
+var errVerifyFailed = errors.New("verify failed")
+
+// 离线检查所有数据文件，不需要打开数据库，也不会修改任何文件
+func (a *app) verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	report, err := bitcask.Check(a.dir)
+	if err != nil {
+		return err
+	}
+
+	if a.jsonOutput {
+		result := &checkResult{
+			Files:    report.Files,
+			Records:  report.Records,
+			Bytes:    report.Bytes,
+			Problems: toCheckProblems(report.Problems),
+		}
+		if err := a.printJSON(result); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range report.Problems {
+			fmt.Fprintln(a.out, p.String())
+		}
+		fmt.Fprintf(a.out, "%d files, %d records checked, %d problems\n", report.Files, report.Records, len(report.Problems))
+	}
+	if !report.OK() {
+		return fmt.Errorf("%w: %d problems found", errVerifyFailed, len(report.Problems))
+	}
+	return nil
+}
+
+// repairResult repair的结果，lost为丢弃的数据范围
+type repairResult struct {
+	Files     []uint32       `json:"files"`
+	Records   int64          `json:"records"`
+	LostBytes int64          `json:"lost_bytes"`
+	Lost      []checkProblem `json:"lost"`
+	Skipped   []checkProblem `json:"skipped"`
+	BackupDir string         `json:"backup_dir,omitempty"`
+}
+
+// 离线修复数据文件，需要独占数据目录
+func (a *app) repair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+	if err := a.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	report, err := bitcask.Repair(a.dir)
+	if err != nil {
+		return err
+	}
+
+	if a.jsonOutput {
+		result := &repairResult{
+			Files:     report.Files,
+			Records:   report.Records,
+			LostBytes: report.LostBytes,
+			Lost:      toCheckProblems(report.Lost),
+			Skipped:   toCheckProblems(report.Skipped),
+			BackupDir: report.BackupDir,
+		}
+		if result.Files == nil {
+			result.Files = []uint32{}
+		}
+		return a.printJSON(result)
+	}
+	for _, p := range report.Lost {
+		fmt.Fprintf(a.out, "lost %s\n", p.String())
+	}
+	for _, p := range report.Skipped {
+		fmt.Fprintf(a.out, "skipped %s\n", p.String())
+	}
+	if len(report.Files) == 0 {
+		fmt.Fprintln(a.out, "nothing to repair")
+		return nil
+	}
+	fmt.Fprintf(a.out, "%d files repaired, %d records kept, %d bytes lost\n", len(report.Files), report.Records, report.LostBytes)
+	fmt.Fprintf(a.out, "original files and report saved to %s\n", report.BackupDir)
+	return nil
+}
+
+func toCheckProblems(problems []bitcask.CheckProblem) []checkProblem {
+	result := make([]checkProblem, 0, len(problems))
+	for _, p := range problems {
+		result = append(result, checkProblem{
+			File: p.FileName, FileId: p.FileId, Offset: p.Offset, Length: p.Length, Error: p.Err.Error(),
+		})
+	}
+	return result
+}
+
+// record 输出的一条数据
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl_ms,omitempty"` // 剩余的存活时间，单位毫秒，没有过期时间时不输出
+}
+
+type statResult struct {
+	KeyNum          uint             `json:"key_num"`
+	DataFileNum     uint             `json:"data_file_num"`
+	ReclaimableSize int64            `json:"reclaimable_size"`
+	DiskSize        int64            `json:"disk_size"`
+	Files           []fileStatResult `json:"files"`
+}
+
+type fileStatResult struct {
+	FileId          uint32  `json:"file_id"`
+	Size            int64   `json:"size"`
+	ReclaimableSize int64   `json:"reclaimable_size"`
+	DeadRatio       float64 `json:"dead_ratio"`
+}
+
+func (a *app) encode(buf []byte) string {
+	if a.base64 {
+		return base64.StdEncoding.EncodeToString(buf)
+	}
+	return string(buf)
+}
+
+func (a *app) decode(s string) ([]byte, error) {
+	if !a.base64 {
+		return []byte(s), nil
+	}
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 %q: %v", s, err)
+	}
+	return buf, nil
+}
+
+func (a *app) printJSON(v interface{}) error {
+	return json.NewEncoder(a.out).Encode(v)
+}
+
+func (a *app) printOK() error {
+	if a.jsonOutput {
+		return a.printJSON(map[string]bool{"ok": true})
+	}
+	fmt.Fprintln(a.out, "OK")
+	return nil
+}
+
+// 输出错误，JSON格式时输出到标准输出，方便和结果一起解析
+func (a *app) printError(err error) {
+	if a.jsonOutput {
+		_ = a.printJSON(map[string]string{"error": err.Error()})
+		return
+	}
+	fmt.Fprintf(a.errOut, "error: %v\n", err)
+}
@@ -0,0 +1,124 @@
+// kvctl 查看和管理数据库的命令行工具
+//
+// 用法：
+//
+//	kvctl -dir <数据目录> [-index btree|art|bptree] [-data-file-size 字节数] [-json] [-base64] <命令> [参数]
+//
+// 索引类型和数据文件大小需要和使用数据库的服务的配置一致，否则持久化的B+树索引会被删除后重建，新的数据文件大小也会不同
+//
+// 不指定命令时进入交互模式，输入help查看所有命令
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	bitcask "kv-bitcask"
+	"kv-bitcask/index"
+	"os"
+	"path/filepath"
+)
+
+// -index参数可以使用的索引类型
+var indexTypes = map[string]index.IndexType{
+	"btree":  index.Btree,
+	"art":    index.ART,
+	"bptree": index.BPTree,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// 执行命令行，返回进程的退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", "", "数据目录")
+	indexName := flags.String("index", "btree", "索引类型：btree、art或bptree，需要和数据库使用的索引类型一致")
+	dataFileSize := flags.Int64("data-file-size", bitcask.DefaultOptions.DataFileSize, "数据文件的大小，需要和数据库的配置一致")
+	jsonOutput := flags.Bool("json", false, "以JSON格式输出，scan和dump每行输出一条数据")
+	useBase64 := flags.Bool("base64", false, "key和value使用base64编码，用于二进制数据")
+	historyFile := flags.String("history", defaultHistoryFile(), "交互模式的历史记录文件，为空时不保存")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: kvctl -dir <path> [options] [command [args]]\n\noptions:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(stderr, "\ncommands:\n")
+		printCommands(stderr)
+		fmt.Fprintf(stderr, "\nwithout a command, kvctl starts an interactive shell\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" {
+		fmt.Fprintln(stderr, "kvctl: -dir is required")
+		flags.Usage()
+		return 2
+	}
+	indexType, ok := indexTypes[*indexName]
+	if !ok {
+		fmt.Fprintf(stderr, "kvctl: unknown index type %q\n", *indexName)
+		flags.Usage()
+		return 2
+	}
+	if *dataFileSize <= 0 {
+		fmt.Fprintln(stderr, "kvctl: -data-file-size must be positive")
+		flags.Usage()
+		return 2
+	}
+
+	a := &app{dir: *dir, out: stdout, errOut: stderr, jsonOutput: *jsonOutput, base64: *useBase64}
+	if flags.NArg() == 0 || !offlineCommands[flags.Arg(0)] {
+		opts := bitcask.DefaultOptions
+		opts.DirPath = *dir
+		opts.IndexType = indexType
+		opts.DataFileSize = *dataFileSize
+		opts.ReadOnly = flags.NArg() > 0 && readOnlyCommands[flags.Arg(0)]
+		db, err := openDB(opts)
+		if err != nil {
+			a.printError(err)
+			return 1
+		}
+		a.db = db
+		defer func() {
+			_ = db.Close()
+		}()
+	}
+
+	if flags.NArg() == 0 {
+		if err := a.repl(stdin, *historyFile); err != nil {
+			a.printError(err)
+			return 1
+		}
+		return 0
+	}
+	if err := a.exec(flags.Args()); err != nil {
+		a.printError(err)
+		if errors.Is(err, errUsage) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// 打开已经存在的数据目录，不会创建新的目录
+func openDB(opts bitcask.Options) (*bitcask.DB, error) {
+	stat, err := os.Stat(opts.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", opts.DirPath)
+	}
+	return bitcask.Open(opts)
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kvctl_history")
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	bitcask "kv-bitcask"
+	"kv-bitcask/data"
+	"kv-bitcask/index"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 执行一次kvctl，返回退出码、标准输出和标准错误
+func runKvctl(t *testing.T, stdin string, args ...string) (int, string, string) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	code := run(args, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestKvctl_Commands(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-kvctl-1")
+	defer os.RemoveAll(dir)
+
+	code, stdout, _ := runKvctl(t, "", "-dir", dir, "put", "name", "bitcask")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "OK\n", stdout)
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "get", "name")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "bitcask\n", stdout)
+
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "-json", "put", "--ttl", "1h", "user-1", "tom")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "{\"ok\":true}\n", stdout)
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "-json", "get", "user-1")
+	assert.Equal(t, 0, code)
+	var result record
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &result))
+	assert.Equal(t, "tom", result.Value)
+	assert.True(t, result.TTL > 0)
+
+	// 二进制数据
+	code, _, _ = runKvctl(t, "", "-dir", dir, "-base64", "put", "AP8=", "AQI=")
+	assert.Equal(t, 0, code)
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "-base64", "get", "AP8=")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "AQI=\n", stdout)
+
+	code, _, _ = runKvctl(t, "", "-dir", dir, "put", "user-2", "jerry")
+	assert.Equal(t, 0, code)
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "scan", "--prefix", "user-")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "user-1\ttom\nuser-2\tjerry\n", stdout)
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "-json", "scan", "--prefix", "user-", "--reverse", "--limit", "1")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "{\"key\":\"user-2\",\"value\":\"jerry\"}\n", stdout)
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "dump")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, 4, strings.Count(stdout, "\n"))
+
+	code, _, _ = runKvctl(t, "", "-dir", dir, "del", "name")
+	assert.Equal(t, 0, code)
+	code, _, stderr := runKvctl(t, "", "-dir", dir, "get", "name")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "error: "+bitcask.ErrKeyNotFound.Error()+"\n", stderr)
+
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "-json", "stat")
+	assert.Equal(t, 0, code)
+	var stat statResult
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &stat))
+	assert.Equal(t, uint(3), stat.KeyNum)
+
+	code, _, _ = runKvctl(t, "", "-dir", dir, "merge")
+	assert.Equal(t, 0, code)
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-kvctl-backup")
+	defer os.RemoveAll(backupDir)
+	code, _, _ = runKvctl(t, "", "-dir", dir, "backup", backupDir)
+	assert.Equal(t, 0, code)
+	code, stdout, _ = runKvctl(t, "", "-dir", backupDir, "get", "user-2")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "jerry\n", stdout)
+
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "verify")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "2 files, 3 records checked, 0 problems\n", stdout)
+}
+
+func TestKvctl_Usage(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-kvctl-2")
+	defer os.RemoveAll(dir)
+
+	code, _, _ := runKvctl(t, "", "get", "k")
+	assert.Equal(t, 2, code)
+	code, _, _ = runKvctl(t, "", "-dir", dir, "unknown")
+	assert.Equal(t, 2, code)
+	code, _, stderr := runKvctl(t, "", "-dir", dir, "get")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "usage: get <key>")
+	code, _, _ = runKvctl(t, "", "-dir", dir, "put", "--ttl", "x", "k", "v")
+	assert.Equal(t, 2, code)
+
+	// 不会创建不存在的目录
+	missing := filepath.Join(dir, "missing")
+	code, _, _ = runKvctl(t, "", "-dir", missing, "stat")
+	assert.Equal(t, 1, code)
+	_, err := os.Stat(missing)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// 使用和数据库一致的索引类型和数据文件大小
+func TestKvctl_Options(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-kvctl-7")
+	defer os.RemoveAll(dir)
+
+	code, _, _ := runKvctl(t, "", "-dir", dir, "-index", "hash", "stat")
+	assert.Equal(t, 2, code)
+	code, _, _ = runKvctl(t, "", "-dir", dir, "-data-file-size", "0", "stat")
+	assert.Equal(t, 2, code)
+
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < 10; i++ {
+		code, _, _ = runKvctl(t, "", "-dir", dir, "-index", "bptree", "-data-file-size", "4096", "put", fmt.Sprintf("key-%d", i), value)
+		assert.Equal(t, 0, code)
+	}
+	dataFiles, _ := filepath.Glob(filepath.Join(dir, "*"+data.DataFileNameSuffix))
+	assert.True(t, len(dataFiles) > 1)
+	_, err := os.Stat(filepath.Join(dir, index.BPTreeFileName))
+	assert.Nil(t, err)
+
+	code, stdout, _ := runKvctl(t, "", "-dir", dir, "-index", "bptree", "get", "key-9")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, value+"\n", stdout)
+	_, err = os.Stat(filepath.Join(dir, index.BPTreeFileName))
+	assert.Nil(t, err)
+}
+
+func TestKvctl_Verify(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-kvctl-3")
+	defer os.RemoveAll(dir)
+
+	opts := bitcask.DefaultOptions
+	opts.DirPath = dir
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%04d", i))))
+	}
+	assert.Nil(t, db.Close())
+
+	code, stdout, _ := runKvctl(t, "", "-dir", dir, "verify")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "1 files, 100 records checked, 0 problems\n", stdout)
+
+	// 修改一条记录的value，CRC校验失败，数据库无法打开时也可以检查
+	fileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	i := bytes.Index(buf, []byte("value-0001"))
+	buf[i] = 'V'
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "-json", "verify")
+	assert.Equal(t, 1, code)
+	var result checkResult
+	assert.Nil(t, json.NewDecoder(strings.NewReader(stdout)).Decode(&result))
+	assert.Equal(t, 1, result.Files)
+	assert.Equal(t, int64(99), result.Records)
+	assert.Equal(t, 1, len(result.Problems))
+	assert.Equal(t, "000000000.data", result.Problems[0].File)
+	assert.Equal(t, data.ErrInvalidCRC.Error(), result.Problems[0].Error)
+
+	// 检查不会修改文件
+	after, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, buf, after)
+
+	// 修复之后检查通过，损坏的记录丢失
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "-json", "repair")
+	assert.Equal(t, 0, code)
+	var repaired repairResult
+	assert.Nil(t, json.NewDecoder(strings.NewReader(stdout)).Decode(&repaired))
+	assert.Equal(t, []uint32{0}, repaired.Files)
+	assert.Equal(t, int64(99), repaired.Records)
+	assert.Equal(t, result.Problems, repaired.Lost)
+	_, err = os.Stat(filepath.Join(repaired.BackupDir, "000000000.data"))
+	assert.Nil(t, err)
+
+	code, _, _ = runKvctl(t, "", "-dir", dir, "verify")
+	assert.Equal(t, 0, code)
+	code, _, stderr := runKvctl(t, "", "-dir", dir, "get", "key-0001")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, bitcask.ErrKeyNotFound.Error())
+	code, stdout, _ = runKvctl(t, "", "-dir", dir, "repair")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "nothing to repair\n", stdout)
+}
+
+func TestKvctl_ReadOnly(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-kvctl-5")
+	defer os.RemoveAll(dir)
+
+	code, _, _ := runKvctl(t, "", "-dir", dir, "put", "name", "bitcask")
+	assert.Equal(t, 0, code)
+
+	// 读取的命令以只读方式打开，可以和其他只读实例同时使用
+	opts := bitcask.DefaultOptions
+	opts.DirPath = dir
+	opts.ReadOnly = true
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	code, stdout, _ := runKvctl(t, "", "-dir", dir, "get", "name")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "bitcask\n", stdout)
+	code, _, _ = runKvctl(t, "", "-dir", dir, "stat")
+	assert.Equal(t, 0, code)
+	code, _, stderr := runKvctl(t, "", "-dir", dir, "put", "name", "kv")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, bitcask.ErrDatabaseIsUsing.Error())
+}
+
+func TestKvctl_Repl(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-kvctl-4")
+	defer os.RemoveAll(dir)
+	historyFile := filepath.Join(dir, "history")
+
+	input := strings.Join([]string{
+		`put "hello world" 'a b'`,
+		`get "hello world"`,
+		`!!`,
+		`get missing`,
+		`get "unterminated`,
+		`history`,
+		`exit`,
+		`get never-run`,
+	}, "\n")
+	code, stdout, stderr := runKvctl(t, input, "-dir", dir, "-history", historyFile)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, 2, strings.Count(stdout, "a b\n"))
+	assert.Contains(t, stdout, "    3  get \"hello world\"\n")
+	assert.Contains(t, stderr, bitcask.ErrKeyNotFound.Error())
+	assert.Contains(t, stderr, "unterminated")
+	assert.NotContains(t, stderr, "never-run")
+
+	// 历史记录保存到文件，下次启动时可以使用
+	buf, err := os.ReadFile(historyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, strings.Count(string(buf), "\n"))
+	code, stdout, _ = runKvctl(t, "!2\n", "-dir", dir, "-history", historyFile)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "a b\n")
+}
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`put  "a b" 'c "d"' e\ f ""`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"put", "a b", `c "d"`, "e f", ""}, args)
+	_, err = splitArgs(`get 'a`)
+	assert.NotNil(t, err)
+}
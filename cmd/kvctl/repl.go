@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 历史记录文件中最多保存的命令数量
+const maxHistory = 1000
+
+// 交互模式，逐行读取并执行命令，直到输入exit或者读到EOF
+// 历史记录在启动时从文件加载，退出时写回；!!执行上一条命令，!n执行第n条命令
+func (a *app) repl(in io.Reader, historyFile string) error {
+	history := loadHistory(historyFile)
+	defer func() {
+		if err := saveHistory(historyFile, history); err != nil {
+			fmt.Fprintf(a.errOut, "save history: %v\n", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for {
+		fmt.Fprint(a.out, "kvctl> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(a.out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// 展开历史记录
+		if strings.HasPrefix(line, "!") {
+			expanded, err := expandHistory(line, history)
+			if err != nil {
+				a.printError(err)
+				continue
+			}
+			line = expanded
+			fmt.Fprintln(a.out, line)
+		}
+		history = append(history, line)
+		if len(history) > maxHistory {
+			history = history[len(history)-maxHistory:]
+		}
+
+		args, err := splitArgs(line)
+		if err != nil {
+			a.printError(err)
+			continue
+		}
+		switch args[0] {
+		case "exit", "quit":
+			return nil
+		case "help":
+			printCommands(a.out)
+			fmt.Fprintf(a.out, "  %-45s %s\n", "history", "查看历史记录，!!执行上一条命令，!n执行第n条命令")
+			fmt.Fprintf(a.out, "  %-45s %s\n", "exit", "退出")
+		case "history":
+			for i, cmd := range history {
+				fmt.Fprintf(a.out, "%5d  %s\n", i+1, cmd)
+			}
+		default:
+			if err := a.exec(args); err != nil {
+				a.printError(err)
+			}
+		}
+	}
+}
+
+func expandHistory(line string, history []string) (string, error) {
+	if line == "!!" {
+		if len(history) == 0 {
+			return "", errors.New("no previous command")
+		}
+		return history[len(history)-1], nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(history) {
+		return "", fmt.Errorf("%s: event not found", line)
+	}
+	return history[n-1], nil
+}
+
+func loadHistory(historyFile string) []string {
+	if historyFile == "" {
+		return nil
+	}
+	buf, err := os.ReadFile(historyFile)
+	if err != nil {
+		return nil
+	}
+	var history []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line != "" {
+			history = append(history, line)
+		}
+	}
+	return history
+}
+
+func saveHistory(historyFile string, history []string) error {
+	if historyFile == "" || len(history) == 0 {
+		return nil
+	}
+	return os.WriteFile(historyFile, []byte(strings.Join(history, "\n")+"\n"), 0600)
+}
+
+// 拆分交互模式输入的一行，支持单引号、双引号和反斜杠转义
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg, escaped := false, false
+	for _, ch := range line {
+		switch {
+		case escaped:
+			current.WriteRune(ch)
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else {
+				current.WriteRune(ch)
+			}
+		case ch == '"' || ch == '\'':
+			quote, inArg = ch, true
+		case ch == ' ' || ch == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(ch)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("%w: unterminated quote or escape", errUsage)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -10,9 +10,16 @@ import (
 )
 
 var (
-	ErrInvalidCRC = errors.New("invalid crc")
+	ErrInvalidCRC             = errors.New("invalid crc")
+	ErrLogRecordTruncated     = errors.New("log record is truncated")
+	ErrInvalidLogRecordHeader = errors.New("invalid log record header")
 )
 
+// IsCorrupted 判断读取LogRecord时的错误是否是数据损坏导致的
+func IsCorrupted(err error) bool {
+	return err == ErrInvalidCRC || err == ErrLogRecordTruncated || err == ErrInvalidLogRecordHeader
+}
+
 // DataFile 数据文件，bitcask里面包括的主体，分为active和non-active
 type DataFile struct {
 	FileId    uint32        // 文件ID
@@ -21,14 +28,39 @@ type DataFile struct {
 }
 
 const (
-	DataFileNameSuffix = ".data"
+	DataFileNameSuffix    = ".data"
+	HintFileNameSuffix    = ".hint"
+	MergeFinishedFileName = "merge-finished"
 )
 
-// OpenDataFile 打开新的数据文件
-func OpenDataFile(dirPath string, fileId uint32) (*DataFile, error) {
-	fileName := filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
+// GetDataFileName 获取数据文件的完整路径
+func GetDataFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
+}
+
+// GetHintFileName 获取数据文件对应的hint文件的完整路径
+func GetHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+HintFileNameSuffix)
+}
+
+// OpenDataFile 打开新的数据文件，ioType为MemoryMap时只能读取
+func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	return newDataFile(GetDataFileName(dirPath, fileId), fileId, ioType)
+}
+
+// OpenHintFile 打开数据文件对应的hint文件，hint文件中只保存key及其索引位置
+func OpenHintFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+	return newDataFile(GetHintFileName(dirPath, fileId), fileId, ioType)
+}
+
+// OpenMergeFinishedFile 打开标识merge完成的文件
+func OpenMergeFinishedFile(dirPath string, ioType fio.FileIOType) (*DataFile, error) {
+	return newDataFile(filepath.Join(dirPath, MergeFinishedFileName), 0, ioType)
+}
+
+func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	// 初始化IO管理器
-	ioManager, err := fio.NewFileIOManager(fileName)
+	ioManager, err := fio.NewIOManager(fileName, ioType)
 	if err != nil {
 		return nil, err
 	}
@@ -39,10 +71,27 @@ func OpenDataFile(dirPath string, fileId uint32) (*DataFile, error) {
 	}, nil
 }
 
+// SetIOManager 关闭当前的IO管理器，换成指定类型的IO管理器
+func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
+	if err := df.IOManager.Close(); err != nil {
+		return err
+	}
+	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType)
+	if err != nil {
+		return err
+	}
+	df.IOManager = ioManager
+	return nil
+}
+
 func (df *DataFile) Sync() error {
 	return df.IOManager.Sync()
 }
 
+func (df *DataFile) Close() error {
+	return df.IOManager.Close()
+}
+
 func (df *DataFile) Write(buf []byte) error {
 	size, err := df.IOManager.Write(buf)
 	if err != nil {
@@ -53,11 +102,15 @@ func (df *DataFile) Write(buf []byte) error {
 }
 
 // ReadLogRecord 根据给定的offset，读取该位置的LogRecord
+// 记录超出了文件末尾时返回ErrLogRecordTruncated，CRC校验失败时返回ErrInvalidCRC，同时返回记录的长度
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	fileSize, err := df.IOManager.Size()
 	if err != nil {
 		return nil, 0, err
 	}
+	if offset >= fileSize {
+		return nil, 0, io.EOF
+	}
 
 	// 如果读取的header长度大于文件的大小，则直接读取到文件的结尾即可
 	var headerBytes int64 = maxLogRecordHeaderSize
@@ -74,7 +127,11 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	header, headerSize := decodeLogRecordHeader(headerBuf)
 	// 判断头文件是否有效
 	if header == nil {
-		return nil, 0, io.EOF
+		// 文件末尾剩余的数据不足一个完整的header
+		if headerBytes < maxLogRecordHeaderSize {
+			return nil, 0, ErrLogRecordTruncated
+		}
+		return nil, 0, ErrInvalidLogRecordHeader
 	}
 	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
 		return nil, 0, io.EOF
@@ -83,8 +140,11 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 提取key value的长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
+	if offset+recordSize > fileSize {
+		return nil, 0, ErrLogRecordTruncated
+	}
 
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{Type: header.recordType, SeqNo: header.seqNo, Expire: header.expire}
 	// 读取实际的key value值
 	if keySize > 0 || valueSize > 0 {
 		kvBuf, err := df.ReadNBytes(keySize+valueSize, offset+headerSize)
@@ -99,7 +159,7 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 验证CRC
 	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
 	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+		return nil, recordSize, ErrInvalidCRC
 	}
 	return logRecord, recordSize, nil
 }
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"math"
 )
 
 // LogRecordType 描述该行记录是否应被删除
@@ -11,39 +12,68 @@ type LogRecordType = byte
 const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
+	LogRecordBatchFinished // 批次提交完成的标识
+	LogRecordHistory       // merge时为存活的快照保留的历史版本，启动时不会加载到索引中
+)
+
+// 类型字节的高位作为标志位，标识header中是否带有可选字段，不带可选字段的记录编码保持不变
+const (
+	logRecordTypeMask   byte = 0x3f
+	logRecordSeqFlag    byte = 0x40 // header中带有批次序列号
+	logRecordExpireFlag byte = 0x80 // header中带有过期时间
 )
 
 // LogRecord头部信息
-// crc	 type	keySize	valueSize
+// crc	 type	keySize	valueSize	seqNo	expire
 //
-//	4      1      5         5
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+//	4      1      5         5        10      10
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64*2 + 5
 
 type LogRecordHeader struct {
 	crc        uint32        // crc校验码
 	recordType LogRecordType // 类型记录
 	keySize    uint32
 	valueSize  uint32
+	seqNo      uint64 // 批次序列号，不属于批次的记录为0
+	expire     int64  // 过期时间，没有设置过期时间的记录为0
 }
 
 // LogRecordPos 数据内存索引，描述数据在磁盘的位置
 type LogRecordPos struct {
 	Fid    uint32 // 文件 id，表示数据存储在哪个文件
 	Offset int64  // 偏移量，表示将数据存储在数据文件的那个位置
+	Size   uint32 // 标识数据在磁盘上的大小
+	Expire int64  // 过期时间，UnixNano，0表示永不过期
+
+	// Version 写入这条数据时的提交序列号，用于事务的冲突检测，不会写入hint文件
+	// 启动时从数据文件加载的数据版本为0，早于所有之后开始的事务
+	Version uint64
+}
+
+// IsExpired 判断数据在now（UnixNano）时是否已经过期
+func (pos *LogRecordPos) IsExpired(now int64) bool {
+	return pos.Expire > 0 && pos.Expire <= now
 }
 
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType
+	SeqNo  uint64 // 所属批次的序列号，0表示不属于任何批次
+	Expire int64  // 过期时间，UnixNano，0表示永不过期
+}
+
+// IsExpired 判断记录在now（UnixNano）时是否已经过期
+func (lr *LogRecord) IsExpired(now int64) bool {
+	return lr.Expire > 0 && lr.Expire <= now
 }
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
 //
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	    4字节          1字节        变长（最大5）   变长（最大5）        变长           变长
+//	+-------------+-------------+-------------+--------------+---------------+---------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |  seq 批次序号  | expire 过期时间 |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+---------------+---------------+-------------+--------------+
+//	    4字节          1字节        变长（最大5）   变长（最大5）  可选，变长（最大10） 可选，变长（最大10）   变长           变长
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	// 初始化Header字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
@@ -55,6 +85,18 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
 
+	// 属于批次的记录需要保存序列号
+	if logRecord.SeqNo > 0 {
+		header[4] |= logRecordSeqFlag
+		index += binary.PutUvarint(header[index:], logRecord.SeqNo)
+	}
+
+	// 设置了过期时间的记录需要保存过期时间
+	if logRecord.Expire != 0 {
+		header[4] |= logRecordExpireFlag
+		index += binary.PutVarint(header[index:], logRecord.Expire)
+	}
+
 	// 最终生成的字节数组的大小
 	var size = index + len(logRecord.Key) + len(logRecord.Value)
 	encBytes := make([]byte, size)
@@ -80,20 +122,46 @@ func decodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 
 	header := &LogRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		recordType: buf[4] & logRecordTypeMask,
 	}
 
 	var index = 5
-	// 取出key size
+	// 取出key size，数据不完整或者长度不合法时header无效
 	keySize, n := binary.Varint(buf[index:])
+	if n <= 0 || keySize < 0 || keySize > math.MaxUint32 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 
 	// 取出value size
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 || valueSize < 0 || valueSize > math.MaxUint32 {
+		return nil, 0
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	// 取出批次序列号
+	if buf[4]&logRecordSeqFlag != 0 {
+		seqNo, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.seqNo = seqNo
+		index += n
+	}
+
+	// 取出过期时间
+	if buf[4]&logRecordExpireFlag != 0 {
+		expire, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.expire = expire
+		index += n
+	}
+
 	return header, int64(index)
 }
 
@@ -108,3 +176,24 @@ func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
 
 	return crc
 }
+
+// EncodeLogRecordPos 对位置信息进行编码，用于写入hint文件
+func EncodeLogRecordPos(pos *LogRecordPos) []byte {
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	var index = 0
+	index += binary.PutVarint(buf[index:], int64(pos.Fid))
+	index += binary.PutVarint(buf[index:], pos.Offset)
+	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	return buf[:index]
+}
+
+// DecodeLogRecordPos 解码位置信息
+func DecodeLogRecordPos(buf []byte) *LogRecordPos {
+	var index = 0
+	fileId, n := binary.Varint(buf[index:])
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	index += n
+	size, _ := binary.Varint(buf[index:])
+	return &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+}
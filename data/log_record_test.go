@@ -96,3 +96,72 @@ func TestGetLogRecordCRC(t *testing.T) {
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
 }
+
+func TestEncodeLogRecordPos(t *testing.T) {
+	pos1 := &LogRecordPos{Fid: 1, Offset: 1024, Size: 18}
+	res1 := EncodeLogRecordPos(pos1)
+	assert.NotNil(t, res1)
+	assert.Equal(t, pos1, DecodeLogRecordPos(res1))
+
+	pos2 := &LogRecordPos{Fid: 1 << 30, Offset: 1 << 40, Size: 1 << 31}
+	res2 := EncodeLogRecordPos(pos2)
+	assert.Equal(t, pos2, DecodeLogRecordPos(res2))
+}
+
+func TestEncodeLogRecord_SeqNo(t *testing.T) {
+	// 属于批次的记录
+	record1 := &LogRecord{
+		Key:   []byte("name"),
+		Value: []byte("bitcask"),
+		Type:  LogRecordDeleted,
+		SeqNo: 300,
+	}
+	res1, n1 := EncodeLogRecord(record1)
+	assert.Equal(t, int64(20), n1)
+	h1, size1 := decodeLogRecordHeader(res1)
+	assert.Equal(t, int64(9), size1)
+	assert.Equal(t, LogRecordDeleted, h1.recordType)
+	assert.Equal(t, uint64(300), h1.seqNo)
+	assert.Equal(t, h1.crc, getLogRecordCRC(record1, res1[crc32.Size:size1]))
+
+	// 批次完成的标识
+	record2 := &LogRecord{
+		Key:   []byte("batch.finished"),
+		Type:  LogRecordBatchFinished,
+		SeqNo: 1,
+	}
+	res2, _ := EncodeLogRecord(record2)
+	h2, _ := decodeLogRecordHeader(res2)
+	assert.Equal(t, LogRecordBatchFinished, h2.recordType)
+	assert.Equal(t, uint64(1), h2.seqNo)
+}
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	// 设置了过期时间，同时属于批次
+	record1 := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask"),
+		Type:   LogRecordNormal,
+		SeqNo:  300,
+		Expire: 1700000000000000000,
+	}
+	res1, _ := EncodeLogRecord(record1)
+	h1, size1 := decodeLogRecordHeader(res1)
+	assert.Equal(t, LogRecordNormal, h1.recordType)
+	assert.Equal(t, uint64(300), h1.seqNo)
+	assert.Equal(t, int64(1700000000000000000), h1.expire)
+	assert.Equal(t, h1.crc, getLogRecordCRC(record1, res1[crc32.Size:size1]))
+
+	// 只设置了过期时间
+	record2 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask"), Expire: 100}
+	res2, _ := EncodeLogRecord(record2)
+	h2, _ := decodeLogRecordHeader(res2)
+	assert.Equal(t, uint64(0), h2.seqNo)
+	assert.Equal(t, int64(100), h2.expire)
+	assert.True(t, record2.IsExpired(100))
+	assert.False(t, record2.IsExpired(99))
+
+	// 没有设置过期时间的记录永不过期
+	record3 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask")}
+	assert.False(t, record3.IsExpired(1<<62))
+}
@@ -1,26 +1,49 @@
 package kv_bitcask
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"kv-bitcask/data"
+	"kv-bitcask/fio"
 	"kv-bitcask/index"
+	"kv-bitcask/utils"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // DB bitcask存储引擎实例
 type DB struct {
-	options    Options
-	mu         *sync.RWMutex
-	fileIds    []int // 仅用于一开始加载实例
-	activeFile *data.DataFile
-	olderFiles map[uint32]*data.DataFile
-	index      index.Indexer
+	options     Options
+	mu          *sync.RWMutex
+	fileIds     []int // 仅用于一开始加载实例
+	activeFile  *data.DataFile
+	olderFiles  map[uint32]*data.DataFile
+	index       index.Indexer
+	isClosed    bool             // 数据库是否已关闭
+	isMerging   bool             // 是否正在merge
+	hintWg      *sync.WaitGroup  // 等待后台生成hint文件的任务
+	mergeWg     *sync.WaitGroup  // 等待正在进行的merge和后台自动merge的任务
+	syncWg      *sync.WaitGroup  // 等待后台定期持久化的任务
+	closeCh     chan struct{}    // 关闭数据库时关闭，通知后台任务退出
+	seqNo       uint64           // 最新的提交序列号，每次写入和批次提交都会递增
+	snapshots   map[uint64]int   // 存活的快照，创建时的提交序列号 -> 快照数量
+	versions    *versionStore    // 快照存活期间被覆盖或删除的旧版本
+	reclaimSize map[uint32]int64 // 每个数据文件中可以被merge回收的数据大小
+	fileLock    *utils.FileLock  // 目录文件锁，保证同一时刻只有一个进程打开数据目录
+
+	writtenBytes uint64       // 打开之后写入的总字节数，作为写入的位置判断是否已经持久化
+	syncer       *groupSyncer // 合并等待持久化的写入
 }
 
+const fileLockName = "flock"
+
 // Open 根据配置项打开一个DB实例
 func Open(options Options) (*DB, error) {
 	// 校验配置项options
@@ -28,64 +51,295 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
-	// 判断目录是否存在，不存在则创建
+	// 判断目录是否存在，不存在则创建，只读模式下目录必须存在
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
+		if options.ReadOnly {
+			return nil, err
+		}
 		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
+	// 对数据目录加锁，判断是否有其他进程正在使用
+	fileLock := utils.NewFileLock(filepath.Join(options.DirPath, fileLockName))
+	hold, err := tryLockDir(fileLock, options.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+
 	// 初始化DB实例
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType),
+		options:     options,
+		mu:          new(sync.RWMutex),
+		olderFiles:  make(map[uint32]*data.DataFile),
+		fileLock:    fileLock,
+		hintWg:      new(sync.WaitGroup),
+		mergeWg:     new(sync.WaitGroup),
+		syncWg:      new(sync.WaitGroup),
+		closeCh:     make(chan struct{}),
+		snapshots:   make(map[uint64]int),
+		versions:    newVersionStore(),
+		reclaimSize: make(map[uint32]int64),
+	}
+	db.syncer = newGroupSyncer(db.syncActiveFile)
+
+	// 上次运行时完成但还没有替换的merge会改变数据的位置，持久化的索引需要重建
+	_, _, _, mergeFinished, err := readMergeFinished(filepath.Join(options.DirPath, mergeDirName))
+	if err != nil {
+		db.abortOpen()
+		return nil, err
+	}
+
+	// 加载merge目录，完成上一次未完成的文件替换
+	// 只读模式下不能替换文件，未完成的merge不影响旧文件，直接忽略
+	if options.ReadOnly && mergeFinished {
+		db.abortOpen()
+		return nil, fmt.Errorf("%w: a finished merge must be applied by opening in read-write mode", ErrReadOnly)
+	}
+	if !options.ReadOnly {
+		if err := db.loadMergeFiles(); err != nil {
+			db.abortOpen()
+			return nil, err
+		}
+	}
+
+	// 打开索引
+	if err := db.openIndex(mergeFinished); err != nil {
+		db.abortOpen()
+		return nil, err
 	}
 
 	// 加载数据文件
 	if err := db.loadDataFiles(); err != nil {
+		db.abortOpen()
 		return nil, err
 	}
 
 	// 加载索引文件
 	if err := db.loadIndexFromDataFiles(); err != nil {
+		db.abortOpen()
 		return nil, err
 	}
+
+	// 加载完成后数据文件换回标准IO，active文件需要继续写入
+	if db.options.MMapAtStartup && !db.options.ReadOnly {
+		if err := db.resetIoType(); err != nil {
+			db.abortOpen()
+			return nil, err
+		}
+	}
+
+	// 启动后台自动merge的任务
+	if db.options.MergeCheckInterval > 0 && !db.options.ReadOnly {
+		db.mergeWg.Add(1)
+		go db.autoMerge()
+	}
+
+	// 启动后台定期持久化的任务
+	if db.options.SyncInterval > 0 && !db.options.ReadOnly {
+		db.syncWg.Add(1)
+		go db.syncPeriodically()
+	}
 	return db, nil
 }
 
-// Close 关闭数据库
-func (db *DB) Close() error {
+// 对数据目录加锁，只读模式下加共享锁
+// 锁文件不存在说明目录没有以读写方式打开过，只读模式下不创建锁文件，直接打开
+func tryLockDir(fileLock *utils.FileLock, readOnly bool) (bool, error) {
+	if !readOnly {
+		return fileLock.TryLock()
+	}
+	hold, err := fileLock.TryRLock()
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return hold, err
+}
+
+// 打开失败时关闭已打开的数据文件和索引并释放目录锁
+func (db *DB) abortOpen() {
+	for _, dataFile := range db.olderFiles {
+		_ = dataFile.Close()
+	}
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	// 没有设置检查点，持久化的索引下次打开时会重建
+	if db.index != nil {
+		_ = db.index.Close()
+	}
+	_ = db.fileLock.Unlock()
+}
+
+// 打开索引，reset为true时先删除持久化的索引文件
+func (db *DB) openIndex(reset bool) error {
+	indexType := db.options.IndexType
+	switch {
+	case db.options.ReadOnly:
+		// 持久化的索引打开时就会写入文件，只读模式下改用内存索引
+		if indexType == index.BPTree {
+			indexType = index.Btree
+		}
+	case reset || indexType != index.BPTree:
+		// 使用其他类型的索引时不会维护持久化的B+树索引，之后的写入和merge会让它失效
+		err := os.Remove(filepath.Join(db.options.DirPath, index.BPTreeFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	indexer, err := index.NewIndexer(indexType, db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	db.index = indexer
 	return nil
 }
 
-// Put 写入key-val，key不为空，加锁在appendLogRecord中考虑
+// Close 关闭数据库，持久化并关闭所有数据文件，之后的读写操作都会返回ErrDBClosed
+func (db *DB) Close() error {
+	db.mu.Lock()
+	// 重复关闭直接返回
+	if db.isClosed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.isClosed = true
+	close(db.closeCh)
+	db.mu.Unlock()
+
+	// 等待merge、后台生成hint文件和定期持久化的任务结束，这些任务都需要访问数据文件
+	db.mergeWg.Wait()
+	db.hintWg.Wait()
+	db.syncWg.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 检查点需要读取active文件的内容，在关闭数据文件之前生成
+	checkpointer, isCheckpointer := db.index.(index.Checkpointer)
+	var checkpoint *indexCheckpoint
+	var err error
+	if isCheckpointer {
+		checkpoint, err = db.newIndexCheckpoint()
+	}
+	if closeErr := db.closeDataFiles(); err == nil {
+		err = closeErr
+	}
+
+	// 数据文件都已经持久化，持久化的索引保存检查点，下次打开时不需要回放之前的数据
+	if isCheckpointer && err == nil {
+		checkpointer.SetCheckpoint(checkpoint.encode())
+	}
+	if indexErr := db.index.Close(); err == nil {
+		err = indexErr
+	}
+
+	// 释放目录锁
+	if unlockErr := db.fileLock.Unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// 持久化并关闭所有数据文件，出错时仍会继续关闭剩余文件，返回第一个错误
+func (db *DB) closeDataFiles() error {
+	var firstErr error
+	saveErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// active文件可能还有未持久化的数据
+	if db.activeFile != nil {
+		if !db.options.ReadOnly {
+			saveErr(db.activeFile.Sync())
+		}
+		saveErr(db.activeFile.Close())
+	}
+	// older文件在转换时已经持久化过，直接关闭
+	for _, dataFile := range db.olderFiles {
+		saveErr(dataFile.Close())
+	}
+	return firstErr
+}
+
+// NoExpiration key没有设置过期时间时TTL的返回值
+const NoExpiration time.Duration = -1
+
+// Put 写入key-val，key不为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.put(key, value, 0)
+}
+
+// PutWithTTL 写入key-val，并设置过期时间，过期之后key被视为不存在，merge时会被清理
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// 写入key-val，expire为过期时间，0表示永不过期
+func (db *DB) put(key []byte, value []byte, expire int64) error {
 	// 判断是否为空
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if err := db.checkKeySize(key); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	written, err := db.putLocked(key, value, expire)
+	db.mu.Unlock()
+	if err != nil || !db.options.SyncWrites {
+		return err
+	}
+	// 释放锁之后再等待持久化，并发的写入可以共享同一次fsync
+	return db.syncer.wait(written)
+}
+
+// 写入记录并更新索引，返回写入的位置，调用方需持有db.mu写锁
+func (db *DB) putLocked(key []byte, value []byte, expire int64) (uint64, error) {
+	if db.isClosed {
+		return 0, ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
 
 	// 创建LogRecord格式文件，即为行记录
 	logRecord := &data.LogRecord{
-		Key:   key,
-		Value: value,
-		Type:  data.LogRecordNormal,
+		Key:    key,
+		Value:  value,
+		Type:   data.LogRecordNormal,
+		Expire: expire,
 	}
 
 	// 插入到当前活跃active文件中
 	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	pos.Expire = expire
+	db.seqNo++
+	pos.Version = db.seqNo
+
+	// 旧的数据被覆盖之后可以被回收
+	oldPos := db.index.Get(key)
+	db.saveVersion(key, db.seqNo, oldPos)
+	db.addReclaimSize(oldPos)
 
 	// 添加内存索引
 	if ok := db.index.Put(key, pos); !ok {
-		return ErrIndexUpdateFailed
+		return 0, ErrIndexUpdateFailed
 	}
-
-	return nil
+	return db.writtenBytes, nil
 }
 
 // Delete 根据key删除对应的数据
@@ -94,26 +348,57 @@ func (db *DB) Delete(key []byte) error {
 		return ErrKeyIsEmpty
 	}
 
+	db.mu.Lock()
+	written, err := db.deleteLocked(key)
+	db.mu.Unlock()
+	if err != nil || !db.options.SyncWrites {
+		return err
+	}
+	return db.syncer.wait(written)
+}
+
+// 写入墓碑值并删除索引，返回写入的位置，没有写入时返回0，调用方需持有db.mu写锁
+func (db *DB) deleteLocked(key []byte) (uint64, error) {
+	if db.isClosed {
+		return 0, ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
 	// 判断key是否存在，不存在则不添加新的记录进去
-	if pos := db.index.Get(key); pos == nil {
-		return nil
+	pos := db.index.Get(key)
+	if pos == nil {
+		return 0, nil
+	}
+	// 已经过期的key重启时也不会被加载，不需要写入墓碑值
+	if pos.IsExpired(time.Now().UnixNano()) {
+		db.index.Delete(key)
+		db.addReclaimSize(pos)
+		return 0, nil
 	}
 
 	// 构造LogRecord，标记墓碑值
 	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
 
 	// 写入
-	_, err := db.appendLogRecord(logRecord)
+	tombstonePos, err := db.appendLogRecord(logRecord)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	db.seqNo++
+	db.saveVersion(key, db.seqNo, pos)
+
+	// 被删除的数据和墓碑值本身都可以被回收
+	db.addReclaimSize(pos)
+	db.addReclaimSize(tombstonePos)
 
 	// 从内存索引中删除
 	ok := db.index.Delete(key)
 	if !ok {
-		return ErrIndexUpdateFailed
+		return 0, ErrIndexUpdateFailed
 	}
-	return nil
+	return db.writtenBytes, nil
 }
 
 // Get 根据key读取数据
@@ -121,6 +406,10 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
+	if db.isClosed {
+		return nil, ErrDBClosed
+	}
+
 	// 判断key是否有效
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
@@ -129,13 +418,106 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	// 从内存数据结构获取key对应索引信息
 	LogRecordPos := db.index.Get(key)
 	// 看key是否在索引中
-	if LogRecordPos == nil {
+	if LogRecordPos == nil || LogRecordPos.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 
+	return db.getValueByPosition(LogRecordPos)
+}
+
+// TTL 获取key剩余的存活时间，没有设置过期时间时返回NoExpiration
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.isClosed {
+		return 0, ErrDBClosed
+	}
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+
+	pos := db.index.Get(key)
+	now := time.Now().UnixNano()
+	if pos == nil || pos.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if pos.Expire == 0 {
+		return NoExpiration, nil
+	}
+	return time.Duration(pos.Expire - now), nil
+}
+
+// ListKeys 获取数据库中所有的key，按从小到大的顺序返回，数据库已经关闭时返回nil
+func (db *DB) ListKeys() [][]byte {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.isClosed {
+		return nil
+	}
+
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+
+	var keys [][]byte
+	now := time.Now().UnixNano()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if !iterator.Value().IsExpired(now) {
+			keys = append(keys, iterator.Key())
+		}
+	}
+	return keys
+}
+
+// Fold 按key从小到大遍历所有的数据，并执行用户指定的操作，fn返回false时终止遍历
+// 遍历期间持有读锁，看到的是一致的数据，fn中不能对数据库进行写操作
+func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.isClosed {
+		return ErrDBClosed
+	}
+
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	now := time.Now().UnixNano()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		value, err := db.getValueByPosition(iterator.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// 校验key的长度，B+树索引的每个页需要放下多条数据，key的长度有上限
+func (db *DB) checkKeySize(key []byte) error {
+	if db.options.IndexType == index.BPTree && len(key) > index.BPTreeMaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// 记录可以被merge回收的数据，调用方需持有db.mu写锁
+func (db *DB) addReclaimSize(pos *data.LogRecordPos) {
+	if pos != nil {
+		db.reclaimSize[pos.Fid] += int64(pos.Size)
+	}
+}
+
+// 根据索引信息读取对应的value，调用方需持有db.mu读锁
+func (db *DB) getValueByPosition(LogRecordPos *data.LogRecordPos) ([]byte, error) {
 	// 根据文件ID找到对应的文件
 	var dataFile *data.DataFile
-	if db.activeFile.FileId == LogRecordPos.Fid {
+	if db.activeFile != nil && db.activeFile.FileId == LogRecordPos.Fid {
 		dataFile = db.activeFile
 	} else {
 		dataFile = db.olderFiles[LogRecordPos.Fid]
@@ -152,19 +534,16 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	// 墓碑值
-	if logRecord.Type == data.LogRecordDeleted {
+	// 墓碑值或者已经过期
+	if logRecord.Type == data.LogRecordDeleted || logRecord.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 
 	return logRecord.Value, nil
 }
 
-// 追加写的方式，写入active文件
+// 追加写的方式，写入active文件，调用方需持有db.mu写锁
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
 	// 判断当前是否存在active文件，如果没有则需要进行初始化
 	if db.activeFile == nil {
 		if err := db.setActiveDataFile(); err != nil {
@@ -181,9 +560,12 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		if err := db.activeFile.Sync(); err != nil {
 			return nil, err
 		}
+		db.syncer.markSynced(db.writtenBytes)
 
-		// 当前文件加入到不活跃状态
+		// 当前文件加入到不活跃状态，并在后台为其生成hint文件
 		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		db.hintWg.Add(1)
+		go db.generateHintFile(db.activeFile)
 
 		// 开新页
 		if err := db.setActiveDataFile(); err != nil {
@@ -197,25 +579,36 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		return nil, err
 	}
 
-	// 根据用户配置决定是否持久化
-	if db.options.SyncWrites {
+	db.writtenBytes += uint64(size)
+
+	// 累计写入的数据达到BytesPerSync时持久化，SyncWrites的持久化由写入方释放锁之后合并执行
+	if db.options.BytesPerSync > 0 && db.writtenBytes-db.syncer.syncedPos() >= uint64(db.options.BytesPerSync) {
 		if err := db.activeFile.Sync(); err != nil {
 			return nil, err
 		}
+		db.syncer.markSynced(db.writtenBytes)
 	}
 
 	// 构造内存索引
-	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff}
+	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size)}
 	return pos, nil
 }
 
-// 设置active文件
+// 设置active文件，只读模式下不会创建新的文件
 func (db *DB) setActiveDataFile() error {
 	var initialFileId uint32 = 0
 	if db.activeFile != nil {
 		initialFileId = db.activeFile.FileId + 1
 	}
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId)
+	return db.openActiveDataFile(initialFileId)
+}
+
+// 使用指定的id打开新的active文件
+func (db *DB) openActiveDataFile(fileId uint32) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	dataFile, err := data.OpenDataFile(db.options.DirPath, fileId, fio.StandardFIO)
 	if err != nil {
 		return err
 	}
@@ -233,6 +626,13 @@ func (db *DB) loadDataFiles() error {
 	var fileIds []int
 	// 遍历目录中所有文件，找到所有以.data结尾的文件
 	for _, entry := range dirEntries {
+		// 清理崩溃时残留的hint临时文件
+		if strings.HasSuffix(entry.Name(), data.HintFileNameSuffix+hintTmpFileSuffix) && !db.options.ReadOnly {
+			if err := os.Remove(filepath.Join(db.options.DirPath, entry.Name())); err != nil {
+				return err
+			}
+			continue
+		}
 		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
 			splitName := strings.Split(entry.Name(), ".")
 			fileId, err := strconv.Atoi(splitName[0])
@@ -247,9 +647,18 @@ func (db *DB) loadDataFiles() error {
 	sort.Ints(fileIds)
 	db.fileIds = fileIds
 
+	// 启动时只需要读取数据，可以使用内存映射加快索引的加载
+	// 只读模式下所有文件都以只读方式打开，不会创建文件
+	ioType := fio.StandardFIO
+	if db.options.ReadOnly {
+		ioType = fio.ReadOnlyFIO
+	} else if db.options.MMapAtStartup {
+		ioType = fio.MemoryMap
+	}
+
 	// 遍历每个文件id，打开对应的数据文件
 	for i, fid := range fileIds {
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid))
+		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType)
 		if err != nil {
 			return err
 		}
@@ -263,6 +672,22 @@ func (db *DB) loadDataFiles() error {
 	return nil
 }
 
+// 将所有数据文件的IO类型设置为标准文件IO
+func (db *DB) resetIoType() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+		return err
+	}
+	for _, dataFile := range db.olderFiles {
+		if err := dataFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // 从数据文件中加载索引
 func (db *DB) loadIndexFromDataFiles() error {
 	// 如果没有文件，说明数据库是空的，直接返回
@@ -270,6 +695,61 @@ func (db *DB) loadIndexFromDataFiles() error {
 		return nil
 	}
 
+	// 根据记录类型更新内存索引
+	now := time.Now().UnixNano()
+	applyRecord := func(logRecord *data.LogRecord, pos *data.LogRecordPos) error {
+		pos.Expire = logRecord.Expire
+		// 历史版本只在上次运行时的快照中可见
+		if logRecord.Type == data.LogRecordHistory {
+			db.addReclaimSize(pos)
+			return nil
+		}
+		db.addReclaimSize(db.index.Get(logRecord.Key))
+		if logRecord.Type == data.LogRecordDeleted || logRecord.IsExpired(now) {
+			// merge可能已经清理了key之前的记录，墓碑值对应的key不一定在索引中
+			// 已经过期的记录覆盖了之前的数据，同样视为删除
+			db.index.Delete(logRecord.Key)
+			db.addReclaimSize(pos)
+		} else if ok := db.index.Put(logRecord.Key, pos); !ok {
+			return ErrIndexUpdateFailed
+		}
+		return nil
+	}
+
+	// 批次中的记录先暂存，读到批次完成的标识后再一起更新索引，没有完成标识的批次直接丢弃
+	batchRecords := make(map[uint64][]*batchRecord)
+	var currentSeqNo uint64
+	updateIndex := func(logRecord *data.LogRecord, pos *data.LogRecordPos) error {
+		if logRecord.SeqNo > currentSeqNo {
+			currentSeqNo = logRecord.SeqNo
+		}
+		if logRecord.SeqNo == 0 {
+			return applyRecord(logRecord, pos)
+		}
+		if logRecord.Type == data.LogRecordBatchFinished {
+			for _, record := range batchRecords[logRecord.SeqNo] {
+				if err := applyRecord(record.logRecord, record.pos); err != nil {
+					return err
+				}
+			}
+			delete(batchRecords, logRecord.SeqNo)
+			db.addReclaimSize(pos)
+			return nil
+		}
+		batchRecords[logRecord.SeqNo] = append(batchRecords[logRecord.SeqNo],
+			&batchRecord{logRecord: logRecord, pos: pos})
+		return nil
+	}
+
+	// 持久化的索引已经包含了检查点之前的数据，只需要回放之后的部分
+	checkpoint, err := db.loadIndexCheckpoint()
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		currentSeqNo = checkpoint.seqNo
+	}
+
 	// 遍历文件id，处理文件中的记录
 	for i, fid := range db.fileIds {
 		var fileId = uint32(fid)
@@ -281,37 +761,179 @@ func (db *DB) loadIndexFromDataFiles() error {
 		}
 
 		var offset int64 = 0
-		for {
+		if checkpoint != nil && fileId <= checkpoint.fileId {
+			if fileId < checkpoint.fileId {
+				continue
+			}
+			offset = checkpoint.offset
+		} else if i < len(db.fileIds)-1 {
+			// older文件优先从hint文件加载，不需要读取value
+			ok, err := db.loadIndexFromHintFile(dataFile, updateIndex)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+
+		fileSize, err := dataFile.IOManager.Size()
+		if err != nil {
+			return err
+		}
+		for offset < fileSize {
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
-				// 判断是否是读完该文件
-				if err == io.EOF {
+				// 文件末尾之前遇到了损坏或者不完整的数据
+				if err == io.EOF || data.IsCorrupted(err) {
+					if err := db.recoverDataFile(dataFile, offset, size, err); err != nil {
+						return err
+					}
 					break
 				}
 				return err
 			}
 
 			// 构建内存索引并保存
-			LogRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset}
-			var ok bool
-			if logRecord.Type == data.LogRecordDeleted {
-				ok = db.index.Delete(logRecord.Key)
-			} else {
-				ok = db.index.Put(logRecord.Key, LogRecordPos)
-			}
-			if !ok {
-				return ErrIndexUpdateFailed
+			LogRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
+			if err := updateIndex(logRecord, LogRecordPos); err != nil {
+				return err
 			}
 			offset += size
 		}
 		// 判断是active文件，则更新该文件的WriteOff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+		if dataFile == db.activeFile {
+			dataFile.WriteOff = offset
+		}
+	}
+
+	// 没有完成标识的批次不会生效，可以被回收
+	for _, records := range batchRecords {
+		for _, record := range records {
+			db.addReclaimSize(record.pos)
 		}
 	}
+
+	// 更新批次序列号，新的批次从这之后开始
+	db.seqNo = currentSeqNo
 	return nil
 }
 
+// 计算检查点指纹时读取的数据长度
+const checkpointFingerprintSize = 4096
+
+// 持久化索引的检查点，记录关闭时active文件写入的位置和最新的批次序列号
+// merge之后文件id会被复用，同时记录active文件的内容指纹，文件被替换过时检查点失效
+type indexCheckpoint struct {
+	fileId      uint32
+	offset      int64
+	seqNo       uint64
+	fingerprint uint32
+}
+
+func (cp *indexCheckpoint) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*2)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(cp.fileId))
+	index += binary.PutVarint(buf[index:], cp.offset)
+	index += binary.PutUvarint(buf[index:], cp.seqNo)
+	index += binary.PutUvarint(buf[index:], uint64(cp.fingerprint))
+	return buf[:index]
+}
+
+// 生成当前的检查点，调用方需持有db.mu写锁
+func (db *DB) newIndexCheckpoint() (*indexCheckpoint, error) {
+	checkpoint := &indexCheckpoint{seqNo: db.seqNo}
+	if db.activeFile == nil {
+		return checkpoint, nil
+	}
+	checkpoint.fileId = db.activeFile.FileId
+	checkpoint.offset = db.activeFile.WriteOff
+	fingerprint, err := dataFileFingerprint(db.activeFile, checkpoint.offset)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.fingerprint = fingerprint
+	return checkpoint, nil
+}
+
+// 数据文件offset之前内容的指纹，取开头和offset之前各一段数据的CRC
+// 数据文件只会追加写入，同一个文件之后的写入不会改变指纹
+func dataFileFingerprint(dataFile *data.DataFile, offset int64) (uint32, error) {
+	n := int64(checkpointFingerprintSize)
+	if offset < n {
+		n = offset
+	}
+	head, err := dataFile.ReadNBytes(n, 0)
+	if err != nil {
+		return 0, err
+	}
+	tail, err := dataFile.ReadNBytes(n, offset-n)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Update(crc32.ChecksumIEEE(head), crc32.IEEETable, tail), nil
+}
+
+func decodeIndexCheckpoint(buf []byte) *indexCheckpoint {
+	fileId, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil
+	}
+	var index = n
+	offset, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil
+	}
+	index += n
+	seqNo, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil
+	}
+	index += n
+	fingerprint, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil
+	}
+	return &indexCheckpoint{fileId: uint32(fileId), offset: offset, seqNo: seqNo, fingerprint: uint32(fingerprint)}
+}
+
+// 读取持久化索引的检查点，索引不是持久化的或者需要重建时返回nil
+// 检查点和数据文件对应不上时（例如数据文件被merge或者手动替换过）清空索引，从头回放所有数据
+func (db *DB) loadIndexCheckpoint() (*indexCheckpoint, error) {
+	checkpointer, ok := db.index.(index.Checkpointer)
+	if !ok || checkpointer.Checkpoint() == nil {
+		return nil, nil
+	}
+	checkpoint := decodeIndexCheckpoint(checkpointer.Checkpoint())
+	if checkpoint != nil && checkpoint.fileId <= db.activeFile.FileId {
+		var dataFile = db.olderFiles[checkpoint.fileId]
+		if checkpoint.fileId == db.activeFile.FileId {
+			dataFile = db.activeFile
+		}
+		if dataFile != nil {
+			size, err := dataFile.IOManager.Size()
+			if err != nil {
+				return nil, err
+			}
+			if checkpoint.offset <= size {
+				fingerprint, err := dataFileFingerprint(dataFile, checkpoint.offset)
+				if err != nil {
+					return nil, err
+				}
+				if fingerprint == checkpoint.fingerprint {
+					return checkpoint, nil
+				}
+			}
+		}
+	}
+
+	if err := db.index.Close(); err != nil {
+		return nil, err
+	}
+	return nil, db.openIndex(true)
+}
+
 // 查验options是否合规
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
@@ -320,5 +942,13 @@ func checkOptions(options Options) error {
 	if options.DataFileSize <= 0 {
 		return ErrFileSizeIllegal
 	}
+	if options.MergeRatio < 0 || options.MergeRatio > 1 {
+		return ErrInvalidMergeRatio
+	}
+	for _, window := range options.MergeWindows {
+		if window.Start < 0 || window.Start >= 24*time.Hour || window.End < 0 || window.End >= 24*time.Hour {
+			return ErrInvalidMergeWindow
+		}
+	}
 	return nil
 }
@@ -1,10 +1,15 @@
 package kv_bitcask
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/index"
 	"kv-bitcask/utils"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // 测试完成之后销毁 DB 数据目录
@@ -211,3 +216,559 @@ func TestDB_Delete(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, val1, val2)
 }
+
+func TestDB_Close(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-close")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(11), utils.RandomValue(24))
+	assert.Nil(t, err)
+
+	// 1.正常关闭
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 2.重复关闭
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 3.关闭后读写返回 ErrDBClosed
+	err = db.Put(utils.GetTestKey(22), utils.RandomValue(24))
+	assert.Equal(t, ErrDBClosed, err)
+	_, err = db.Get(utils.GetTestKey(11))
+	assert.Equal(t, ErrDBClosed, err)
+	err = db.Delete(utils.GetTestKey(11))
+	assert.Equal(t, ErrDBClosed, err)
+	err = db.Delete([]byte("unknown key"))
+	assert.Equal(t, ErrDBClosed, err)
+
+	// 4.重启后数据仍然存在
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	val, err := db2.Get(utils.GetTestKey(11))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestOpen_FileLock(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-flock")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.目录已被占用，再次打开失败
+	db2, err := Open(opts)
+	assert.Nil(t, db2)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	// 2.关闭后可以再次打开
+	err = db.Close()
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db3)
+	err = db3.Close()
+	assert.Nil(t, err)
+
+	// 3.打开失败时释放锁
+	err = os.WriteFile(filepath.Join(dir, "abc.data"), nil, 0644)
+	assert.Nil(t, err)
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupted, err)
+	assert.Nil(t, os.Remove(filepath.Join(dir, "abc.data")))
+	db4, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db4)
+	err = db4.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_ListKeys(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-list-keys")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 数据库为空
+	keys1 := db.ListKeys()
+	assert.Equal(t, 0, len(keys1))
+
+	// 只有一条数据
+	err = db.Put(utils.GetTestKey(11), utils.RandomValue(20))
+	assert.Nil(t, err)
+	keys2 := db.ListKeys()
+	assert.Equal(t, 1, len(keys2))
+
+	// 有多条数据，按顺序返回
+	err = db.Put(utils.GetTestKey(33), utils.RandomValue(20))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(22), utils.RandomValue(20))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(11))
+	assert.Nil(t, err)
+	keys3 := db.ListKeys()
+	assert.Equal(t, [][]byte{utils.GetTestKey(22), utils.GetTestKey(33)}, keys3)
+
+	// 关闭之后返回空的结果
+	assert.Nil(t, db.Close())
+	assert.Empty(t, db.ListKeys())
+}
+
+func TestDB_Fold(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-fold")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		values[string(utils.GetTestKey(i))] = utils.RandomValue(20)
+		err := db.Put(utils.GetTestKey(i), values[string(utils.GetTestKey(i))])
+		assert.Nil(t, err)
+	}
+
+	// 遍历所有数据
+	var count int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		assert.Equal(t, values[string(key)], value)
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, count)
+
+	// 提前终止遍历
+	count = 0
+	err = db.Fold(func(key []byte, value []byte) bool {
+		count++
+		return count < 3
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// 关闭之后遍历
+	err = db.Close()
+	assert.Nil(t, err)
+	err = db.Fold(func(key []byte, value []byte) bool {
+		return true
+	})
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestDB_ARTIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-art")
+	opts.DirPath = dir
+	opts.IndexType = index.ART
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 500, len(db.ListKeys()))
+
+	// 重启后重建索引
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Equal(t, utils.GetTestKey(500), db2.ListKeys()[0])
+}
+
+func TestDB_BPTreeIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Put(make([]byte, index.BPTreeMaxKeySize+1), utils.RandomValue(24))
+	assert.Equal(t, ErrKeyTooLarge, err)
+
+	// 重启后直接使用持久化的索引，只回放检查点之后的数据
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db2.index.(index.Checkpointer).Checkpoint())
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Equal(t, utils.GetTestKey(1000), db2.ListKeys()[0])
+
+	// merge 之后索引指向新的数据位置
+	for i := 1000; i < 1500; i++ {
+		err := db2.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	err = db2.Merge()
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	assert.Equal(t, 1000, len(db3.ListKeys()))
+	err = db3.Fold(func(key []byte, value []byte) bool {
+		assert.NotNil(t, value)
+		return true
+	})
+	assert.Nil(t, err)
+}
+
+func TestDB_BPTreeIndexStale(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.Nil(t, db.Close())
+	indexFile := filepath.Join(dir, index.BPTreeFileName)
+	staleIndex, err := os.ReadFile(indexFile)
+	assert.Nil(t, err)
+
+	// 使用其他类型的索引写入并merge，文件id被复用
+	btreeOpts := opts
+	btreeOpts.IndexType = index.Btree
+	db, err = Open(btreeOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i+100), []byte(fmt.Sprintf("v%d", i+200))))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(indexFile)
+	assert.True(t, os.IsNotExist(err))
+
+	check := func() {
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 2000, len(db.ListKeys()))
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		value, err := db.Get(utils.GetTestKey(100))
+		assert.Nil(t, err)
+		assert.Equal(t, "v200", string(value))
+		assert.Nil(t, db.Close())
+	}
+	check()
+
+	// 旧的索引文件被恢复回来，检查点和merge之后的数据文件对应不上，索引被重建
+	assert.Nil(t, os.WriteFile(indexFile, staleIndex, 0644))
+	check()
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
+
+func TestOpen_MMapAtStartup(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MMapAtStartup = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 使用内存映射加载索引，之后仍然可以写入
+	opts.MMapAtStartup = true
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	err = db2.Put(utils.GetTestKey(2000), utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	val, err := db3.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2000), val)
+}
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	// 没有设置过期时间
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(24))
+	assert.Nil(t, err)
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	// 覆盖为带过期时间的数据
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.RandomValue(24), time.Hour)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3), utils.RandomValue(24))
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= 100*time.Millisecond)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	time.Sleep(150 * time.Millisecond)
+
+	// 过期之后视为不存在
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, [][]byte{utils.GetTestKey(2), utils.GetTestKey(3)}, db.ListKeys())
+	iter := db.NewIterator(DefaultIteratorOptions)
+	assert.Equal(t, []string{string(utils.GetTestKey(2)), string(utils.GetTestKey(3))}, iterKeys(iter))
+	iter.Close()
+	var count int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	// 重启之后过期的数据不会被加载，也不会恢复为之前的值
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	ttl, err = db2.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 59*time.Minute)
+	assert.Equal(t, 2, len(db2.ListKeys()))
+}
+
+// 目录中每个文件的内容，用于判断文件是否被修改
+func dirContents(t *testing.T, dirPath string) map[string]string {
+	entries, err := os.ReadDir(dirPath)
+	assert.Nil(t, err)
+	contents := make(map[string]string)
+	for _, entry := range entries {
+		buf, err := os.ReadFile(filepath.Join(dirPath, entry.Name()))
+		assert.Nil(t, err)
+		contents[entry.Name()] = string(buf)
+	}
+	return contents
+}
+
+func TestOpen_ReadOnly(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Close())
+	// 末尾写入到一半的记录，只读模式下不会被截断
+	appendToDataFile(t, dir, db.activeFile.FileId, []byte{1, 2, 3})
+	before := dirContents(t, dir)
+
+	opts.ReadOnly = true
+	opts.MergeCheckInterval = time.Millisecond
+	var infos []RecoveryInfo
+	opts.RecoveryCallback = func(info RecoveryInfo) {
+		infos = append(infos, info)
+	}
+	roDB, err := Open(opts)
+	assert.Nil(t, err)
+	roDB2, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 共享锁和读写实例互斥
+	rwOpts := opts
+	rwOpts.ReadOnly = false
+	_, err = Open(rwOpts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	assert.Equal(t, 2, len(infos))
+	assert.False(t, infos[0].Truncated)
+	_, err = roDB.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(roDB2.ListKeys()))
+	stat, err := roDB.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1000), stat.KeyNum)
+
+	assert.Equal(t, ErrReadOnly, roDB.Put(utils.GetTestKey(1), []byte("value")))
+	assert.Equal(t, ErrReadOnly, roDB.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, roDB.Merge())
+	wb := roDB.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("value")))
+	assert.Equal(t, ErrReadOnly, wb.Commit())
+	txn := roDB.Begin()
+	assert.Nil(t, txn.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, txn.Commit())
+	_, err = roDB.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	assert.Nil(t, roDB.Close())
+	assert.Nil(t, roDB2.Close())
+	assert.Equal(t, before, dirContents(t, dir))
+
+	// 只读实例都关闭之后可以以读写方式打开
+	db, err = Open(rwOpts)
+	assert.Nil(t, err)
+}
+
+func TestOpen_ReadOnlyFiles(t *testing.T) {
+	opts := DefaultOptions
+	opts.ReadOnly = true
+
+	// 目录不存在时不会创建
+	dir := filepath.Join(os.TempDir(), "bitcask-go-readonly-missing")
+	opts.DirPath = dir
+	_, err := Open(opts)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// 空目录中不会创建数据文件和锁文件
+	dir, _ = os.MkdirTemp("", "bitcask-go-readonly")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, ErrReadOnly, db.Put(utils.GetTestKey(1), []byte("value")))
+	assert.Nil(t, db.Close())
+	assert.Empty(t, dirContents(t, dir))
+
+	// 持久化的B+树索引不会被修改
+	opts.ReadOnly = false
+	opts.IndexType = index.BPTree
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	assert.Nil(t, db.Close())
+	before := dirContents(t, dir)
+
+	opts.ReadOnly = true
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+	assert.Equal(t, before, dirContents(t, dir))
+
+	// 没有写权限的数据文件和hint文件也可以打开
+	opts.ReadOnly = false
+	opts.IndexType = index.Btree
+	opts.DataFileSize = 4 * 1024
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 100; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	assert.Nil(t, db.Close())
+	hintFiles, err := filepath.Glob(filepath.Join(dir, "*"+data.HintFileNameSuffix))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, hintFiles)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.Nil(t, os.Chmod(filepath.Join(dir, entry.Name()), 0444))
+	}
+	before = dirContents(t, dir)
+
+	opts.ReadOnly = true
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+	assert.Equal(t, before, dirContents(t, dir))
+}
@@ -10,4 +10,20 @@ var (
 	ErrDirPathIsEmpty         = errors.New("dir path is empty")
 	ErrFileSizeIllegal        = errors.New("file size is less than 0")
 	ErrDataDirectoryCorrupted = errors.New("data directory maybe corrupted")
+	ErrDBClosed               = errors.New("database is closed")
+	ErrExceedMaxBatchNum      = errors.New("exceed the max batch num")
+	ErrMergeIsProgress        = errors.New("merge is in progress, try again later")
+	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
+	ErrKeyTooLarge            = errors.New("key is too large for the index type")
+	ErrInvalidTTL             = errors.New("ttl must be positive")
+	ErrTxnConflict            = errors.New("transaction conflict, the keys it read have been changed")
+	ErrTxnFinished            = errors.New("transaction has been committed or rolled back")
+	ErrSnapshotReleased       = errors.New("snapshot has been released")
+	ErrBackupDirIsDataDir     = errors.New("backup directory can not be the data directory")
+	ErrBackupDirNotEmpty      = errors.New("backup directory is not empty and is not a backup of this database")
+	ErrInvalidMergeRatio      = errors.New("invalid merge ratio, must between 0 and 1")
+	ErrInvalidMergeWindow     = errors.New("invalid merge window, must be within a day")
+	ErrInvalidDataFileName    = errors.New("data file name does not match the %09d.data pattern")
+	ErrUnexpectedZeroBytes    = errors.New("unexpected zero bytes in data file")
+	ErrReadOnly               = errors.New("database is opened in read-only mode")
 )
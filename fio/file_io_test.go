@@ -92,3 +92,30 @@ func TestFileIO_Close(t *testing.T) {
 	err = fio.Close()
 	assert.Nil(t, err)
 }
+
+func TestNewReadOnlyFileIOManager(t *testing.T) {
+	path := filepath.Join("/tmp", "a-readonly.data")
+	defer destroyFile(path)
+
+	// 文件不存在时不会创建
+	_, err := NewReadOnlyFileIOManager(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, os.WriteFile(path, []byte("bitcask kv"), DatafilePerm))
+	fio, err := NewReadOnlyFileIOManager(path)
+	assert.Nil(t, err)
+	defer fio.Close()
+
+	b := make([]byte, 7)
+	n, err := fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("bitcask"), b)
+	_, err = fio.Write([]byte("key"))
+	assert.NotNil(t, err)
+	size, err := fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+}
@@ -2,6 +2,19 @@ package fio
 
 const DatafilePerm = 0644 // 文件默认权限
 
+type FileIOType = byte
+
+const (
+	// StandardFIO 标准文件IO
+	StandardFIO FileIOType = iota
+
+	// MemoryMap 内存文件映射，只读
+	MemoryMap
+
+	// ReadOnlyFIO 只读的标准文件IO，不会创建文件，写入会返回错误
+	ReadOnlyFIO
+)
+
 // IOManager 抽象IO管理接口，接入不同的IO类型
 type IOManager interface {
 	// Read 从文件指定位置读取数据
@@ -19,3 +32,17 @@ type IOManager interface {
 	// Size 获取文件大小
 	Size() (int64, error)
 }
+
+// NewIOManager 根据IO类型创建IO管理器
+func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
+	switch ioType {
+	case StandardFIO:
+		return NewFileIOManager(fileName)
+	case MemoryMap:
+		return NewMMapIOManager(fileName)
+	case ReadOnlyFIO:
+		return NewReadOnlyFileIOManager(fileName)
+	default:
+		panic("unsupported io type")
+	}
+}
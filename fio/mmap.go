@@ -0,0 +1,72 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+var ErrMMapReadOnly = errors.New("mmap io manager is read only")
+
+// MMap 内存文件映射IO，只能读取打开时已有的数据，读取时不需要系统调用，适合启动时加载索引
+type MMap struct {
+	fd   *os.File // 系统文件描述符
+	data []byte   // 映射到内存中的文件内容
+}
+
+func NewMMapIOManager(fileName string) (*MMap, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDONLY, DatafilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	// 空文件不能映射
+	var data []byte
+	if stat.Size() > 0 {
+		data, err = syscall.Mmap(int(fd.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+	return &MMap{fd: fd, data: data}, nil
+}
+
+func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
+	var n int
+	if offset < int64(len(mmap.data)) {
+		n = copy(b, mmap.data[offset:])
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mmap *MMap) Write([]byte) (int, error) {
+	return 0, ErrMMapReadOnly
+}
+
+func (mmap *MMap) Sync() error {
+	return nil
+}
+
+func (mmap *MMap) Close() error {
+	if mmap.data != nil {
+		if err := syscall.Munmap(mmap.data); err != nil {
+			return err
+		}
+		mmap.data = nil
+	}
+	return mmap.fd.Close()
+}
+
+func (mmap *MMap) Size() (int64, error) {
+	return int64(len(mmap.data)), nil
+}
@@ -0,0 +1,57 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestMMap_Read(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-a.data")
+	defer destroyFile(path)
+
+	// 空文件
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+	b1 := make([]byte, 10)
+	n, err := mmapIO.Read(b1, 0)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+	assert.Nil(t, mmapIO.Close())
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	assert.Nil(t, fio.Close())
+
+	mmapIO2, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+	defer mmapIO2.Close()
+	size, err = mmapIO2.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	b2 := make([]byte, 5)
+	n, err = mmapIO2.Read(b2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-a"), b2)
+
+	// 读取超过文件末尾
+	b3 := make([]byte, 10)
+	n, err = mmapIO2.Read(b3, 5)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-b"), b3[:n])
+
+	// 只读
+	_, err = mmapIO2.Write([]byte("key-c"))
+	assert.Equal(t, ErrMMapReadOnly, err)
+}
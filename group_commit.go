@@ -0,0 +1,107 @@
+package kv_bitcask
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// groupSyncer 合并并发写入的持久化请求
+// 写入的位置是打开之后写入的总字节数，等待持久化的写入只需要等到已经持久化的位置超过自己的写入位置
+// 同一时刻只有一个写入执行fsync，其他写入等待该次fsync完成，fsync期间到达的写入由下一次fsync一起持久化
+type groupSyncer struct {
+	mu      *sync.Mutex
+	cond    *sync.Cond
+	syncing bool                   // 是否有写入正在执行fsync
+	synced  uint64                 // 已经持久化的写入位置
+	sync    func() (uint64, error) // 执行一次持久化，返回持久化的写入位置
+}
+
+func newGroupSyncer(syncFn func() (uint64, error)) *groupSyncer {
+	mu := new(sync.Mutex)
+	return &groupSyncer{mu: mu, cond: sync.NewCond(mu), sync: syncFn}
+}
+
+// 等待写入位置written之前的数据都已经持久化，没有其他写入正在fsync时由当前写入执行
+func (gs *groupSyncer) wait(written uint64) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for gs.synced < written {
+		if gs.syncing {
+			gs.cond.Wait()
+			continue
+		}
+
+		gs.syncing = true
+		gs.mu.Unlock()
+		synced, err := gs.sync()
+		gs.mu.Lock()
+		gs.syncing = false
+		// 失败时也唤醒等待的写入，由它们重新执行fsync
+		gs.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if synced > gs.synced {
+			gs.synced = synced
+		}
+	}
+	return nil
+}
+
+// 其他途径已经持久化到了写入位置synced，例如active文件转换为older文件时
+func (gs *groupSyncer) markSynced(synced uint64) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if synced > gs.synced {
+		gs.synced = synced
+		gs.cond.Broadcast()
+	}
+}
+
+// 已经持久化的写入位置
+func (gs *groupSyncer) syncedPos() uint64 {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.synced
+}
+
+// 不持有db.mu持久化当前的active文件，返回持久化的写入位置
+// 之前的active文件在转换为older文件时已经持久化过，只需要持久化当前的active文件
+func (db *DB) syncActiveFile() (uint64, error) {
+	db.mu.RLock()
+	activeFile, written := db.activeFile, db.writtenBytes
+	db.mu.RUnlock()
+	if activeFile == nil {
+		return written, nil
+	}
+	// fsync期间文件可能已经转换为older文件后被merge关闭，或者数据库已经关闭，关闭之前都已经持久化过
+	if err := activeFile.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return 0, err
+	}
+	return written, nil
+}
+
+// 后台定期持久化active文件，宕机时最多丢失SyncInterval时间内写入的数据
+func (db *DB) syncPeriodically() {
+	defer db.syncWg.Done()
+
+	ticker := time.NewTicker(db.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		db.mu.RLock()
+		written := db.writtenBytes
+		db.mu.RUnlock()
+		if err := db.syncer.wait(written); err != nil {
+			log.Printf("bitcask: periodic sync failed: %v", err)
+		}
+	}
+}
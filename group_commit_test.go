@@ -0,0 +1,123 @@
+package kv_bitcask
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/utils"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupSyncer(t *testing.T) {
+	var written, syncCount uint64
+	gs := newGroupSyncer(func() (uint64, error) {
+		atomic.AddUint64(&syncCount, 1)
+		synced := atomic.LoadUint64(&written)
+		time.Sleep(5 * time.Millisecond)
+		return synced, nil
+	})
+
+	// 并发等待持久化的写入共享fsync
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, gs.wait(atomic.AddUint64(&written, 10)))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(1000), gs.syncedPos())
+	assert.Less(t, atomic.LoadUint64(&syncCount), uint64(50))
+
+	// 已经持久化的位置不需要再次fsync
+	count := atomic.LoadUint64(&syncCount)
+	assert.Nil(t, gs.wait(500))
+	gs.markSynced(2000)
+	assert.Nil(t, gs.wait(2000))
+	assert.Equal(t, count, atomic.LoadUint64(&syncCount))
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 模拟较慢的磁盘，fsync期间到达的写入等待下一次fsync
+	var syncCount uint64
+	syncActiveFile := db.syncer.sync
+	db.syncer.sync = func() (uint64, error) {
+		atomic.AddUint64(&syncCount, 1)
+		time.Sleep(time.Millisecond)
+		return syncActiveFile()
+	}
+
+	// utils.RandomValue不是并发安全的，先生成好value
+	value := utils.RandomValue(128)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i*50+j), value))
+			}
+			assert.Nil(t, db.Delete(utils.GetTestKey(i*50)))
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			assert.Nil(t, wb.Put(utils.GetTestKey(i*50), value))
+			assert.Nil(t, wb.Commit())
+		}(i)
+	}
+	wg.Wait()
+
+	// 返回时写入都已经持久化，并发的写入合并了fsync
+	assert.Equal(t, db.writtenBytes, db.syncer.syncedPos())
+	assert.Less(t, atomic.LoadUint64(&syncCount), uint64(520))
+	assert.Equal(t, 1000, len(db.ListKeys()))
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+}
+
+func TestDB_BytesPerSync(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.BytesPerSync = 4096
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+		assert.Less(t, db.writtenBytes-db.syncer.syncedPos(), uint64(opts.BytesPerSync))
+	}
+	assert.Greater(t, db.syncer.syncedPos(), uint64(0))
+}
+
+func TestDB_SyncInterval(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.SyncInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(128)))
+	assert.Equal(t, uint64(0), db.syncer.syncedPos())
+	assert.Eventually(t, func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return db.syncer.syncedPos() == db.writtenBytes
+	}, time.Second, 5*time.Millisecond)
+}
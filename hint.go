@@ -0,0 +1,179 @@
+package kv_bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"os"
+)
+
+// hint文件先写入临时文件，完整写入后再重命名
+const hintTmpFileSuffix = ".tmp"
+
+// hintFileWriter 写入hint文件
+// 每条hint记录的key、类型和批次序列号与数据文件中的记录一致，value为记录的位置信息
+// 文件末尾是一条key为空的结束记录，保存对应数据文件的大小，用于校验hint文件是否完整有效
+type hintFileWriter struct {
+	fileName string
+	fd       *os.File
+	writer   *bufio.Writer
+}
+
+func newHintFileWriter(dirPath string, fileId uint32) (*hintFileWriter, error) {
+	fileName := data.GetHintFileName(dirPath, fileId)
+	fd, err := os.OpenFile(fileName+hintTmpFileSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DatafilePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &hintFileWriter{
+		fileName: fileName,
+		fd:       fd,
+		writer:   bufio.NewWriter(fd),
+	}, nil
+}
+
+// 写入一条hint记录
+func (hw *hintFileWriter) write(logRecord *data.LogRecord, pos *data.LogRecordPos) error {
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:    logRecord.Key,
+		Value:  data.EncodeLogRecordPos(pos),
+		Type:   logRecord.Type,
+		SeqNo:  logRecord.SeqNo,
+		Expire: logRecord.Expire,
+	})
+	_, err := hw.writer.Write(encRecord)
+	return err
+}
+
+// 写入结束记录并持久化临时文件
+func (hw *hintFileWriter) finish(dataFileSize int64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, dataFileSize)
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Value: buf[:n]})
+	if _, err := hw.writer.Write(encRecord); err != nil {
+		return err
+	}
+	if err := hw.writer.Flush(); err != nil {
+		return err
+	}
+	if err := hw.fd.Sync(); err != nil {
+		return err
+	}
+	return hw.fd.Close()
+}
+
+// 将临时文件重命名为正式的hint文件
+func (hw *hintFileWriter) commit() error {
+	return os.Rename(hw.fileName+hintTmpFileSuffix, hw.fileName)
+}
+
+// 放弃写入，删除临时文件
+func (hw *hintFileWriter) abort() {
+	_ = hw.fd.Close()
+	_ = os.Remove(hw.fileName + hintTmpFileSuffix)
+}
+
+// 后台扫描转换为older的数据文件，生成对应的hint文件
+func (db *DB) generateHintFile(dataFile *data.DataFile) {
+	defer db.hintWg.Done()
+
+	hintWriter, err := newHintFileWriter(db.options.DirPath, dataFile.FileId)
+	if err != nil {
+		return
+	}
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			hintWriter.abort()
+			return
+		}
+		pos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size)}
+		if err := hintWriter.write(logRecord, pos); err != nil {
+			hintWriter.abort()
+			return
+		}
+		offset += size
+	}
+	if err := hintWriter.finish(offset); err != nil {
+		hintWriter.abort()
+		return
+	}
+
+	// 数据文件在此期间可能已经被merge替换，此时生成的hint文件已经失效
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.olderFiles[dataFile.FileId] != dataFile {
+		hintWriter.abort()
+		return
+	}
+	if err := hintWriter.commit(); err != nil {
+		hintWriter.abort()
+	}
+}
+
+// 从hint文件中加载older文件的索引，hint文件不存在或不完整时返回false，需要回放数据文件
+func (db *DB) loadIndexFromHintFile(dataFile *data.DataFile,
+	updateIndex func(*data.LogRecord, *data.LogRecordPos) error) (bool, error) {
+	hintFileName := data.GetHintFileName(db.options.DirPath, dataFile.FileId)
+	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+		return false, nil
+	}
+	// hint文件只会被读取，只读模式下也不需要写权限
+	hintFile, err := data.OpenHintFile(db.options.DirPath, dataFile.FileId, fio.ReadOnlyFIO)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	// 先校验hint文件的结束记录，和数据文件的大小一致才认为有效
+	dataFileSize, err := dataFile.IOManager.Size()
+	if err != nil {
+		return false, err
+	}
+	var offset int64 = 0
+	var valid bool
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF || data.IsCorrupted(err) {
+				break
+			}
+			return false, err
+		}
+		offset += size
+		if len(logRecord.Key) == 0 {
+			hintSize, _ := binary.Varint(logRecord.Value)
+			valid = hintSize == dataFileSize
+			break
+		}
+	}
+	if !valid {
+		return false, nil
+	}
+
+	// 根据hint记录更新索引
+	offset = 0
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			return false, err
+		}
+		if len(logRecord.Key) == 0 {
+			break
+		}
+		if err := updateIndex(logRecord, data.DecodeLogRecordPos(logRecord.Value)); err != nil {
+			return false, err
+		}
+		offset += size
+	}
+	return true, nil
+}
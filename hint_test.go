@@ -0,0 +1,94 @@
+package kv_bitcask
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_HintFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hint")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 1.转换为 older 的文件都生成了 hint 文件
+	assert.Greater(t, len(db.olderFiles), 0)
+	for fid := range db.olderFiles {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(data.GetHintFileName(dir, db.activeFile.FileId))
+	assert.True(t, os.IsNotExist(err))
+
+	check := func(db *DB) {
+		for i := 0; i < 5000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := 5000; i < 20000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+	}
+
+	// 2.重启后从 hint 文件加载索引
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	ok, err := db2.loadIndexFromHintFile(db2.olderFiles[0], func(*data.LogRecord, *data.LogRecordPos) error {
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	check(db2)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 3.hint 文件不完整时回放数据文件
+	hintFileName := data.GetHintFileName(dir, 0)
+	stat, err := os.Stat(hintFileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(hintFileName, stat.Size()/2))
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	ok, err = db3.loadIndexFromHintFile(db3.olderFiles[0], func(*data.LogRecord, *data.LogRecordPos) error {
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	check(db3)
+
+	// 4.merge 之后新的数据文件也有 hint 文件
+	err = db3.Merge()
+	assert.Nil(t, err)
+	for fid := range db3.olderFiles {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	err = db3.Close()
+	assert.Nil(t, err)
+
+	db4, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db4.Close()
+	}()
+	check(db4)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	bitcask "kv-bitcask"
+	"kv-bitcask/httpapi"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "监听的TCP地址")
+	dir := flag.String("dir", "", "数据目录，默认使用临时目录")
+	backupDir := flag.String("backup-dir", "", "备份的根目录，POST /backup 备份到其下的子目录，为空时不允许备份")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "关闭时等待正在处理的请求的最长时间")
+	flag.Parse()
+
+	opts := bitcask.DefaultOptions
+	if *dir != "" {
+		opts.DirPath = *dir
+	}
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+
+	serverOpts := httpapi.DefaultOptions
+	serverOpts.BackupDir = *backupDir
+	server := httpapi.NewServer(db, serverOpts)
+	// 收到退出信号时等待正在处理的请求结束，然后关闭数据库
+	shutdownDone := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer close(shutdownDone)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("failed to shutdown: %v", err)
+		}
+	}()
+
+	log.Printf("http server listening on %s, data dir %s", *addr, opts.DirPath)
+	if err := server.ListenAndServe(*addr); err != http.ErrServerClosed {
+		_ = db.Close()
+		log.Fatalf("http server stopped: %v", err)
+	}
+	<-shutdownDone
+}
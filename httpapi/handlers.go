@@ -0,0 +1,392 @@
+package httpapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bitcask "kv-bitcask"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	keysPath   = "/keys"
+	scanPath   = "/scan"
+	statPath   = "/stat"
+	mergePath  = "/merge"
+	backupPath = "/backup"
+
+	defaultScanLimit = 100 // list和scan默认返回的数量
+)
+
+// key和value的编码方式，通过请求参数encoding指定
+const (
+	encodingRaw    = "raw"    // 原样使用，适合UTF-8文本
+	encodingBase64 = "base64" // 任意的二进制数据
+)
+
+var (
+	errInvalidEncoding   = errors.New("encoding must be raw or base64")
+	errKeyTooLarge       = errors.New("key exceeds the max key size")
+	errBackupDisabled    = errors.New("backup is disabled, the server has no backup dir")
+	errInvalidBackupName = errors.New("backup name must be a relative path without ..")
+)
+
+// putRequest 写入数据的请求体
+type putRequest struct {
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl_ms,omitempty"` // 过期时间，单位毫秒，0表示不过期
+}
+
+// item 返回的一条数据
+type item struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl_ms,omitempty"` // 剩余的存活时间，单位毫秒，没有过期时间时不返回
+}
+
+// listResponse list的结果，Next不为空时表示还有数据，作为下一次请求的cursor参数继续遍历
+type listResponse struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// scanResponse scan的结果，Next和list一样
+type scanResponse struct {
+	Items []item `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+type statResponse struct {
+	KeyNum          uint       `json:"key_num"`
+	DataFileNum     uint       `json:"data_file_num"`
+	ReclaimableSize int64      `json:"reclaimable_size"`
+	DiskSize        int64      `json:"disk_size"`
+	Files           []fileStat `json:"files"`
+}
+
+type fileStat struct {
+	FileId          uint32  `json:"file_id"`
+	Size            int64   `json:"size"`
+	ReclaimableSize int64   `json:"reclaimable_size"`
+	DeadRatio       float64 `json:"dead_ratio"`
+}
+
+type backupRequest struct {
+	Name string `json:"name"` // 备份目录相对于Options.BackupDir的路径
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// GET、PUT、DELETE /keys/{key}
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request, rawKey string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	codec, err := getCodec(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	key, err := codec.decode(rawKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(key) > s.options.MaxKeySize {
+		writeError(w, http.StatusBadRequest, errKeyTooLarge)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, err := s.db.Get(key)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		ttl, err := s.db.TTL(key)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		resp := item{Key: codec.encode(key), Value: codec.encode(value)}
+		if ttl != bitcask.NoExpiration {
+			resp.TTL = ttl.Milliseconds()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	case http.MethodPut:
+		var req putRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		value, err := codec.decode(req.Value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch {
+		case req.TTL > 0:
+			err = s.db.PutWithTTL(key, value, time.Duration(req.TTL)*time.Millisecond)
+		case req.TTL < 0:
+			err = bitcask.ErrInvalidTTL
+		default:
+			err = s.db.Put(key, value)
+		}
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := s.db.Delete(key); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /keys 和 GET /scan
+// 参数：prefix只返回指定前缀的key，cursor从该key开始遍历，limit返回的最大数量，reverse=true反向遍历
+// list只返回key，scan同时返回value
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request, withValue bool) {
+	codec, err := getCodec(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	query := r.URL.Query()
+	prefix, err := codec.decode(query.Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cursor, err := codec.decode(query.Get("cursor"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := defaultScanLimit
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a positive integer"))
+			return
+		}
+	}
+	if limit > s.options.MaxScanLimit {
+		limit = s.options.MaxScanLimit
+	}
+	reverse := query.Get("reverse") == "true"
+
+	iterator := s.db.NewIterator(bitcask.IteratorOptions{Prefix: prefix, Reverse: reverse})
+	defer iterator.Close()
+	if len(cursor) > 0 {
+		iterator.Seek(cursor)
+	}
+
+	var keys []string
+	var items []item
+	var next string
+	for ; iterator.Valid(); iterator.Next() {
+		if len(keys)+len(items) == limit {
+			next = codec.encode(iterator.Key())
+			break
+		}
+		if !withValue {
+			keys = append(keys, codec.encode(iterator.Key()))
+			continue
+		}
+		value, err := iterator.Value()
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		items = append(items, item{Key: codec.encode(iterator.Key()), Value: codec.encode(value)})
+	}
+
+	if withValue {
+		if items == nil {
+			items = []item{}
+		}
+		writeJSON(w, http.StatusOK, scanResponse{Items: items, Next: next})
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, listResponse{Keys: keys, Next: next})
+}
+
+// GET /stat
+func (s *Server) handleStat(w http.ResponseWriter, r *http.Request) {
+	stat, err := s.db.Stat()
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	resp := statResponse{
+		KeyNum:          stat.KeyNum,
+		DataFileNum:     stat.DataFileNum,
+		ReclaimableSize: stat.ReclaimableSize,
+		DiskSize:        stat.DiskSize,
+		Files:           make([]fileStat, 0, len(stat.Files)),
+	}
+	for _, file := range stat.Files {
+		resp.Files = append(resp.Files, fileStat(file))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /merge，merge完成之后返回
+func (s *Server) handleMerge(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.Merge(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /backup，请求体为{"name": "备份名称"}，备份到Options.BackupDir下的同名目录，备份完成之后返回
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if s.options.BackupDir == "" {
+		writeError(w, http.StatusForbidden, errBackupDisabled)
+		return
+	}
+	var req backupRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	dir, ok := resolveBackupDir(s.options.BackupDir, req.Name)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errInvalidBackupName)
+		return
+	}
+	if err := s.db.Backup(dir); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 把备份名称解析为根目录下的子目录，名称不能为空、不能是绝对路径，也不能包含..
+func resolveBackupDir(root, name string) (string, bool) {
+	if name == "" || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return "", false
+		}
+	}
+	if filepath.Clean(name) == "." {
+		return "", false
+	}
+	return filepath.Join(root, name), true
+}
+
+// codec 按请求指定的编码方式转换key和value
+type codec string
+
+func getCodec(r *http.Request) (codec, error) {
+	switch encoding := r.URL.Query().Get("encoding"); encoding {
+	case "", encodingRaw:
+		return encodingRaw, nil
+	case encodingBase64:
+		return encodingBase64, nil
+	default:
+		return "", errInvalidEncoding
+	}
+}
+
+func (c codec) encode(buf []byte) string {
+	if c == encodingBase64 {
+		return base64.StdEncoding.EncodeToString(buf)
+	}
+	return string(buf)
+}
+
+// 解码base64时同时支持标准和URL安全的字符集，填充的=可以省略
+func (c codec) decode(s string) ([]byte, error) {
+	if c != encodingBase64 {
+		return []byte(s), nil
+	}
+	s = strings.TrimRight(s, "=")
+	encoding := base64.RawStdEncoding
+	if strings.ContainsAny(s, "-_") {
+		encoding = base64.RawURLEncoding
+	}
+	buf, err := encoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %v", err)
+	}
+	return buf, nil
+}
+
+// 检查请求的方法，不支持时返回405
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	return false
+}
+
+// 读取JSON请求体，失败时写入错误并返回false
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+		} else {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		}
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// 按DB返回的错误设置状态码
+func writeDBError(w http.ResponseWriter, err error) {
+	writeError(w, statusCode(err), err)
+}
+
+// DB返回的错误可能被包装，使用errors.Is匹配
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, bitcask.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, bitcask.ErrKeyIsEmpty), errors.Is(err, bitcask.ErrKeyTooLarge),
+		errors.Is(err, bitcask.ErrInvalidTTL), errors.Is(err, bitcask.ErrExceedMaxBatchNum),
+		errors.Is(err, bitcask.ErrBackupDirIsDataDir):
+		return http.StatusBadRequest
+	case errors.Is(err, bitcask.ErrMergeIsProgress), errors.Is(err, bitcask.ErrTxnConflict),
+		errors.Is(err, bitcask.ErrDatabaseIsUsing), errors.Is(err, bitcask.ErrBackupDirNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, bitcask.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, bitcask.ErrDBClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,127 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	bitcask "kv-bitcask"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Options HTTP服务的配置项
+type Options struct {
+	MaxKeySize   int    // key的最大长度
+	MaxBodySize  int64  // 请求体的最大长度，超过时返回413
+	MaxScanLimit int    // list和scan一次最多返回的数量
+	BackupDir    string // 备份的根目录，请求中的备份名称是其下的子目录，为空时不允许通过HTTP备份
+}
+
+var DefaultOptions = Options{
+	MaxKeySize:   64 * 1024,
+	MaxBodySize:  32 * 1024 * 1024,
+	MaxScanLimit: 1000,
+}
+
+// Server 通过HTTP/JSON访问DB的服务
+// 服务持有DB，Shutdown时等待正在处理的请求结束之后关闭DB
+type Server struct {
+	db         *bitcask.DB
+	options    Options
+	mu         *sync.Mutex
+	httpServer *http.Server
+	closed     bool
+}
+
+// NewServer 基于已经打开的DB创建服务
+func NewServer(db *bitcask.DB, options Options) *Server {
+	return &Server{
+		db:      db,
+		options: options,
+		mu:      new(sync.Mutex),
+	}
+}
+
+// ListenAndServe 监听TCP地址并处理请求，直到服务被关闭
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve 在listener上处理请求，Shutdown之后返回http.ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return http.ErrServerClosed
+	}
+	if s.httpServer == nil {
+		s.httpServer = &http.Server{Handler: s}
+	}
+	httpServer := s.httpServer
+	s.mu.Unlock()
+	return httpServer.Serve(listener)
+}
+
+// Shutdown 停止接收新的请求，等待正在处理的请求结束之后关闭DB
+// ctx结束时不再等待请求，直接关闭DB，未结束的请求会返回ErrDBClosed
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	var err error
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+	}
+	if closeErr := s.db.Close(); closeErr != nil && !errors.Is(closeErr, bitcask.ErrDBClosed) {
+		err = closeErr
+	}
+	return err
+}
+
+// ServeHTTP 按路径分发请求
+// 不使用http.ServeMux，它会清理路径中的//和..，导致包含这些字符的key无法访问
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, s.options.MaxBodySize)
+	}
+
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, keysPath+"/") && len(path) > len(keysPath)+1:
+		s.handleKey(w, r, path[len(keysPath)+1:])
+	case path == keysPath || path == keysPath+"/":
+		if allowMethods(w, r, http.MethodGet) {
+			s.handleList(w, r, false)
+		}
+	case path == scanPath:
+		if allowMethods(w, r, http.MethodGet) {
+			s.handleList(w, r, true)
+		}
+	case path == statPath:
+		if allowMethods(w, r, http.MethodGet) {
+			s.handleStat(w, r)
+		}
+	case path == mergePath:
+		if allowMethods(w, r, http.MethodPost) {
+			s.handleMerge(w, r)
+		}
+	case path == backupPath:
+		if allowMethods(w, r, http.MethodPost) {
+			s.handleBackup(w, r)
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("no such endpoint"))
+	}
+}
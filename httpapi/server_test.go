@@ -0,0 +1,280 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	bitcask "kv-bitcask"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, options Options) (*Server, *httptest.Server) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-http")
+	opts.DirPath = dir
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+
+	s := NewServer(db, options)
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return s, ts
+}
+
+// 发送请求，返回状态码和解析之后的JSON
+func doRequest(t *testing.T, method, url string, body interface{}) (int, map[string]interface{}) {
+	var reader io.Reader
+	switch v := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(v)
+	default:
+		buf, err := json.Marshal(v)
+		assert.Nil(t, err)
+		reader = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	if resp.StatusCode != http.StatusNoContent {
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+	}
+	return resp.StatusCode, result
+}
+
+func TestServer_Keys(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions)
+
+	code, _ := doRequest(t, http.MethodPut, ts.URL+"/keys/name", putRequest{Value: "bitcask"})
+	assert.Equal(t, http.StatusNoContent, code)
+	code, body := doRequest(t, http.MethodGet, ts.URL+"/keys/name", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"key": "name", "value": "bitcask"}, body)
+
+	// key中包含/和..
+	code, _ = doRequest(t, http.MethodPut, ts.URL+"/keys/a//b/../c", putRequest{Value: ""})
+	assert.Equal(t, http.StatusNoContent, code)
+	code, body = doRequest(t, http.MethodGet, ts.URL+"/keys/a//b/../c", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", body["value"])
+
+	// 过期时间
+	code, _ = doRequest(t, http.MethodPut, ts.URL+"/keys/tmp", putRequest{Value: "v", TTL: 60000})
+	assert.Equal(t, http.StatusNoContent, code)
+	_, body = doRequest(t, http.MethodGet, ts.URL+"/keys/tmp", nil)
+	ttl := body["ttl_ms"].(float64)
+	assert.True(t, ttl > 50000 && ttl <= 60000)
+	code, body = doRequest(t, http.MethodPut, ts.URL+"/keys/tmp", putRequest{Value: "v", TTL: -1})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, bitcask.ErrInvalidTTL.Error(), body["error"])
+
+	// 二进制数据使用base64
+	key := []byte{0, 0xff, '/', '+'}
+	value := []byte{1, 2, 3}
+	code, _ = doRequest(t, http.MethodPut, ts.URL+"/keys/"+base64.URLEncoding.EncodeToString(key)+"?encoding=base64",
+		putRequest{Value: base64.StdEncoding.EncodeToString(value)})
+	assert.Equal(t, http.StatusNoContent, code)
+	code, body = doRequest(t, http.MethodGet, ts.URL+"/keys/"+url.PathEscape(base64.StdEncoding.EncodeToString(key))+"?encoding=base64", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(value), body["value"])
+
+	code, _ = doRequest(t, http.MethodDelete, ts.URL+"/keys/name", nil)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, body = doRequest(t, http.MethodGet, ts.URL+"/keys/name", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, bitcask.ErrKeyNotFound.Error(), body["error"])
+
+	// 错误的请求
+	code, _ = doRequest(t, http.MethodGet, ts.URL+"/keys/name?encoding=hex", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = doRequest(t, http.MethodGet, ts.URL+"/keys/!!?encoding=base64", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = doRequest(t, http.MethodPut, ts.URL+"/keys/name", "{bad json")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = doRequest(t, http.MethodPost, ts.URL+"/keys/name", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = doRequest(t, http.MethodGet, ts.URL+"/unknown", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestServer_SizeLimit(t *testing.T) {
+	options := DefaultOptions
+	options.MaxKeySize = 8
+	options.MaxBodySize = 64
+	_, ts := newTestServer(t, options)
+
+	code, _ := doRequest(t, http.MethodPut, ts.URL+"/keys/0123456789", putRequest{Value: "v"})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = doRequest(t, http.MethodPut, ts.URL+"/keys/k", putRequest{Value: strings.Repeat("v", 64)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	code, _ = doRequest(t, http.MethodPut, ts.URL+"/keys/k", putRequest{Value: strings.Repeat("v", 32)})
+	assert.Equal(t, http.StatusNoContent, code)
+}
+
+func TestServer_ListAndScan(t *testing.T) {
+	options := DefaultOptions
+	options.MaxScanLimit = 4
+	_, ts := newTestServer(t, options)
+
+	for i := 0; i < 10; i++ {
+		code, _ := doRequest(t, http.MethodPut, fmt.Sprintf("%s/keys/user-%d", ts.URL, i), putRequest{Value: fmt.Sprintf("v%d", i)})
+		assert.Equal(t, http.StatusNoContent, code)
+	}
+	code, _ := doRequest(t, http.MethodPut, ts.URL+"/keys/order-1", putRequest{Value: "v"})
+	assert.Equal(t, http.StatusNoContent, code)
+
+	// 超过上限时按上限返回，通过next继续遍历
+	var keys []interface{}
+	cursor := ""
+	for {
+		code, body := doRequest(t, http.MethodGet, ts.URL+"/keys?prefix=user-&limit=100&cursor="+cursor, nil)
+		assert.Equal(t, http.StatusOK, code)
+		page := body["keys"].([]interface{})
+		assert.True(t, len(page) <= 4)
+		keys = append(keys, page...)
+		next, ok := body["next"].(string)
+		if !ok {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "user-0", keys[0])
+
+	code, body := doRequest(t, http.MethodGet, ts.URL+"/scan?prefix=user-&limit=2&reverse=true", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "user-9", "value": "v9"},
+		map[string]interface{}{"key": "user-8", "value": "v8"},
+	}, body["items"])
+	assert.Equal(t, "user-7", body["next"])
+
+	code, body = doRequest(t, http.MethodGet, ts.URL+"/scan?prefix=none", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{}, body["items"])
+	code, _ = doRequest(t, http.MethodGet, ts.URL+"/keys?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestServer_Admin(t *testing.T) {
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-http-backup")
+	defer os.RemoveAll(backupDir)
+	options := DefaultOptions
+	options.BackupDir = backupDir
+	s, ts := newTestServer(t, options)
+
+	for i := 0; i < 100; i++ {
+		code, _ := doRequest(t, http.MethodPut, fmt.Sprintf("%s/keys/key-%d", ts.URL, i), putRequest{Value: "v"})
+		assert.Equal(t, http.StatusNoContent, code)
+	}
+	code, body := doRequest(t, http.MethodGet, ts.URL+"/stat", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(100), body["key_num"])
+	assert.Equal(t, float64(1), body["data_file_num"])
+
+	code, _ = doRequest(t, http.MethodPost, ts.URL+"/merge", nil)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = doRequest(t, http.MethodGet, ts.URL+"/merge", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, _ = doRequest(t, http.MethodPost, ts.URL+"/backup", backupRequest{Name: "daily/1"})
+	assert.Equal(t, http.StatusNoContent, code)
+	matches, _ := filepath.Glob(filepath.Join(backupDir, "daily", "1", "*.data"))
+	assert.True(t, len(matches) > 0)
+	code, _ = doRequest(t, http.MethodPost, ts.URL+"/backup", backupRequest{Name: "daily/1"})
+	assert.Equal(t, http.StatusNoContent, code)
+
+	// 备份名称只能是备份根目录下的子目录
+	for _, name := range []string{"", ".", "/tmp/backup", "../backup", "daily/../../backup", backupDir} {
+		code, _ = doRequest(t, http.MethodPost, ts.URL+"/backup", backupRequest{Name: name})
+		assert.Equal(t, http.StatusBadRequest, code, name)
+	}
+
+	// 备份目录不为空并且不是之前的备份
+	assert.Nil(t, os.MkdirAll(filepath.Join(backupDir, "other"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(backupDir, "other", "file"), nil, 0644))
+	code, _ = doRequest(t, http.MethodPost, ts.URL+"/backup", backupRequest{Name: "other"})
+	assert.Equal(t, http.StatusConflict, code)
+
+	// 数据库关闭之后返回503
+	assert.Nil(t, s.db.Close())
+	code, body = doRequest(t, http.MethodGet, ts.URL+"/stat", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, bitcask.ErrDBClosed.Error(), body["error"])
+}
+
+func TestServer_BackupDisabled(t *testing.T) {
+	_, ts := newTestServer(t, DefaultOptions)
+	code, _ := doRequest(t, http.MethodPost, ts.URL+"/backup", backupRequest{Name: "backup"})
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-http-shutdown")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+
+	s := NewServer(db, DefaultOptions)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(listener)
+	}()
+
+	baseURL := "http://" + listener.Addr().String()
+	code, _ := doRequest(t, http.MethodPut, baseURL+"/keys/k", putRequest{Value: "v"})
+	assert.Equal(t, http.StatusNoContent, code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(ctx))
+	assert.Equal(t, http.ErrServerClosed, <-done)
+	assert.Nil(t, s.Shutdown(ctx))
+
+	// 数据库已经关闭，可以重新打开
+	_, err = db.Stat()
+	assert.Equal(t, bitcask.ErrDBClosed, err)
+	db2, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	val, err := db2.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	assert.Nil(t, db2.Close())
+}
+
+func TestStatusCode(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, statusCode(bitcask.ErrKeyNotFound))
+	assert.Equal(t, http.StatusForbidden, statusCode(bitcask.ErrReadOnly))
+	// 被包装的错误也能匹配到对应的状态码
+	assert.Equal(t, http.StatusForbidden,
+		statusCode(fmt.Errorf("%w: a finished merge must be applied", bitcask.ErrReadOnly)))
+	assert.Equal(t, http.StatusBadRequest,
+		statusCode(fmt.Errorf("backup: %w", bitcask.ErrBackupDirIsDataDir)))
+	assert.Equal(t, http.StatusInternalServerError,
+		statusCode(fmt.Errorf("%w: data file 1", bitcask.ErrDataDirectoryCorrupted)))
+}
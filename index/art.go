@@ -0,0 +1,672 @@
+package index
+
+import (
+	"bytes"
+	"kv-bitcask/data"
+	"sort"
+	"sync"
+)
+
+// AdaptiveRadixTree 自适应基数树索引
+// 内部节点根据子节点数量在Node4/16/48/256之间自适应切换，并对只有一个分支的路径进行压缩
+// 叶子节点只保存key在其所在位置之后的部分，共享前缀的key越长，相比BTree越节省内存
+// 节点使用写时复制，迭代器和树共享创建迭代器时的节点，之后的写入会先复制要修改的节点
+type AdaptiveRadixTree struct {
+	root *artNode
+	size int
+	cow  *artCowContext // 当前树可以直接修改的节点的标记
+	lock *sync.RWMutex
+}
+
+// artCowContext 写时复制的标记，节点的标记和树当前的标记不同时，说明节点可能被迭代器共享，修改前需要先复制
+type artCowContext struct {
+	_ byte // 保证每次分配的标记地址不同
+}
+
+// NewART 新建自适应基数树索引
+func NewART() *AdaptiveRadixTree {
+	return &AdaptiveRadixTree{
+		cow:  new(artCowContext),
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) bool {
+	art.lock.Lock()
+	if _, updated := art.insert(&art.root, key, 0, pos); !updated {
+		art.size++
+	}
+	art.lock.Unlock()
+	return true
+}
+
+func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+
+	n := art.root
+	depth := 0
+	for n != nil {
+		if n.kind == nodeLeaf {
+			if bytes.Equal(n.leaf.suffix, key[depth:]) {
+				return n.leaf.pos
+			}
+			return nil
+		}
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil
+			}
+			return n.leaf.pos
+		}
+		child := n.findChild(key[depth])
+		if child == nil {
+			return nil
+		}
+		n = *child
+		depth++
+	}
+	return nil
+}
+
+func (art *AdaptiveRadixTree) Delete(key []byte) bool {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	if _, ok := art.delete(&art.root, key, 0); ok {
+		art.size--
+		return true
+	}
+	return false
+}
+
+func (art *AdaptiveRadixTree) Size() int {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return art.size
+}
+
+func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
+	// 更换写时复制的标记会修改树，需要加写锁
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	// 现有的节点都交给迭代器共享，之后的写入不再直接修改这些节点
+	art.cow = new(artCowContext)
+	return newARTIterator(art.root, reverse)
+}
+
+func (art *AdaptiveRadixTree) Close() error {
+	return nil
+}
+
+// 插入key，返回旧的位置信息及key是否已经存在
+func (art *AdaptiveRadixTree) insert(ref **artNode, key []byte, depth int, pos *data.LogRecordPos) (*data.LogRecordPos, bool) {
+	n := *ref
+	if n == nil {
+		*ref = newLeafNode(key[depth:], pos, art.cow)
+		return nil, false
+	}
+	n = art.mutable(ref)
+
+	// 叶子节点，key相同则直接替换，否则分裂成一个新的内部节点
+	if n.kind == nodeLeaf {
+		if bytes.Equal(n.leaf.suffix, key[depth:]) {
+			oldPos := n.leaf.pos
+			n.leaf.pos = pos
+			return oldPos, true
+		}
+		suffix := n.leaf.suffix
+		lcp := longestCommonPrefix(suffix, key[depth:])
+		newNode := newArtNode(node4, art.cow)
+		newNode.prefix = copyBytes(suffix[:lcp])
+		newNode.addLeaf(suffix[lcp:], n.leaf)
+		newNode.addLeaf(key[depth+lcp:], &artLeaf{pos: pos})
+		*ref = newNode
+		return nil, false
+	}
+
+	// 压缩路径不匹配，在不匹配的位置分裂
+	if len(n.prefix) > 0 {
+		mismatch := longestCommonPrefix(n.prefix, key[depth:])
+		if mismatch < len(n.prefix) {
+			newNode := newArtNode(node4, art.cow)
+			newNode.prefix = copyBytes(n.prefix[:mismatch])
+			edge := n.prefix[mismatch]
+			n.prefix = copyBytes(n.prefix[mismatch+1:])
+			newNode.addChild(nil, edge, n)
+			newNode.addLeaf(key[depth+mismatch:], &artLeaf{pos: pos})
+			*ref = newNode
+			return nil, false
+		}
+		depth += len(n.prefix)
+	}
+
+	// key恰好在当前节点结束
+	if depth == len(key) {
+		if n.leaf != nil {
+			oldPos := n.leaf.pos
+			n.leaf.pos = pos
+			return oldPos, true
+		}
+		n.leaf = &artLeaf{pos: pos}
+		return nil, false
+	}
+
+	child := n.findChild(key[depth])
+	if child != nil {
+		return art.insert(child, key, depth+1, pos)
+	}
+	n.addChild(ref, key[depth], newLeafNode(key[depth+1:], pos, art.cow))
+	return nil, false
+}
+
+// 删除key，返回被删除的位置信息及key是否存在
+func (art *AdaptiveRadixTree) delete(ref **artNode, key []byte, depth int) (*data.LogRecordPos, bool) {
+	n := *ref
+	if n == nil {
+		return nil, false
+	}
+
+	if n.kind == nodeLeaf {
+		if bytes.Equal(n.leaf.suffix, key[depth:]) {
+			*ref = nil
+			return n.leaf.pos, true
+		}
+		return nil, false
+	}
+
+	if !bytes.HasPrefix(key[depth:], n.prefix) {
+		return nil, false
+	}
+	depth += len(n.prefix)
+	n = art.mutable(ref)
+
+	if depth == len(key) {
+		if n.leaf == nil {
+			return nil, false
+		}
+		oldPos := n.leaf.pos
+		n.leaf = nil
+		n.shrink(ref)
+		return oldPos, true
+	}
+
+	edge := key[depth]
+	child := n.findChild(edge)
+	if child == nil {
+		return nil, false
+	}
+	oldPos, ok := art.delete(child, key, depth+1)
+	if ok && *child == nil {
+		n.removeChild(edge)
+		n.shrink(ref)
+	}
+	return oldPos, ok
+}
+
+// 获取ref指向的节点的可写版本，节点可能被迭代器共享时先复制一份，并替换到ref中
+func (art *AdaptiveRadixTree) mutable(ref **artNode) *artNode {
+	n := *ref
+	if n.cow != art.cow {
+		n = n.clone(art.cow)
+		*ref = n
+	}
+	return n
+}
+
+// 按key从小到大遍历子树中大于等于pivot的key，pivot为nil时遍历所有的key
+// key由路径上的字节拼接而成，fn返回false时停止遍历，返回值表示是否需要继续遍历
+func (n *artNode) ascend(prefix, pivot []byte, fn func(key []byte, pos *data.LogRecordPos) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.kind == nodeLeaf {
+		key := concatBytes(prefix, n.leaf.suffix)
+		if pivot != nil && bytes.Compare(key, pivot) < 0 {
+			return true
+		}
+		return fn(key, n.leaf.pos)
+	}
+
+	path := concatBytes(prefix, n.prefix)
+	if pivot != nil {
+		switch comparePath(path, pivot) {
+		case -1:
+			return true
+		case 1:
+			pivot = nil
+		}
+	}
+	// 在当前节点结束的key比子节点中的key都小，和pivot相等时子节点中的key都大于pivot
+	if pivot != nil && len(pivot) == len(path) {
+		pivot = nil
+	}
+	if n.leaf != nil && pivot == nil {
+		if !fn(copyBytes(path), n.leaf.pos) {
+			return false
+		}
+	}
+	return n.rangeChildren(false, func(edge byte, child *artNode) bool {
+		childPivot := pivot
+		if pivot != nil {
+			if edge < pivot[len(path)] {
+				return true
+			}
+			if edge > pivot[len(path)] {
+				childPivot = nil
+			}
+		}
+		return child.ascend(append(path, edge), childPivot, fn)
+	})
+}
+
+// 按key从大到小遍历子树中小于等于pivot的key，pivot为nil时遍历所有的key
+func (n *artNode) descend(prefix, pivot []byte, fn func(key []byte, pos *data.LogRecordPos) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.kind == nodeLeaf {
+		key := concatBytes(prefix, n.leaf.suffix)
+		if pivot != nil && bytes.Compare(key, pivot) > 0 {
+			return true
+		}
+		return fn(key, n.leaf.pos)
+	}
+
+	path := concatBytes(prefix, n.prefix)
+	if pivot != nil {
+		switch comparePath(path, pivot) {
+		case 1:
+			return true
+		case -1:
+			pivot = nil
+		}
+	}
+	// 子节点中的key比在当前节点结束的key大，先遍历子节点，和pivot相等时子节点中的key都大于pivot
+	if pivot == nil || len(pivot) > len(path) {
+		ok := n.rangeChildren(true, func(edge byte, child *artNode) bool {
+			childPivot := pivot
+			if pivot != nil {
+				if edge > pivot[len(path)] {
+					return true
+				}
+				if edge < pivot[len(path)] {
+					childPivot = nil
+				}
+			}
+			return child.descend(append(path, edge), childPivot, fn)
+		})
+		if !ok {
+			return false
+		}
+	}
+	if n.leaf != nil {
+		return fn(copyBytes(path), n.leaf.pos)
+	}
+	return true
+}
+
+// 比较节点的路径和pivot，路径是pivot的前缀时返回0，否则返回子树中所有的key和pivot的大小关系
+func comparePath(path, pivot []byte) int {
+	if len(path) > len(pivot) {
+		if c := bytes.Compare(path[:len(pivot)], pivot); c != 0 {
+			return c
+		}
+		return 1
+	}
+	return bytes.Compare(path, pivot[:len(path)])
+}
+
+const (
+	nodeLeaf uint8 = iota
+	node4
+	node16
+	node48
+	node256
+)
+
+// 各类型节点的最大子节点数量
+var nodeCapacity = [...]int{nodeLeaf: 0, node4: 4, node16: 16, node48: 48, node256: 256}
+
+// 删除后节点收缩的阈值，保留一定余量避免频繁地扩容和收缩
+var shrinkThreshold = [...]int{node16: 3, node48: 12, node256: 37}
+
+// artLeaf 叶子数据
+type artLeaf struct {
+	suffix []byte // key在当前节点之后剩余的部分，内部节点上的leaf为空
+	pos    *data.LogRecordPos
+}
+
+// artNode ART树节点
+type artNode struct {
+	kind        uint8
+	numChildren int
+	prefix      []byte   // 压缩的路径
+	leaf        *artLeaf // 叶子节点的数据，或者恰好在该内部节点结束的key
+	// node4/node16: 有序的子节点字节
+	// node48: 长度为256的子节点下标表，保存下标+1，0表示不存在
+	// node256: 不使用
+	keys     []byte
+	children []*artNode
+	cow      *artCowContext // 创建或者复制节点时树的写时复制标记
+}
+
+func newArtNode(kind uint8, cow *artCowContext) *artNode {
+	n := &artNode{kind: kind, cow: cow}
+	switch kind {
+	case node4, node16:
+		n.keys = make([]byte, 0, nodeCapacity[kind])
+		n.children = make([]*artNode, 0, nodeCapacity[kind])
+	case node48:
+		n.keys = make([]byte, 256)
+		n.children = make([]*artNode, 48)
+	case node256:
+		n.children = make([]*artNode, 256)
+	}
+	return n
+}
+
+func newLeafNode(suffix []byte, pos *data.LogRecordPos, cow *artCowContext) *artNode {
+	return &artNode{
+		kind: nodeLeaf,
+		leaf: &artLeaf{suffix: copyBytes(suffix), pos: pos},
+		cow:  cow,
+	}
+}
+
+// 复制节点和叶子数据，子节点仍然共享
+func (n *artNode) clone(cow *artCowContext) *artNode {
+	newNode := &artNode{
+		kind:        n.kind,
+		numChildren: n.numChildren,
+		prefix:      n.prefix,
+		cow:         cow,
+	}
+	if n.leaf != nil {
+		leaf := *n.leaf
+		newNode.leaf = &leaf
+	}
+	if n.keys != nil {
+		newNode.keys = make([]byte, len(n.keys), cap(n.keys))
+		copy(newNode.keys, n.keys)
+	}
+	if n.children != nil {
+		newNode.children = make([]*artNode, len(n.children), cap(n.children))
+		copy(newNode.children, n.children)
+	}
+	return newNode
+}
+
+// 在新分裂的节点下挂载叶子数据，rest为key在该节点之后剩余的部分
+func (n *artNode) addLeaf(rest []byte, leaf *artLeaf) {
+	if len(rest) == 0 {
+		leaf.suffix = nil
+		n.leaf = leaf
+		return
+	}
+	leaf.suffix = copyBytes(rest[1:])
+	n.addChild(nil, rest[0], &artNode{kind: nodeLeaf, leaf: leaf, cow: n.cow})
+}
+
+// 查找字节对应的子节点，返回子节点指针所在的位置
+func (n *artNode) findChild(c byte) **artNode {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.numChildren; i++ {
+			if n.keys[i] == c {
+				return &n.children[i]
+			}
+		}
+	case node48:
+		if idx := n.keys[c]; idx > 0 {
+			return &n.children[idx-1]
+		}
+	case node256:
+		if n.children[c] != nil {
+			return &n.children[c]
+		}
+	}
+	return nil
+}
+
+// 添加子节点，节点已满时扩容为更大的节点类型，并通过ref替换当前节点
+func (n *artNode) addChild(ref **artNode, c byte, child *artNode) {
+	if n.numChildren >= nodeCapacity[n.kind] {
+		newNode := n.grow()
+		*ref = newNode
+		newNode.addChild(ref, c, child)
+		return
+	}
+
+	switch n.kind {
+	case node4, node16:
+		// 保持keys有序
+		i := sort.Search(n.numChildren, func(i int) bool { return n.keys[i] > c })
+		n.keys = append(n.keys, 0)
+		n.children = append(n.children, nil)
+		copy(n.keys[i+1:], n.keys[i:])
+		copy(n.children[i+1:], n.children[i:])
+		n.keys[i] = c
+		n.children[i] = child
+	case node48:
+		slot := 0
+		for n.children[slot] != nil {
+			slot++
+		}
+		n.children[slot] = child
+		n.keys[c] = byte(slot + 1)
+	case node256:
+		n.children[c] = child
+	}
+	n.numChildren++
+}
+
+// 删除字节对应的子节点
+func (n *artNode) removeChild(c byte) {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.numChildren; i++ {
+			if n.keys[i] == c {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				n.children = append(n.children[:i], n.children[i+1:]...)
+				break
+			}
+		}
+	case node48:
+		slot := n.keys[c] - 1
+		n.children[slot] = nil
+		n.keys[c] = 0
+	case node256:
+		n.children[c] = nil
+	}
+	n.numChildren--
+}
+
+// 按字节从小到大遍历子节点
+func (n *artNode) eachChild(fn func(edge byte, child *artNode)) {
+	n.rangeChildren(false, func(edge byte, child *artNode) bool {
+		fn(edge, child)
+		return true
+	})
+}
+
+// 按字节顺序遍历子节点，reverse为true时从大到小遍历，fn返回false时停止，返回值表示是否遍历了所有的子节点
+func (n *artNode) rangeChildren(reverse bool, fn func(edge byte, child *artNode) bool) bool {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.numChildren; i++ {
+			j := i
+			if reverse {
+				j = n.numChildren - 1 - i
+			}
+			if !fn(n.keys[j], n.children[j]) {
+				return false
+			}
+		}
+	case node48, node256:
+		for i := 0; i < 256; i++ {
+			c := i
+			if reverse {
+				c = 255 - i
+			}
+			var child *artNode
+			if n.kind == node256 {
+				child = n.children[c]
+			} else if idx := n.keys[c]; idx > 0 {
+				child = n.children[idx-1]
+			}
+			if child != nil && !fn(byte(c), child) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 扩容为更大的节点类型
+func (n *artNode) grow() *artNode {
+	newNode := newArtNode(n.kind+1, n.cow)
+	newNode.prefix = n.prefix
+	newNode.leaf = n.leaf
+	n.eachChild(func(edge byte, child *artNode) {
+		newNode.addChild(nil, edge, child)
+	})
+	return newNode
+}
+
+// 删除之后收缩节点，子节点过少时换成更小的节点类型，只剩一条路径时进行路径压缩
+func (n *artNode) shrink(ref **artNode) {
+	switch n.kind {
+	case node256, node48, node16:
+		if n.numChildren > shrinkThreshold[n.kind] {
+			return
+		}
+		newNode := newArtNode(n.kind-1, n.cow)
+		newNode.prefix = n.prefix
+		newNode.leaf = n.leaf
+		n.eachChild(func(edge byte, child *artNode) {
+			newNode.addChild(nil, edge, child)
+		})
+		*ref = newNode
+	case node4:
+		switch {
+		case n.numChildren == 0 && n.leaf == nil:
+			*ref = nil
+		case n.numChildren == 0:
+			// 只剩在该节点结束的key，换成叶子节点
+			n.leaf.suffix = n.prefix
+			*ref = &artNode{kind: nodeLeaf, leaf: n.leaf, cow: n.cow}
+		case n.numChildren == 1 && n.leaf == nil:
+			// 只有一个子节点，和子节点合并压缩路径，子节点被共享时先复制
+			edge, child := n.keys[0], n.children[0]
+			if child.cow != n.cow {
+				child = child.clone(n.cow)
+			}
+			merged := append(copyBytes(n.prefix), edge)
+			if child.kind == nodeLeaf {
+				child.leaf.suffix = concatBytes(merged, child.leaf.suffix)
+			} else {
+				child.prefix = concatBytes(merged, child.prefix)
+			}
+			*ref = child
+		}
+	}
+}
+
+// 迭代器每次从树中加载的数据条数
+const artIteratorBatchSize = 128
+
+// ART 索引迭代器
+// 创建时保存树当前的根节点，树之后的写入会复制被修改的节点，不需要拷贝数据，也不会影响遍历
+// 遍历时每次按顺序加载一批数据，用完之后从最后一个key继续加载
+type artIterator struct {
+	root      *artNode // 创建迭代器时树的根节点
+	currIndex int      // 当前遍历位置在本批数据中的下标
+	reverse   bool     // 是否反向遍历
+	values    []*Item  // 当前加载的一批key和位置的索引信息
+}
+
+func newARTIterator(root *artNode, reverse bool) *artIterator {
+	ai := &artIterator{
+		root:    root,
+		reverse: reverse,
+	}
+	ai.Rewind()
+	return ai
+}
+
+// 从pivot开始（为nil时从头开始）按遍历方向加载一批数据，skipPivot为true时跳过和pivot相等的key
+func (ai *artIterator) load(pivot []byte, skipPivot bool) {
+	ai.currIndex = 0
+	ai.values = ai.values[:0]
+	saveValues := func(key []byte, pos *data.LogRecordPos) bool {
+		if skipPivot && bytes.Equal(key, pivot) {
+			return true
+		}
+		ai.values = append(ai.values, &Item{key: key, pos: pos})
+		return len(ai.values) < artIteratorBatchSize
+	}
+	if ai.reverse {
+		ai.root.descend(nil, pivot, saveValues)
+	} else {
+		ai.root.ascend(nil, pivot, saveValues)
+	}
+}
+
+func (ai *artIterator) Rewind() {
+	ai.load(nil, false)
+}
+
+func (ai *artIterator) Seek(key []byte) {
+	ai.load(key, false)
+}
+
+func (ai *artIterator) Next() {
+	ai.currIndex += 1
+	// 本批数据已经用完，从最后一个key之后继续加载
+	if ai.currIndex == len(ai.values) && len(ai.values) == artIteratorBatchSize {
+		ai.load(ai.values[len(ai.values)-1].key, true)
+	}
+}
+
+func (ai *artIterator) Valid() bool {
+	return ai.currIndex < len(ai.values)
+}
+
+func (ai *artIterator) Key() []byte {
+	return ai.values[ai.currIndex].key
+}
+
+func (ai *artIterator) Value() *data.LogRecordPos {
+	return ai.values[ai.currIndex].pos
+}
+
+func (ai *artIterator) Close() {
+	ai.root = nil
+	ai.values = nil
+}
+
+func longestCommonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func copyBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func concatBytes(a, b []byte) []byte {
+	res := make([]byte, len(a)+len(b))
+	copy(res, a)
+	copy(res[len(a):], b)
+	return res
+}
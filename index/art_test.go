@@ -0,0 +1,246 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestAdaptiveRadixTree_Put(t *testing.T) {
+	art := NewART()
+	res1 := art.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.True(t, res1)
+
+	res2 := art.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 110})
+	assert.True(t, res2)
+
+	res3 := art.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 120})
+	assert.True(t, res3)
+	assert.Equal(t, 2, art.size)
+}
+
+func TestAdaptiveRadixTree_Get(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("uu"), &data.LogRecordPos{Fid: 1, Offset: 100})
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 110})
+
+	res1 := art.Get([]byte("uu"))
+	assert.Equal(t, uint32(1), res1.Fid)
+	assert.Equal(t, int64(100), res1.Offset)
+
+	res2 := art.Get([]byte("a"))
+	assert.Equal(t, uint32(1), res2.Fid)
+	assert.Equal(t, int64(110), res2.Offset)
+
+	// key 之间互为前缀
+	art.Put([]byte("ab"), &data.LogRecordPos{Fid: 1, Offset: 120})
+	art.Put([]byte("abc"), &data.LogRecordPos{Fid: 1, Offset: 130})
+	assert.Equal(t, int64(110), art.Get([]byte("a")).Offset)
+	assert.Equal(t, int64(120), art.Get([]byte("ab")).Offset)
+	assert.Equal(t, int64(130), art.Get([]byte("abc")).Offset)
+	assert.Nil(t, art.Get([]byte("abcd")))
+	assert.Nil(t, art.Get([]byte("u")))
+	assert.Nil(t, art.Get(nil))
+
+	// 重复 Put
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 110})
+	assert.Equal(t, uint32(2), art.Get([]byte("a")).Fid)
+}
+
+func TestAdaptiveRadixTree_Delete(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("uu"), &data.LogRecordPos{Fid: 1, Offset: 100})
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 110})
+
+	res1 := art.Delete([]byte("uu"))
+	assert.True(t, res1)
+	res2 := art.Delete([]byte("a"))
+	assert.True(t, res2)
+	res3 := art.Delete([]byte("a"))
+	assert.False(t, res3)
+	assert.Nil(t, art.root)
+
+	// 删除互为前缀的 key
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 110})
+	art.Put([]byte("ab"), &data.LogRecordPos{Fid: 1, Offset: 120})
+	art.Put([]byte("abc"), &data.LogRecordPos{Fid: 1, Offset: 130})
+	assert.True(t, art.Delete([]byte("ab")))
+	assert.Nil(t, art.Get([]byte("ab")))
+	assert.Equal(t, int64(110), art.Get([]byte("a")).Offset)
+	assert.Equal(t, int64(130), art.Get([]byte("abc")).Offset)
+	assert.False(t, art.Delete([]byte("abcd")))
+	assert.True(t, art.Delete([]byte("a")))
+	assert.Equal(t, int64(130), art.Get([]byte("abc")).Offset)
+	assert.Equal(t, 1, art.size)
+}
+
+func TestAdaptiveRadixTree_Iterator(t *testing.T) {
+	art1 := NewART()
+	// ART 为空
+	iter1 := art1.Iterator(false)
+	assert.Equal(t, false, iter1.Valid())
+
+	// ART 有数据
+	art1.Put([]byte("ccde"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	iter2 := art1.Iterator(false)
+	assert.Equal(t, true, iter2.Valid())
+	assert.Equal(t, []byte("ccde"), iter2.Key())
+	assert.NotNil(t, iter2.Value())
+	iter2.Next()
+	assert.Equal(t, false, iter2.Valid())
+
+	// 多条数据
+	art1.Put([]byte("acee"), &data.LogRecordPos{Fid: 2, Offset: 10})
+	art1.Put([]byte("eede"), &data.LogRecordPos{Fid: 2, Offset: 10})
+	art1.Put([]byte("bbcd"), &data.LogRecordPos{Fid: 2, Offset: 10})
+	art1.Put([]byte("bb"), &data.LogRecordPos{Fid: 2, Offset: 10})
+	var keys []string
+	iter3 := art1.Iterator(false)
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		keys = append(keys, string(iter3.Key()))
+	}
+	assert.Equal(t, []string{"acee", "bb", "bbcd", "ccde", "eede"}, keys)
+
+	// 逆序
+	keys = nil
+	iter4 := art1.Iterator(true)
+	for iter4.Rewind(); iter4.Valid(); iter4.Next() {
+		keys = append(keys, string(iter4.Key()))
+	}
+	assert.Equal(t, []string{"eede", "ccde", "bbcd", "bb", "acee"}, keys)
+
+	// Seek
+	keys = nil
+	iter5 := art1.Iterator(false)
+	for iter5.Seek([]byte("cc")); iter5.Valid(); iter5.Next() {
+		keys = append(keys, string(iter5.Key()))
+	}
+	assert.Equal(t, []string{"ccde", "eede"}, keys)
+
+	// 逆序seek
+	keys = nil
+	iter6 := art1.Iterator(true)
+	for iter6.Seek([]byte("cc")); iter6.Valid(); iter6.Next() {
+		keys = append(keys, string(iter6.Key()))
+	}
+	assert.Equal(t, []string{"bbcd", "bb", "acee"}, keys)
+}
+
+// 迭代器和树共享节点，创建之后的写入不会影响遍历，遍历跨越多批数据
+func TestAdaptiveRadixTree_IteratorCopyOnWrite(t *testing.T) {
+	art := NewART()
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		art.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	iter := art.Iterator(false)
+	reverseIter := art.Iterator(true)
+	seekIter := art.Iterator(false)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if i%2 == 0 {
+			assert.True(t, art.Delete(key))
+		} else {
+			art.Put(key, &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+		art.Put([]byte(fmt.Sprintf("key-%d-new", i)), &data.LogRecordPos{Fid: 2})
+	}
+	assert.Equal(t, 1500, art.Size())
+
+	var idx int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, keys[idx], string(iter.Key()))
+		assert.Equal(t, uint32(1), iter.Value().Fid)
+		idx++
+	}
+	assert.Equal(t, len(keys), idx)
+
+	idx = len(keys) - 1
+	for reverseIter.Rewind(); reverseIter.Valid(); reverseIter.Next() {
+		assert.Equal(t, keys[idx], string(reverseIter.Key()))
+		idx--
+	}
+	assert.Equal(t, -1, idx)
+
+	idx = sort.SearchStrings(keys, "key-5")
+	for seekIter.Seek([]byte("key-5")); seekIter.Valid(); seekIter.Next() {
+		assert.Equal(t, keys[idx], string(seekIter.Key()))
+		idx++
+	}
+	assert.Equal(t, len(keys), idx)
+
+	// 新的迭代器看到写入之后的数据
+	var count int
+	newIter := art.Iterator(false)
+	for newIter.Rewind(); newIter.Valid(); newIter.Next() {
+		assert.Equal(t, uint32(2), newIter.Value().Fid)
+		count++
+	}
+	assert.Equal(t, 1500, count)
+}
+
+// 随机写入和删除，覆盖节点的扩容、收缩和路径压缩，结果和 map 保持一致
+func TestAdaptiveRadixTree_Random(t *testing.T) {
+	art := NewART()
+	expected := make(map[string]int64)
+	rnd := rand.New(rand.NewSource(1))
+
+	randomKey := func() []byte {
+		// 共享较长的前缀，同时包含互为前缀的 key
+		key := []byte(fmt.Sprintf("bitcask-key-%d", rnd.Intn(2000)))
+		return key[:len(key)-rnd.Intn(3)]
+	}
+	for i := 0; i < 50000; i++ {
+		key := randomKey()
+		if rnd.Intn(3) == 0 {
+			_, exist := expected[string(key)]
+			assert.Equal(t, exist, art.Delete(key))
+			delete(expected, string(key))
+		} else {
+			art.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			expected[string(key)] = int64(i)
+		}
+	}
+	// 单字节 key，让节点扩容到 Node256 后再收缩
+	for c := 0; c < 256; c++ {
+		art.Put([]byte{byte(c)}, &data.LogRecordPos{Fid: 2, Offset: int64(c)})
+		expected[string([]byte{byte(c)})] = int64(c)
+	}
+	for c := 0; c < 256; c += 2 {
+		assert.True(t, art.Delete([]byte{byte(c)}))
+		delete(expected, string([]byte{byte(c)}))
+	}
+
+	assert.Equal(t, len(expected), art.size)
+	var sortedKeys []string
+	for key, offset := range expected {
+		pos := art.Get([]byte(key))
+		assert.NotNil(t, pos)
+		assert.Equal(t, offset, pos.Offset)
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	iter := art.Iterator(false)
+	var idx int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.True(t, bytes.Equal([]byte(sortedKeys[idx]), iter.Key()))
+		idx++
+	}
+	assert.Equal(t, len(sortedKeys), idx)
+
+	// 全部删除
+	for key := range expected {
+		assert.True(t, art.Delete([]byte(key)))
+	}
+	assert.Nil(t, art.root)
+	assert.Equal(t, 0, art.size)
+}
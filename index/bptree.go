@@ -0,0 +1,489 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"kv-bitcask/data"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// BPTreeFileName B+树索引在数据目录中的文件名
+	BPTreeFileName = "bptree-index"
+
+	// BPTreeMaxKeySize B+树索引支持的最大key长度，保证每个页至少能放下4条数据，分裂之后的节点一定能放进一个页
+	BPTreeMaxKeySize = (bptreePageSize-pageHeaderSize)/4 - leafEntryOverhead
+
+	bptreePageSize   = 4096
+	bptreeCachePages = 4096 // 缓存的页数，即16MB
+	bptreeMagic      = 0x52545042
+	bptreeVersion    = 3
+)
+
+// 元数据页（0号页）的格式
+//
+//	magic(4) | version(1) | clean(1) | root(4) | pageCount(4) | size(8) | checkpointSize(2) | checkpoint
+const bptreeMetaHeaderSize = 24
+
+// Checkpointer 持久化的索引需要实现的接口
+// 正常关闭时随索引一起保存检查点，记录索引已经包含了哪些数据，重新打开时只需要回放检查点之后的数据
+type Checkpointer interface {
+	// Checkpoint 上次正常关闭时保存的检查点，索引是新建的或者上次没有正常关闭时返回nil
+	Checkpoint() []byte
+
+	// SetCheckpoint 设置关闭索引时需要保存的检查点，没有设置时索引在下次打开时会被重建
+	SetCheckpoint(checkpoint []byte)
+}
+
+// BPlusTree 磁盘上的B+树索引，按页存储在数据目录中，通过页缓存减少磁盘读写，索引不需要全部放在内存中
+// 运行期间被淘汰的脏页会直接写回文件，只有正常关闭之后文件才是完整的，否则打开时会清空重建
+// 删除数据时不合并节点，空的叶子节点仍保留在链表中
+type BPlusTree struct {
+	lock          *sync.RWMutex
+	fd            *os.File
+	pool          *bufferPool
+	root          uint32 // 根节点所在的页
+	pageCount     uint32 // 已分配的页数量
+	size          int64  // key的数量
+	checkpoint    []byte // 打开时读取到的检查点
+	newCheckpoint []byte // 关闭时需要保存的检查点
+}
+
+// NewBPlusTree 打开数据目录中的B+树索引，文件不存在或者上次没有正常关闭时新建一个空的索引
+func NewBPlusTree(dirPath string) (*BPlusTree, error) {
+	fd, err := os.OpenFile(filepath.Join(dirPath, BPTreeFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	bpt := &BPlusTree{
+		lock: new(sync.RWMutex),
+		fd:   fd,
+		pool: newBufferPool(fd, bptreeCachePages),
+	}
+
+	ok, err := bpt.loadMeta()
+	if err == nil && !ok {
+		err = bpt.init()
+	}
+	// 标记为没有正常关闭，运行期间崩溃之后再次打开会重建索引
+	if err == nil {
+		err = bpt.writeMeta(false)
+	}
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return bpt, nil
+}
+
+// 读取元数据页，索引文件不完整时返回false
+func (bpt *BPlusTree) loadMeta() (bool, error) {
+	stat, err := bpt.fd.Stat()
+	if err != nil {
+		return false, err
+	}
+	if stat.Size() < bptreePageSize {
+		return false, nil
+	}
+
+	page := make([]byte, bptreePageSize)
+	if _, err := bpt.fd.ReadAt(page, 0); err != nil {
+		return false, err
+	}
+	if binary.LittleEndian.Uint32(page[0:]) != bptreeMagic || page[4] != bptreeVersion || page[5] != 1 {
+		return false, nil
+	}
+	checkpointSize := int(binary.LittleEndian.Uint16(page[22:]))
+	if bptreeMetaHeaderSize+checkpointSize > bptreePageSize {
+		return false, nil
+	}
+	bpt.root = binary.LittleEndian.Uint32(page[6:])
+	bpt.pageCount = binary.LittleEndian.Uint32(page[10:])
+	bpt.size = int64(binary.LittleEndian.Uint64(page[14:]))
+	bpt.checkpoint = make([]byte, checkpointSize)
+	copy(bpt.checkpoint, page[bptreeMetaHeaderSize:])
+	return true, nil
+}
+
+// 清空索引文件，只保留一个空的根节点
+func (bpt *BPlusTree) init() error {
+	if err := bpt.fd.Truncate(0); err != nil {
+		return err
+	}
+	bpt.root = 1
+	bpt.pageCount = 1
+	bpt.size = 0
+	bpt.checkpoint = nil
+	bpt.allocNode(true)
+	return nil
+}
+
+// 写入元数据页并持久化，只有正常关闭时clean为true，同时保存检查点
+func (bpt *BPlusTree) writeMeta(clean bool) error {
+	page := make([]byte, bptreePageSize)
+	binary.LittleEndian.PutUint32(page[0:], bptreeMagic)
+	page[4] = bptreeVersion
+	if clean {
+		page[5] = 1
+		binary.LittleEndian.PutUint16(page[22:], uint16(len(bpt.newCheckpoint)))
+		copy(page[bptreeMetaHeaderSize:], bpt.newCheckpoint)
+	}
+	binary.LittleEndian.PutUint32(page[6:], bpt.root)
+	binary.LittleEndian.PutUint32(page[10:], bpt.pageCount)
+	binary.LittleEndian.PutUint64(page[14:], uint64(bpt.size))
+	if _, err := bpt.fd.WriteAt(page, 0); err != nil {
+		return err
+	}
+	return bpt.fd.Sync()
+}
+
+func (bpt *BPlusTree) Checkpoint() []byte {
+	return bpt.checkpoint
+}
+
+func (bpt *BPlusTree) SetCheckpoint(checkpoint []byte) {
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	if len(checkpoint) > bptreePageSize-bptreeMetaHeaderSize {
+		panic("b+tree index checkpoint is too large")
+	}
+	bpt.newCheckpoint = checkpoint
+}
+
+func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) bool {
+	if len(key) > BPTreeMaxKeySize {
+		return false
+	}
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+
+	if err := bpt.insert(key, pos); err != nil {
+		return false
+	}
+	return bpt.pool.evict() == nil
+}
+
+func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+	bpt.lock.RLock()
+	defer bpt.lock.RUnlock()
+	defer bpt.release()
+
+	leaf, err := bpt.findLeaf(key, nil)
+	if err != nil {
+		return nil
+	}
+	if i, found := searchKey(leaf.keys, key); found {
+		return leaf.vals[i]
+	}
+	return nil
+}
+
+func (bpt *BPlusTree) Delete(key []byte) bool {
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+	defer bpt.release()
+
+	leaf, err := bpt.findLeaf(key, nil)
+	if err != nil {
+		return false
+	}
+	i, found := searchKey(leaf.keys, key)
+	if !found {
+		return false
+	}
+	leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
+	leaf.vals = append(leaf.vals[:i], leaf.vals[i+1:]...)
+	leaf.dirty = true
+	bpt.size--
+	return true
+}
+
+func (bpt *BPlusTree) Size() int {
+	bpt.lock.RLock()
+	defer bpt.lock.RUnlock()
+	return int(bpt.size)
+}
+
+func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
+	it := &bptreeIterator{tree: bpt, reverse: reverse}
+	it.Rewind()
+	return it
+}
+
+// Close 将所有的页写回磁盘，设置了检查点时标记为正常关闭
+func (bpt *BPlusTree) Close() error {
+	bpt.lock.Lock()
+	defer bpt.lock.Unlock()
+
+	err := bpt.pool.flush()
+	if err == nil {
+		err = bpt.writeMeta(bpt.newCheckpoint != nil)
+	}
+	if closeErr := bpt.fd.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 一次操作结束之后淘汰多余的页，操作过程中持有的节点不会被换出
+func (bpt *BPlusTree) release() {
+	_ = bpt.pool.evict()
+}
+
+// 分配一个新的节点
+func (bpt *BPlusTree) allocNode(leaf bool) *bpNode {
+	n := &bpNode{id: bpt.pageCount, leaf: leaf}
+	bpt.pageCount++
+	bpt.pool.add(n)
+	return n
+}
+
+// 从根节点向下查找时经过的内部节点，以及选择的子节点下标
+type bpPathEntry struct {
+	node *bpNode
+	idx  int
+}
+
+// 查找key所在的叶子节点，path不为空时记录查找路径
+func (bpt *BPlusTree) findLeaf(key []byte, path *[]bpPathEntry) (*bpNode, error) {
+	n, err := bpt.pool.get(bpt.root)
+	if err != nil {
+		return nil, err
+	}
+	for !n.leaf {
+		i := sort.Search(len(n.keys), func(i int) bool {
+			return bytes.Compare(n.keys[i], key) > 0
+		})
+		if path != nil {
+			*path = append(*path, bpPathEntry{node: n, idx: i})
+		}
+		if n, err = bpt.pool.get(n.children[i]); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// 查找最左或者最右的叶子节点
+func (bpt *BPlusTree) edgeLeaf(rightmost bool) (*bpNode, error) {
+	n, err := bpt.pool.get(bpt.root)
+	if err != nil {
+		return nil, err
+	}
+	for !n.leaf {
+		child := n.children[0]
+		if rightmost {
+			child = n.children[len(n.children)-1]
+		}
+		if n, err = bpt.pool.get(child); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (bpt *BPlusTree) insert(key []byte, pos *data.LogRecordPos) error {
+	var path []bpPathEntry
+	n, err := bpt.findLeaf(key, &path)
+	if err != nil {
+		return err
+	}
+
+	i, found := searchKey(n.keys, key)
+	n.dirty = true
+	if found {
+		n.vals[i] = pos
+		return nil
+	}
+	n.keys = append(n.keys, nil)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = append([]byte(nil), key...)
+	n.vals = append(n.vals, nil)
+	copy(n.vals[i+1:], n.vals[i:])
+	n.vals[i] = pos
+	bpt.size++
+
+	// 节点超出页大小时分裂，分隔key插入到父节点中，一直向上直到不需要分裂
+	for n.encodedSize() > bptreePageSize {
+		sibling, sepKey, err := bpt.split(n)
+		if err != nil {
+			return err
+		}
+		if len(path) == 0 {
+			root := bpt.allocNode(false)
+			root.keys = [][]byte{sepKey}
+			root.children = []uint32{n.id, sibling.id}
+			bpt.root = root.id
+			return nil
+		}
+
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+		p := parent.node
+		p.keys = append(p.keys, nil)
+		copy(p.keys[parent.idx+1:], p.keys[parent.idx:])
+		p.keys[parent.idx] = sepKey
+		p.children = append(p.children, 0)
+		copy(p.children[parent.idx+2:], p.children[parent.idx+1:])
+		p.children[parent.idx+1] = sibling.id
+		p.dirty = true
+		n = p
+	}
+	return nil
+}
+
+// 将节点按编码大小分成两半，后一半放到新的兄弟节点中，返回兄弟节点和需要插入到父节点的分隔key
+func (bpt *BPlusTree) split(n *bpNode) (*bpNode, []byte, error) {
+	var next *bpNode
+	if n.leaf && n.next != 0 {
+		var err error
+		if next, err = bpt.pool.get(n.next); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var mid, size int
+	for mid < len(n.keys)-1 && size < n.encodedSize()/2 {
+		size += n.entryOverhead() + len(n.keys[mid])
+		mid++
+	}
+	if mid == 0 {
+		mid = 1
+	}
+
+	sibling := bpt.allocNode(n.leaf)
+	var sepKey []byte
+	if n.leaf {
+		sibling.keys = append([][]byte(nil), n.keys[mid:]...)
+		sibling.vals = append([]*data.LogRecordPos(nil), n.vals[mid:]...)
+		n.keys = n.keys[:mid]
+		n.vals = n.vals[:mid]
+		sepKey = sibling.keys[0]
+
+		// 维护叶子节点之间的链表
+		sibling.prev = n.id
+		sibling.next = n.next
+		if next != nil {
+			next.prev = sibling.id
+			next.dirty = true
+		}
+		n.next = sibling.id
+	} else {
+		sepKey = n.keys[mid]
+		sibling.keys = append([][]byte(nil), n.keys[mid+1:]...)
+		sibling.children = append([]uint32(nil), n.children[mid+1:]...)
+		n.keys = n.keys[:mid]
+		n.children = n.children[:mid+1]
+	}
+	n.dirty = true
+	return sibling, sepKey, nil
+}
+
+// 从key开始读取一个叶子节点中满足条件的数据，正向时为大于（等于）key的数据，反向时为小于（等于）key的数据
+// key为nil时从头开始读取，当前叶子节点中没有满足条件的数据时继续读取相邻的节点
+func (bpt *BPlusTree) scanLeaf(key []byte, inclusive, reverse bool) ([][]byte, []*data.LogRecordPos) {
+	bpt.lock.RLock()
+	defer bpt.lock.RUnlock()
+	defer bpt.release()
+
+	var leaf *bpNode
+	var err error
+	if key == nil {
+		leaf, err = bpt.edgeLeaf(reverse)
+	} else {
+		leaf, err = bpt.findLeaf(key, nil)
+	}
+	for err == nil {
+		lo, hi := 0, len(leaf.keys)
+		if key != nil {
+			bound := sort.Search(len(leaf.keys), func(i int) bool {
+				cmp := bytes.Compare(leaf.keys[i], key)
+				return cmp > 0 || (cmp == 0 && inclusive != reverse)
+			})
+			if reverse {
+				hi = bound
+			} else {
+				lo = bound
+			}
+		}
+		if lo < hi {
+			keys := append([][]byte(nil), leaf.keys[lo:hi]...)
+			vals := append([]*data.LogRecordPos(nil), leaf.vals[lo:hi]...)
+			if reverse {
+				for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+					keys[i], keys[j] = keys[j], keys[i]
+					vals[i], vals[j] = vals[j], vals[i]
+				}
+			}
+			return keys, vals
+		}
+
+		sibling := leaf.next
+		if reverse {
+			sibling = leaf.prev
+		}
+		if sibling == 0 {
+			break
+		}
+		leaf, err = bpt.pool.get(sibling)
+	}
+	return nil, nil
+}
+
+// 在有序的keys中查找key，返回key所在的位置或者应该插入的位置
+func searchKey(keys [][]byte, key []byte) (int, bool) {
+	i := sort.Search(len(keys), func(i int) bool {
+		return bytes.Compare(keys[i], key) >= 0
+	})
+	return i, i < len(keys) && bytes.Equal(keys[i], key)
+}
+
+// B+树索引迭代器，每次只读取一个叶子节点的数据
+// 读完之后根据最后一个key重新从根节点查找下一批数据，遍历期间的写入不会导致重复或遗漏已有的key
+type bptreeIterator struct {
+	tree      *BPlusTree
+	reverse   bool
+	keys      [][]byte
+	vals      []*data.LogRecordPos
+	currIndex int
+}
+
+func (bpi *bptreeIterator) Rewind() {
+	bpi.load(nil, true)
+}
+
+func (bpi *bptreeIterator) Seek(key []byte) {
+	bpi.load(key, true)
+}
+
+func (bpi *bptreeIterator) Next() {
+	bpi.currIndex++
+	if bpi.currIndex == len(bpi.keys) {
+		bpi.load(bpi.keys[len(bpi.keys)-1], false)
+	}
+}
+
+func (bpi *bptreeIterator) Valid() bool {
+	return bpi.currIndex < len(bpi.keys)
+}
+
+func (bpi *bptreeIterator) Key() []byte {
+	return bpi.keys[bpi.currIndex]
+}
+
+func (bpi *bptreeIterator) Value() *data.LogRecordPos {
+	return bpi.vals[bpi.currIndex]
+}
+
+func (bpi *bptreeIterator) Close() {
+	bpi.keys = nil
+	bpi.vals = nil
+}
+
+func (bpi *bptreeIterator) load(key []byte, inclusive bool) {
+	bpi.keys, bpi.vals = bpi.tree.scanLeaf(key, inclusive, bpi.reverse)
+	bpi.currIndex = 0
+}
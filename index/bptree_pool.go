@@ -0,0 +1,232 @@
+package index
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"kv-bitcask/data"
+	"os"
+	"sync"
+)
+
+var ErrBPTreePageCorrupted = errors.New("b+tree index page is corrupted")
+
+// B+树节点页的格式
+//
+//	+------+-------+-------------------------+-------------+---------+
+//	| type | count | prev（内部节点为第一个子节点） |    next     | entries |
+//	+------+-------+-------------------------+-------------+---------+
+//	  1字节   2字节            4字节                4字节        变长
+//
+// 叶子节点的entry: keySize(2) | key | fid(4) | offset(8) | size(4) | expire(8) | version(8)
+// 内部节点的entry: keySize(2) | key | child(4)，child为大于等于key的子节点
+const (
+	pageHeaderSize        = 11
+	leafEntryOverhead     = 2 + 32
+	internalEntryOverhead = 2 + 4
+)
+
+const (
+	pageTypeLeaf     byte = 1
+	pageTypeInternal byte = 2
+)
+
+// bpNode 解码之后的B+树节点，叶子节点之间通过prev和next相连，0表示不存在（0号页是元数据页）
+type bpNode struct {
+	id       uint32
+	leaf     bool
+	keys     [][]byte
+	vals     []*data.LogRecordPos // 叶子节点中key对应的位置信息
+	children []uint32             // 内部节点的子节点，比keys多一个
+	prev     uint32
+	next     uint32
+	dirty    bool // 是否被修改过，需要写回磁盘
+}
+
+// 节点编码之后的大小
+func (n *bpNode) encodedSize() int {
+	size := pageHeaderSize
+	for _, key := range n.keys {
+		size += n.entryOverhead() + len(key)
+	}
+	return size
+}
+
+func (n *bpNode) entryOverhead() int {
+	if n.leaf {
+		return leafEntryOverhead
+	}
+	return internalEntryOverhead
+}
+
+// 将节点编码到页中
+func (n *bpNode) encode(page []byte) {
+	if n.leaf {
+		page[0] = pageTypeLeaf
+		binary.LittleEndian.PutUint32(page[3:], n.prev)
+	} else {
+		page[0] = pageTypeInternal
+		binary.LittleEndian.PutUint32(page[3:], n.children[0])
+	}
+	binary.LittleEndian.PutUint16(page[1:], uint16(len(n.keys)))
+	binary.LittleEndian.PutUint32(page[7:], n.next)
+
+	var index = pageHeaderSize
+	for i, key := range n.keys {
+		binary.LittleEndian.PutUint16(page[index:], uint16(len(key)))
+		index += 2
+		index += copy(page[index:], key)
+		if n.leaf {
+			pos := n.vals[i]
+			binary.LittleEndian.PutUint32(page[index:], pos.Fid)
+			binary.LittleEndian.PutUint64(page[index+4:], uint64(pos.Offset))
+			binary.LittleEndian.PutUint32(page[index+12:], pos.Size)
+			binary.LittleEndian.PutUint64(page[index+16:], uint64(pos.Expire))
+			binary.LittleEndian.PutUint64(page[index+24:], pos.Version)
+			index += 32
+		} else {
+			binary.LittleEndian.PutUint32(page[index:], n.children[i+1])
+			index += 4
+		}
+	}
+}
+
+// 从页中解码节点
+func decodeNode(id uint32, page []byte) (*bpNode, error) {
+	n := &bpNode{id: id}
+	switch page[0] {
+	case pageTypeLeaf:
+		n.leaf = true
+		n.prev = binary.LittleEndian.Uint32(page[3:])
+	case pageTypeInternal:
+		n.children = append(n.children, binary.LittleEndian.Uint32(page[3:]))
+	default:
+		return nil, ErrBPTreePageCorrupted
+	}
+	count := int(binary.LittleEndian.Uint16(page[1:]))
+	n.next = binary.LittleEndian.Uint32(page[7:])
+
+	var index = pageHeaderSize
+	for i := 0; i < count; i++ {
+		if index+2 > len(page) {
+			return nil, ErrBPTreePageCorrupted
+		}
+		keySize := int(binary.LittleEndian.Uint16(page[index:]))
+		index += 2
+		if index+keySize+n.entryOverhead()-2 > len(page) {
+			return nil, ErrBPTreePageCorrupted
+		}
+		key := make([]byte, keySize)
+		index += copy(key, page[index:index+keySize])
+		n.keys = append(n.keys, key)
+		if n.leaf {
+			n.vals = append(n.vals, &data.LogRecordPos{
+				Fid:     binary.LittleEndian.Uint32(page[index:]),
+				Offset:  int64(binary.LittleEndian.Uint64(page[index+4:])),
+				Size:    binary.LittleEndian.Uint32(page[index+12:]),
+				Expire:  int64(binary.LittleEndian.Uint64(page[index+16:])),
+				Version: binary.LittleEndian.Uint64(page[index+24:]),
+			})
+			index += 32
+		} else {
+			n.children = append(n.children, binary.LittleEndian.Uint32(page[index:]))
+			index += 4
+		}
+	}
+	return n, nil
+}
+
+// bufferPool 页缓存，按LRU淘汰，被淘汰的脏页写回磁盘
+// 淘汰只在每次操作结束时进行，保证操作过程中持有的节点不会被换出
+type bufferPool struct {
+	mu       *sync.Mutex
+	fd       *os.File
+	capacity int
+	nodes    map[uint32]*list.Element
+	lru      *list.List
+}
+
+func newBufferPool(fd *os.File, capacity int) *bufferPool {
+	return &bufferPool{
+		mu:       new(sync.Mutex),
+		fd:       fd,
+		capacity: capacity,
+		nodes:    make(map[uint32]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// 获取节点，不在缓存中则从磁盘读取
+func (bp *bufferPool) get(id uint32) (*bpNode, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if elem, ok := bp.nodes[id]; ok {
+		bp.lru.MoveToFront(elem)
+		return elem.Value.(*bpNode), nil
+	}
+
+	page := make([]byte, bptreePageSize)
+	if _, err := bp.fd.ReadAt(page, int64(id)*bptreePageSize); err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(id, page)
+	if err != nil {
+		return nil, err
+	}
+	bp.nodes[id] = bp.lru.PushFront(n)
+	return n, nil
+}
+
+// 加入新分配的节点
+func (bp *bufferPool) add(n *bpNode) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	n.dirty = true
+	bp.nodes[n.id] = bp.lru.PushFront(n)
+}
+
+// 淘汰超出容量的节点
+func (bp *bufferPool) evict() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for bp.lru.Len() > bp.capacity {
+		elem := bp.lru.Back()
+		n := elem.Value.(*bpNode)
+		if n.dirty {
+			if err := bp.writeNode(n); err != nil {
+				return err
+			}
+		}
+		bp.lru.Remove(elem)
+		delete(bp.nodes, n.id)
+	}
+	return nil
+}
+
+// 将所有脏页写回磁盘并持久化
+func (bp *bufferPool) flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for elem := bp.lru.Front(); elem != nil; elem = elem.Next() {
+		n := elem.Value.(*bpNode)
+		if n.dirty {
+			if err := bp.writeNode(n); err != nil {
+				return err
+			}
+		}
+	}
+	return bp.fd.Sync()
+}
+
+func (bp *bufferPool) writeNode(n *bpNode) error {
+	page := make([]byte, bptreePageSize)
+	n.encode(page)
+	if _, err := bp.fd.WriteAt(page, int64(n.id)*bptreePageSize); err != nil {
+		return err
+	}
+	n.dirty = false
+	return nil
+}
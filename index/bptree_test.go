@@ -0,0 +1,204 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func newTestBPTree(t *testing.T) (*BPlusTree, string) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree")
+	bpt, err := NewBPlusTree(dir)
+	assert.Nil(t, err)
+	return bpt, dir
+}
+
+func TestBPlusTree_Put(t *testing.T) {
+	bpt, dir := newTestBPTree(t)
+	defer os.RemoveAll(dir)
+	defer bpt.Close()
+
+	res1 := bpt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.True(t, res1)
+	res2 := bpt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 110})
+	assert.True(t, res2)
+	res3 := bpt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 120})
+	assert.True(t, res3)
+	assert.Equal(t, int64(2), bpt.size)
+
+	// key 超过最大长度
+	res4 := bpt.Put(make([]byte, BPTreeMaxKeySize+1), &data.LogRecordPos{Fid: 1, Offset: 130})
+	assert.False(t, res4)
+}
+
+func TestBPlusTree_Get(t *testing.T) {
+	bpt, dir := newTestBPTree(t)
+	defer os.RemoveAll(dir)
+	defer bpt.Close()
+
+	bpt.Put([]byte("uu"), &data.LogRecordPos{Fid: 1, Offset: 100, Size: 10})
+	bpt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 110})
+
+	res1 := bpt.Get([]byte("uu"))
+	assert.Equal(t, uint32(1), res1.Fid)
+	assert.Equal(t, int64(100), res1.Offset)
+	assert.Equal(t, uint32(10), res1.Size)
+	assert.Nil(t, bpt.Get([]byte("u")))
+
+	bpt.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 110})
+	assert.Equal(t, uint32(2), bpt.Get([]byte("a")).Fid)
+}
+
+func TestBPlusTree_Delete(t *testing.T) {
+	bpt, dir := newTestBPTree(t)
+	defer os.RemoveAll(dir)
+	defer bpt.Close()
+
+	bpt.Put([]byte("uu"), &data.LogRecordPos{Fid: 1, Offset: 100})
+	bpt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 110})
+
+	assert.True(t, bpt.Delete([]byte("uu")))
+	assert.True(t, bpt.Delete([]byte("a")))
+	assert.False(t, bpt.Delete([]byte("a")))
+	assert.Nil(t, bpt.Get([]byte("a")))
+	assert.Equal(t, int64(0), bpt.size)
+}
+
+func TestBPlusTree_Iterator(t *testing.T) {
+	bpt, dir := newTestBPTree(t)
+	defer os.RemoveAll(dir)
+	defer bpt.Close()
+
+	// 索引为空
+	iter1 := bpt.Iterator(false)
+	assert.Equal(t, false, iter1.Valid())
+
+	for _, key := range []string{"ccde", "acee", "eede", "bbcd", "bb"} {
+		bpt.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 10})
+	}
+	var keys []string
+	iter2 := bpt.Iterator(false)
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		assert.NotNil(t, iter2.Value())
+		keys = append(keys, string(iter2.Key()))
+	}
+	assert.Equal(t, []string{"acee", "bb", "bbcd", "ccde", "eede"}, keys)
+
+	// 逆序
+	keys = nil
+	iter3 := bpt.Iterator(true)
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		keys = append(keys, string(iter3.Key()))
+	}
+	assert.Equal(t, []string{"eede", "ccde", "bbcd", "bb", "acee"}, keys)
+
+	// Seek
+	keys = nil
+	for iter2.Seek([]byte("cc")); iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+	}
+	assert.Equal(t, []string{"ccde", "eede"}, keys)
+
+	// 逆序seek
+	keys = nil
+	for iter3.Seek([]byte("ccde")); iter3.Valid(); iter3.Next() {
+		keys = append(keys, string(iter3.Key()))
+	}
+	assert.Equal(t, []string{"ccde", "bbcd", "bb", "acee"}, keys)
+}
+
+// 随机写入和删除，数据量远大于页缓存，结果和 map 保持一致，重新打开之后数据仍然存在
+func TestBPlusTree_Random(t *testing.T) {
+	bpt, dir := newTestBPTree(t)
+	defer os.RemoveAll(dir)
+	bpt.pool.capacity = 16
+
+	expected := make(map[string]int64)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		key := []byte(fmt.Sprintf("bitcask-key-%d", rnd.Intn(20000)))
+		if rnd.Intn(3) == 0 {
+			_, exist := expected[string(key)]
+			assert.Equal(t, exist, bpt.Delete(key))
+			delete(expected, string(key))
+		} else {
+			assert.True(t, bpt.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+			expected[string(key)] = int64(i)
+		}
+	}
+
+	check := func(bpt *BPlusTree) {
+		assert.Equal(t, int64(len(expected)), bpt.size)
+		var sortedKeys []string
+		for key, offset := range expected {
+			pos := bpt.Get([]byte(key))
+			assert.NotNil(t, pos)
+			assert.Equal(t, offset, pos.Offset)
+			sortedKeys = append(sortedKeys, key)
+		}
+		sort.Strings(sortedKeys)
+
+		iter := bpt.Iterator(false)
+		var idx int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.True(t, bytes.Equal([]byte(sortedKeys[idx]), iter.Key()))
+			idx++
+		}
+		assert.Equal(t, len(sortedKeys), idx)
+
+		iter = bpt.Iterator(true)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			idx--
+			assert.True(t, bytes.Equal([]byte(sortedKeys[idx]), iter.Key()))
+		}
+		assert.Equal(t, 0, idx)
+	}
+	check(bpt)
+
+	// 设置检查点之后关闭，重新打开
+	bpt.SetCheckpoint([]byte("checkpoint"))
+	assert.Nil(t, bpt.Close())
+	bpt2, err := NewBPlusTree(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("checkpoint"), bpt2.Checkpoint())
+	check(bpt2)
+
+	// 没有正常关闭，重新打开时索引被清空
+	assert.Nil(t, bpt2.fd.Close())
+	bpt3, err := NewBPlusTree(dir)
+	assert.Nil(t, err)
+	defer bpt3.Close()
+	assert.Nil(t, bpt3.Checkpoint())
+	assert.Equal(t, int64(0), bpt3.size)
+	assert.False(t, bpt3.Iterator(false).Valid())
+}
+
+// 迭代过程中有新的写入，不会重复或遗漏已有的 key
+func TestBPlusTree_IteratorConcurrentWrite(t *testing.T) {
+	bpt, dir := newTestBPTree(t)
+	defer os.RemoveAll(dir)
+	defer bpt.Close()
+
+	for i := 0; i < 10000; i += 2 {
+		bpt.Put([]byte(fmt.Sprintf("key-%06d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	for _, reverse := range []bool{false, true} {
+		iter := bpt.Iterator(reverse)
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			// 写入新的 key，导致叶子节点分裂
+			i := rand.Intn(10000)
+			bpt.Put([]byte(fmt.Sprintf("key-%06d-new", i)), &data.LogRecordPos{Fid: 2, Offset: int64(i)})
+			if iter.Value().Fid == 1 {
+				count++
+			}
+		}
+		assert.Equal(t, 5000, count)
+	}
+}
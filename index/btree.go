@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"kv-bitcask/data"
-	"sort"
 	"sync"
 )
 
@@ -32,7 +31,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) bool {
 }
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -49,62 +50,82 @@ func (bt *BTree) Delete(key []byte) bool {
 	return true
 }
 
+func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.tree.Len()
+}
+
 func (bt *BTree) Iterator(reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
+	// Clone会修改原树的写时复制标记，需要加写锁
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return newBTreeIterator(bt.tree.Clone(), reverse)
 }
 
+// 迭代器每次从树中加载的数据条数
+const btreeIteratorBatchSize = 128
+
 // BTree 索引迭代器
+// 创建时对树做写时复制的克隆，不需要拷贝数据，之后的写入也不会影响遍历
+// 遍历时每次按顺序加载一批数据，用完之后从最后一个key继续加载
 type btreeIterator struct {
-	currIndex int     // 当前遍历位置的下标
-	reverse   bool    // 是否反向遍历
-	values    []*Item // key和位置的索引信息
+	tree      *btree.BTree // 创建迭代器时索引的只读副本
+	currIndex int          // 当前遍历位置在本批数据中的下标
+	reverse   bool         // 是否反向遍历
+	values    []*Item      // 当前加载的一批key和位置的索引信息
 }
 
 func newBTreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
+	bti := &btreeIterator{
+		tree:    tree,
+		reverse: reverse,
+	}
+	bti.Rewind()
+	return bti
+}
 
-	// 把数据放在数组中
+// 从pivot开始（为nil时从头开始）按遍历方向加载一批数据，skipPivot为true时跳过和pivot相等的key
+func (bti *btreeIterator) load(pivot *Item, skipPivot bool) {
+	bti.currIndex = 0
+	bti.values = bti.values[:0]
 	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
+		item := it.(*Item)
+		if skipPivot && bytes.Equal(item.key, pivot.key) {
+			return true
+		}
+		bti.values = append(bti.values, item)
+		return len(bti.values) < btreeIteratorBatchSize
 	}
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
-	}
-	return &btreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+	switch {
+	case pivot == nil && bti.reverse:
+		bti.tree.Descend(saveValues)
+	case pivot == nil:
+		bti.tree.Ascend(saveValues)
+	case bti.reverse:
+		bti.tree.DescendLessOrEqual(pivot, saveValues)
+	default:
+		bti.tree.AscendGreaterOrEqual(pivot, saveValues)
 	}
 }
 
 func (bti *btreeIterator) Rewind() {
-	bti.currIndex = 0
+	bti.load(nil, false)
 }
 
 func (bti *btreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
-	} else {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
-	}
+	bti.load(&Item{key: key}, false)
 }
 
 func (bti *btreeIterator) Next() {
 	bti.currIndex += 1
+	// 本批数据已经用完，从最后一个key之后继续加载
+	if bti.currIndex == len(bti.values) && len(bti.values) == btreeIteratorBatchSize {
+		bti.load(bti.values[len(bti.values)-1], true)
+	}
 }
 
 func (bti *btreeIterator) Valid() bool {
@@ -120,5 +141,10 @@ func (bti *btreeIterator) Value() *data.LogRecordPos {
 }
 
 func (bti *btreeIterator) Close() {
+	bti.tree = nil
 	bti.values = nil
 }
+
+func (bt *BTree) Close() error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package index
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"kv-bitcask/data"
 	"log"
@@ -92,3 +93,42 @@ func TestBTree_Iterator(t *testing.T) {
 		log.Print(string(iter6.Key()))
 	}
 }
+
+// 数据量超过一批，迭代过程中有新的写入和删除，遍历的仍是创建迭代器时的数据
+func TestBTree_IteratorBatch(t *testing.T) {
+	bt := NewBTree()
+	for i := 0; i < 1000; i++ {
+		bt.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	for _, reverse := range []bool{false, true} {
+		iter := bt.Iterator(reverse)
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			i := count
+			if reverse {
+				i = 999 - count
+			}
+			assert.Equal(t, fmt.Sprintf("key-%04d", i), string(iter.Key()))
+			assert.Equal(t, int64(i), iter.Value().Offset)
+			bt.Put([]byte(fmt.Sprintf("key-%04d-new", i)), &data.LogRecordPos{Fid: 2})
+			bt.Delete([]byte(fmt.Sprintf("key-%04d", 999-i)))
+			count++
+		}
+		assert.Equal(t, 1000, count)
+
+		// 恢复数据
+		for i := 0; i < 1000; i++ {
+			bt.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			bt.Delete([]byte(fmt.Sprintf("key-%04d-new", i)))
+		}
+	}
+
+	iter := bt.Iterator(false)
+	iter.Seek([]byte("key-0500"))
+	var count int
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 500, count)
+}
@@ -19,6 +19,12 @@ type Indexer interface {
 
 	// Iterator 索引迭代器
 	Iterator(reverse bool) Iterator
+
+	// Size 索引中key的数量
+	Size() int
+
+	// Close 关闭索引，持久化的索引需要将数据写回磁盘
+	Close() error
 }
 
 type IndexType = int8
@@ -29,15 +35,20 @@ const (
 
 	// ART 自适应基数树索引
 	ART
+
+	// BPTree 磁盘上的B+树索引，适用于key无法全部放在内存中的场景
+	BPTree
 )
 
-func NewIndexer(typ IndexType) Indexer {
+// NewIndexer 根据索引类型创建索引，持久化的索引存放在dirPath中
+func NewIndexer(typ IndexType, dirPath string) (Indexer, error) {
 	switch typ {
 	case Btree:
-		return NewBTree()
+		return NewBTree(), nil
 	case ART:
-		// todo
-		return nil
+		return NewART(), nil
+	case BPTree:
+		return NewBPlusTree(dirPath)
 	default:
 		panic("unsupported index type")
 	}
@@ -0,0 +1,176 @@
+package kv_bitcask
+
+import (
+	"bytes"
+	"kv-bitcask/data"
+	"kv-bitcask/index"
+	"time"
+)
+
+// Iterator 面向用户的迭代器，遍历的key范围由前缀和[Start, End)共同决定
+type Iterator struct {
+	indexIter index.Iterator // 索引迭代器
+	db        *DB
+	options   IteratorOptions
+	lower     []byte    // 遍历范围的下界（包含），为空表示不限制
+	upper     []byte    // 遍历范围的上界（不包含），为空表示不限制
+	snapshot  *Snapshot // 遍历快照时不为空，value从快照中读取
+}
+
+// NewIterator 初始化迭代器，索引迭代器在创建时保存了当前的索引数据，之后的写入不会影响遍历的key，Value读取的是key当前的数据
+// 数据库已经关闭时返回的迭代器没有任何数据
+func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.isClosed {
+		return newIterator(db, closedIterator{}, opts)
+	}
+	return newIterator(db, db.index.Iterator(opts.Reverse), opts)
+}
+
+func newIterator(db *DB, indexIter index.Iterator, opts IteratorOptions) *Iterator {
+	// 将前缀转换为范围，和用户指定的范围取交集
+	lower, upper := opts.Start, opts.End
+	if len(opts.Prefix) > 0 {
+		if lower == nil || bytes.Compare(opts.Prefix, lower) > 0 {
+			lower = opts.Prefix
+		}
+		if prefixEnd := prefixSuccessor(opts.Prefix); prefixEnd != nil &&
+			(upper == nil || bytes.Compare(prefixEnd, upper) < 0) {
+			upper = prefixEnd
+		}
+	}
+
+	it := &Iterator{
+		indexIter: indexIter,
+		db:        db,
+		options:   opts,
+		lower:     lower,
+		upper:     upper,
+	}
+	it.Rewind()
+	return it
+}
+
+// Rewind 重新回到迭代器的起点，即范围内的第一个数据
+func (it *Iterator) Rewind() {
+	if it.options.Reverse {
+		it.seekUpper()
+	} else if it.lower != nil {
+		it.indexIter.Seek(it.lower)
+	} else {
+		it.indexIter.Rewind()
+	}
+	it.skipExpired()
+}
+
+// Seek 根据传入的key找到第一个大于（或小于）等于的目标key，从该key开始遍历，不会超出遍历范围
+func (it *Iterator) Seek(key []byte) {
+	if it.options.Reverse {
+		if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+			it.seekUpper()
+			it.skipExpired()
+			return
+		}
+	} else if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+	it.indexIter.Seek(key)
+	it.skipExpired()
+}
+
+// 反向遍历时定位到上界之前的第一个key
+func (it *Iterator) seekUpper() {
+	if it.upper == nil {
+		it.indexIter.Rewind()
+		return
+	}
+	it.indexIter.Seek(it.upper)
+	if it.indexIter.Valid() && bytes.Equal(it.indexIter.Key(), it.upper) {
+		it.indexIter.Next()
+	}
+}
+
+// Next 跳转到下一个key
+func (it *Iterator) Next() {
+	it.indexIter.Next()
+	it.skipExpired()
+}
+
+// 跳过已经过期的key
+func (it *Iterator) skipExpired() {
+	now := time.Now().UnixNano()
+	for it.Valid() && it.indexIter.Value().IsExpired(now) {
+		it.indexIter.Next()
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了范围内所有的key
+func (it *Iterator) Valid() bool {
+	if !it.indexIter.Valid() {
+		return false
+	}
+	key := it.indexIter.Key()
+	if it.options.Reverse {
+		return it.lower == nil || bytes.Compare(key, it.lower) >= 0
+	}
+	return it.upper == nil || bytes.Compare(key, it.upper) < 0
+}
+
+// Key 当前遍历位置的key数据
+func (it *Iterator) Key() []byte {
+	return it.indexIter.Key()
+}
+
+// Value 当前遍历位置的value数据，从对应的数据文件中读取
+// 创建迭代器之后的merge会改变数据的位置，读取时重新从索引中获取位置，读取的是key当前的value
+func (it *Iterator) Value() ([]byte, error) {
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+
+	if it.db.isClosed {
+		return nil, ErrDBClosed
+	}
+	var logRecordPos *data.LogRecordPos
+	if it.snapshot != nil {
+		if it.snapshot.released {
+			return nil, ErrSnapshotReleased
+		}
+		logRecordPos = it.snapshot.position(it.Key())
+	} else {
+		logRecordPos = it.db.index.Get(it.Key())
+	}
+	if logRecordPos == nil {
+		return nil, ErrKeyNotFound
+	}
+	return it.db.getValueByPosition(logRecordPos)
+}
+
+// Close 关闭迭代器，释放相应资源
+func (it *Iterator) Close() {
+	it.indexIter.Close()
+}
+
+// closedIterator 数据库关闭之后创建的索引迭代器，不能再访问已经关闭的索引
+type closedIterator struct{}
+
+func (closedIterator) Rewind()                   {}
+func (closedIterator) Seek([]byte)               {}
+func (closedIterator) Next()                     {}
+func (closedIterator) Valid() bool               { return false }
+func (closedIterator) Key() []byte               { return nil }
+func (closedIterator) Value() *data.LogRecordPos { return nil }
+func (closedIterator) Close()                    {}
+
+// 计算大于所有以prefix为前缀的key的最小key，prefix全为0xff时不存在，返回nil
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix[:i+1])
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
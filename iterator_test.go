@@ -0,0 +1,225 @@
+package kv_bitcask
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/utils"
+	"os"
+	"testing"
+)
+
+// 收集迭代器遍历到的所有 key
+func iterKeys(it *Iterator) []string {
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func TestDB_NewIterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	assert.NotNil(t, iterator)
+	assert.Equal(t, false, iterator.Valid())
+}
+
+func TestDB_Iterator_One_Value(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(10), utils.GetTestKey(10))
+	assert.Nil(t, err)
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	assert.NotNil(t, iterator)
+	assert.Equal(t, true, iterator.Valid())
+	assert.Equal(t, utils.GetTestKey(10), iterator.Key())
+	val, err := iterator.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+}
+
+func TestDB_Iterator_Multi_Values(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-3")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"annde", "cnedc", "aeeue", "esnue", "bnede", "aa", "ab"} {
+		err := db.Put([]byte(key), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+
+	// 正向迭代
+	iter1 := db.NewIterator(DefaultIteratorOptions)
+	assert.Equal(t, []string{"aa", "ab", "aeeue", "annde", "bnede", "cnedc", "esnue"}, iterKeys(iter1))
+	iter1.Rewind()
+	for iter1.Seek([]byte("c")); iter1.Valid(); iter1.Next() {
+		assert.NotNil(t, iter1.Key())
+		val, err := iter1.Value()
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	iter1.Close()
+
+	// 反向迭代
+	iterOpts := DefaultIteratorOptions
+	iterOpts.Reverse = true
+	iter2 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"esnue", "cnedc", "bnede", "annde", "aeeue", "ab", "aa"}, iterKeys(iter2))
+	iter2.Seek([]byte("c"))
+	assert.Equal(t, []string{"bnede", "annde", "aeeue", "ab", "aa"}, iterKeys(iter2))
+	iter2.Close()
+
+	// 指定了 prefix
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Prefix = []byte("a")
+	iter3 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"aa", "ab", "aeeue", "annde"}, iterKeys(iter3))
+	iter3.Close()
+
+	// 反向遍历指定的 prefix
+	iterOpts.Reverse = true
+	iter4 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"annde", "aeeue", "ab", "aa"}, iterKeys(iter4))
+	iter4.Seek([]byte("zz"))
+	assert.Equal(t, []string{"annde", "aeeue", "ab", "aa"}, iterKeys(iter4))
+	iter4.Close()
+
+	// 指定范围 [Start, End)
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Start = []byte("ab")
+	iterOpts.End = []byte("cnedc")
+	iter5 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"ab", "aeeue", "annde", "bnede"}, iterKeys(iter5))
+	iter5.Seek([]byte("a"))
+	assert.Equal(t, []string{"ab", "aeeue", "annde", "bnede"}, iterKeys(iter5))
+	iter5.Close()
+
+	// 反向遍历指定的范围
+	iterOpts.Reverse = true
+	iter6 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"bnede", "annde", "aeeue", "ab"}, iterKeys(iter6))
+	iter6.Close()
+
+	// 范围和前缀同时指定
+	iterOpts = DefaultIteratorOptions
+	iterOpts.Prefix = []byte("a")
+	iterOpts.Start = []byte("ab")
+	iterOpts.End = []byte("b")
+	iter7 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"ab", "aeeue", "annde"}, iterKeys(iter7))
+	iter7.Close()
+}
+
+func TestDB_Iterator_Concurrent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-4")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+	}
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+
+	// 迭代过程中有新的写入和删除
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = db.Delete(utils.GetTestKey(i))
+			_ = db.Put(utils.GetTestKey(i+100), utils.RandomValue(10))
+		}
+	}()
+
+	var count int
+	for ; iterator.Valid(); iterator.Next() {
+		val, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+		count++
+	}
+	<-done
+	assert.Equal(t, 100, count)
+
+	// 关闭之后读取 value
+	iter2 := db.NewIterator(DefaultIteratorOptions)
+	defer iter2.Close()
+	err = db.Close()
+	assert.Nil(t, err)
+	assert.True(t, iter2.Valid())
+	_, err = iter2.Value()
+	assert.Equal(t, ErrDBClosed, err)
+
+	// 关闭之后创建的迭代器没有数据
+	iter3 := db.NewIterator(IteratorOptions{Prefix: []byte("a"), Reverse: true})
+	defer iter3.Close()
+	assert.False(t, iter3.Valid())
+	iter3.Seek(utils.GetTestKey(1))
+	assert.False(t, iter3.Valid())
+}
+
+// 创建迭代器之后merge改变了数据的位置，仍然可以读取到正确的value
+func TestDB_Iterator_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-6")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d-old", i))))
+	}
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i))))
+	}
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	assert.Nil(t, db.Delete([]byte("key-000")))
+	assert.Nil(t, db.Merge())
+
+	var count int
+	for ; iterator.Valid(); iterator.Next() {
+		val, err := iterator.Value()
+		if string(iterator.Key()) == "key-000" {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, "value-"+string(iterator.Key())[4:], string(val))
+		count++
+	}
+	assert.Equal(t, 199, count)
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	assert.Equal(t, []byte("b"), prefixSuccessor([]byte("a")))
+	assert.Equal(t, []byte("b"), prefixSuccessor([]byte{'a', 0xff}))
+	assert.Nil(t, prefixSuccessor([]byte{0xff, 0xff}))
+}
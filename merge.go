@@ -0,0 +1,500 @@
+package kv_bitcask
+
+import (
+	"fmt"
+	"io"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"kv-bitcask/index"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mergeDirName     = "merge"
+	mergeFinishedKey = "merge.finished"
+)
+
+// mergeEntry merge过程中被重写的有效记录，及其在新数据文件中的位置，已经过期被丢弃的记录pos为nil
+type mergeEntry struct {
+	key    []byte
+	fid    uint32 // 记录在被merge的文件中的位置
+	offset int64
+	pos    *data.LogRecordPos
+}
+
+// Merge 清理older文件中的无效数据（被覆盖的旧值、墓碑值和过期的数据），只保留有效记录和存活的快照仍会读取的旧版本
+// 有效记录会被重写到merge目录下的新数据文件中，全部完成后再原子地替换旧文件
+// merge过程中active文件仍然可以正常读写
+func (db *DB) Merge() error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	if db.isClosed {
+		db.mu.Unlock()
+		return ErrDBClosed
+	}
+	if db.isMerging {
+		db.mu.Unlock()
+		return ErrMergeIsProgress
+	}
+	// 数据库为空，无需merge
+	if db.activeFile == nil || (len(db.olderFiles) == 0 && db.activeFile.WriteOff == 0) {
+		db.mu.Unlock()
+		return nil
+	}
+	db.isMerging = true
+	db.mergeWg.Add(1)
+	defer db.mergeWg.Done()
+	defer func() {
+		db.mu.Lock()
+		db.isMerging = false
+		db.mu.Unlock()
+	}()
+
+	mergeFiles, firstMergeFileId, nonMergeFileId, err := db.rotateMergeFiles()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 从小到大处理需要merge的文件
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
+
+	// 清理上一次可能残留的merge目录
+	mergePath := filepath.Join(db.options.DirPath, mergeDirName)
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
+		return err
+	}
+
+	entries, mergedCount, corrupted, err := db.rewriteMergeFiles(mergePath, mergeFiles, firstMergeFileId, nonMergeFileId)
+	if err != nil {
+		return err
+	}
+
+	// 写入merge完成的标识，此后即使崩溃，下次启动时也能完成替换
+	if err := writeMergeFinished(mergePath, nonMergeFileId, firstMergeFileId, mergedCount); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.swapMergeFiles(nonMergeFileId, firstMergeFileId, mergedCount, entries, corrupted)
+}
+
+// 持久化当前active文件，并将其转换为older文件，所有的older文件都参与merge，调用方需持有db.mu写锁
+// active文件之后预留和参与merge的文件数量相同的id给merge生成的新文件，新的写入进入预留的id之后的文件中
+// 新文件的id不会和任何旧文件重叠，替换之前获取的旧位置不会读取到新文件中其他的记录
+func (db *DB) rotateMergeFiles() (mergeFiles []*data.DataFile, firstMergeFileId, nonMergeFileId uint32, err error) {
+	if err := db.activeFile.Sync(); err != nil {
+		return nil, 0, 0, err
+	}
+	db.syncer.markSynced(db.writtenBytes)
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+
+	firstMergeFileId = db.activeFile.FileId + 1
+	nonMergeFileId = firstMergeFileId + uint32(len(db.olderFiles))
+	if err := db.openActiveDataFile(nonMergeFileId); err != nil {
+		return nil, 0, 0, err
+	}
+	for _, dataFile := range db.olderFiles {
+		mergeFiles = append(mergeFiles, dataFile)
+	}
+	return mergeFiles, firstMergeFileId, nonMergeFileId, nil
+}
+
+// 将需要merge的文件中的有效记录重写到merge目录中，同时为每个新文件生成hint文件
+// 新文件的id从firstFileId开始，不超过nonMergeFileId，返回重写的记录、生成的文件数量以及是否跳过了损坏的数据
+func (db *DB) rewriteMergeFiles(mergePath string, mergeFiles []*data.DataFile,
+	firstFileId, nonMergeFileId uint32) ([]*mergeEntry, uint32, bool, error) {
+	fileId := firstFileId
+	mergeFile, err := data.OpenDataFile(mergePath, fileId, fio.StandardFIO)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	hintWriter, err := newHintFileWriter(mergePath, fileId)
+	if err != nil {
+		_ = mergeFile.Close()
+		return nil, 0, false, err
+	}
+	defer func() {
+		_ = mergeFile.Close()
+		hintWriter.abort()
+	}()
+
+	// 持久化当前merge文件，并完成对应的hint文件
+	finishMergeFile := func() error {
+		if err := mergeFile.Sync(); err != nil {
+			return err
+		}
+		if err := hintWriter.finish(mergeFile.WriteOff); err != nil {
+			return err
+		}
+		return hintWriter.commit()
+	}
+
+	var entries []*mergeEntry
+	var corrupted bool
+	now := time.Now().UnixNano()
+	limiter := newMergeLimiter(db.options.MergeRateLimit, db.closeCh)
+	for _, dataFile := range mergeFiles {
+		fileSize, err := dataFile.IOManager.Size()
+		if err != nil {
+			return nil, 0, false, err
+		}
+		var offset int64 = 0
+		for offset < fileSize {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				// 文件末尾之前遇到了损坏的数据，跳过损坏的数据继续读取之后完好的记录
+				if err == io.EOF || data.IsCorrupted(err) {
+					if offset, err = db.skipCorruptedData(dataFile, offset, size, fileSize, err); err != nil {
+						return nil, 0, false, err
+					}
+					corrupted = true
+					continue
+				}
+				return nil, 0, false, err
+			}
+			// 限制读取速度，数据库关闭时放弃本次merge
+			if err := limiter.wait(size); err != nil {
+				return nil, 0, false, err
+			}
+
+			// 和内存索引中的位置进行比较，位置一致说明是有效记录
+			// 索引先于旧版本更新，先读取索引可以保证不会遗漏merge期间被覆盖的记录
+			pos := db.index.Get(logRecord.Key)
+			isLatest := logRecord.Type == data.LogRecordNormal && pos != nil &&
+				pos.Fid == dataFile.FileId && pos.Offset == offset
+			isHistory := !isLatest && logRecord.Type != data.LogRecordDeleted &&
+				logRecord.Type != data.LogRecordBatchFinished &&
+				db.versions.contains(logRecord.Key, dataFile.FileId, offset)
+
+			// 已经过期的记录直接丢弃，替换文件时从索引中删除
+			if (isLatest || isHistory) && logRecord.IsExpired(now) {
+				entries = append(entries, &mergeEntry{key: copyKey(logRecord.Key), fid: dataFile.FileId, offset: offset})
+			} else if isLatest || isHistory {
+				// 有效记录所属的批次一定已经提交，重写时不再需要批次序列号
+				logRecord.SeqNo = 0
+				// 旧版本不写入hint文件，重启之后也不会被加载
+				if isHistory {
+					logRecord.Type = data.LogRecordHistory
+				}
+				encRecord, recordSize := data.EncodeLogRecord(logRecord)
+
+				// 当前merge文件写满，打开新的文件
+				// 调小DataFileSize之后预留的id可能不够用，此时继续写入最后一个文件
+				if mergeFile.WriteOff > 0 && mergeFile.WriteOff+recordSize > db.options.DataFileSize &&
+					fileId+1 < nonMergeFileId {
+					if err := finishMergeFile(); err != nil {
+						return nil, 0, false, err
+					}
+					if err := mergeFile.Close(); err != nil {
+						return nil, 0, false, err
+					}
+					fileId++
+					if mergeFile, err = data.OpenDataFile(mergePath, fileId, fio.StandardFIO); err != nil {
+						return nil, 0, false, err
+					}
+					if hintWriter, err = newHintFileWriter(mergePath, fileId); err != nil {
+						return nil, 0, false, err
+					}
+				}
+
+				writeOff := mergeFile.WriteOff
+				if err := mergeFile.Write(encRecord); err != nil {
+					return nil, 0, false, err
+				}
+				newPos := &data.LogRecordPos{
+					Fid:    fileId,
+					Offset: writeOff,
+					Size:   uint32(recordSize),
+					Expire: logRecord.Expire,
+				}
+				if isLatest {
+					if err := hintWriter.write(logRecord, newPos); err != nil {
+						return nil, 0, false, err
+					}
+				}
+				entries = append(entries, &mergeEntry{
+					key:    copyKey(logRecord.Key),
+					fid:    dataFile.FileId,
+					offset: offset,
+					pos:    newPos,
+				})
+			}
+			offset += size
+		}
+	}
+
+	// 没有任何有效记录，不保留空文件
+	if mergeFile.WriteOff == 0 {
+		if err := os.Remove(data.GetDataFileName(mergePath, fileId)); err != nil {
+			return nil, 0, false, err
+		}
+		return entries, fileId - firstFileId, corrupted, nil
+	}
+	if err := finishMergeFile(); err != nil {
+		return nil, 0, false, err
+	}
+	return entries, fileId - firstFileId + 1, corrupted, nil
+}
+
+// merge时读取到损坏的数据，返回下一条完好记录的位置
+// 开启了Salvage时和启动时一样丢弃损坏的数据，否则返回错误，需要先使用Repair修复数据文件
+func (db *DB) skipCorruptedData(dataFile *data.DataFile, offset, size, fileSize int64, readErr error) (int64, error) {
+	if !db.options.Salvage {
+		cause := readErr
+		if cause == io.EOF {
+			cause = ErrUnexpectedZeroBytes
+		}
+		return 0, fmt.Errorf("%w: data file %d offset %d: %v, run Repair before merging",
+			ErrDataDirectoryCorrupted, dataFile.FileId, offset, cause)
+	}
+	return nextValidRecord(dataFile, offset, size, fileSize, readErr)
+}
+
+// 将merge完成的文件替换到数据目录中，并更新内存索引，调用方需持有db.mu写锁
+// corrupted为true时merge跳过了损坏的数据，索引中仍然指向被merge的文件的key会被删除
+func (db *DB) swapMergeFiles(nonMergeFileId, firstMergeFileId, mergedCount uint32,
+	entries []*mergeEntry, corrupted bool) error {
+	// 数据库已关闭，替换会在下次启动时完成
+	if db.isClosed {
+		return ErrDBClosed
+	}
+
+	// 关闭所有被merge的旧文件
+	for fid, dataFile := range db.olderFiles {
+		if fid < nonMergeFileId {
+			if err := dataFile.Close(); err != nil {
+				return err
+			}
+			delete(db.olderFiles, fid)
+		}
+	}
+	for fid := range db.reclaimSize {
+		if fid < nonMergeFileId {
+			delete(db.reclaimSize, fid)
+		}
+	}
+
+	if err := db.loadMergeFiles(); err != nil {
+		return err
+	}
+	// 数据的位置发生了变化，不是由当前索引维护的持久化B+树索引已经失效
+	if _, ok := db.index.(index.Checkpointer); !ok {
+		err := os.Remove(filepath.Join(db.options.DirPath, index.BPTreeFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// 打开merge之后的新文件
+	for fid := firstMergeFileId; fid < firstMergeFileId+mergedCount; fid++ {
+		dataFile, err := data.OpenDataFile(db.options.DirPath, fid, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		db.olderFiles[fid] = dataFile
+	}
+
+	for _, entry := range entries {
+		// 快照引用的旧版本，包括merge期间被覆盖或删除的记录
+		if len(db.snapshots) > 0 {
+			for _, version := range db.versions.find(entry.key, entry.fid, entry.offset) {
+				db.versions.setPos(version, entry.pos)
+			}
+		}
+		// 索引不再指向被merge的记录，说明merge期间被覆盖或删除，这些记录在新文件中仍然可以被回收
+		indexPos := db.index.Get(entry.key)
+		if indexPos == nil || indexPos.Fid != entry.fid || indexPos.Offset != entry.offset {
+			db.addReclaimSize(entry.pos)
+			continue
+		}
+		// 过期的记录没有被重写
+		if entry.pos == nil {
+			db.index.Delete(entry.key)
+			continue
+		}
+		// 数据本身没有变化，保留原来的版本
+		entry.pos.Version = indexPos.Version
+		if ok := db.index.Put(entry.key, entry.pos); !ok {
+			return ErrIndexUpdateFailed
+		}
+	}
+
+	// 从hint文件加载的索引可能指向损坏的记录，这些记录没有被重写，和启动时一样丢弃
+	if corrupted {
+		db.dropMergedKeys(nonMergeFileId, firstMergeFileId, mergedCount)
+	}
+	return nil
+}
+
+// 删除索引中仍然指向被merge的旧文件的key
+func (db *DB) dropMergedKeys(nonMergeFileId, firstMergeFileId, mergedCount uint32) {
+	var keys [][]byte
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		fid := iterator.Value().Fid
+		if fid < nonMergeFileId && (fid < firstMergeFileId || fid >= firstMergeFileId+mergedCount) {
+			keys = append(keys, iterator.Key())
+		}
+	}
+	iterator.Close()
+	for _, key := range keys {
+		db.index.Delete(key)
+	}
+}
+
+// 加载merge目录，如果merge已完成则用新文件替换掉旧的数据文件，否则丢弃merge的结果
+// 替换过程是可重入的，中途崩溃后再次执行仍能得到正确的结果
+func (db *DB) loadMergeFiles() error {
+	mergePath := filepath.Join(db.options.DirPath, mergeDirName)
+	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	nonMergeFileId, firstMergeFileId, mergedCount, finished, err := readMergeFinished(mergePath)
+	if err != nil {
+		return err
+	}
+	// merge没有完成，旧文件仍然有效，直接删除merge目录
+	if !finished {
+		return os.RemoveAll(mergePath)
+	}
+
+	// 删除所有参与merge的旧数据文件及其hint文件，保留已经移动过的新文件
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, data.DataFileNameSuffix) && !strings.HasSuffix(name, data.HintFileNameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.Split(name, ".")[0])
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		fid := uint32(fileId)
+		if fid < nonMergeFileId && (fid < firstMergeFileId || fid >= firstMergeFileId+mergedCount) {
+			if err := os.Remove(filepath.Join(db.options.DirPath, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 将新文件移动到数据目录中，已经移动过的文件直接跳过
+	for fid := firstMergeFileId; fid < firstMergeFileId+mergedCount; fid++ {
+		srcPath := data.GetDataFileName(mergePath, fid)
+		if _, err := os.Stat(srcPath); err == nil {
+			// 旧版本merge生成的文件会覆盖相同id的旧文件，旧的hint文件先删除，避免和新的数据文件对应
+			err := os.Remove(data.GetHintFileName(db.options.DirPath, fid))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Rename(srcPath, data.GetDataFileName(db.options.DirPath, fid)); err != nil {
+				return err
+			}
+		}
+
+		srcHintPath := data.GetHintFileName(mergePath, fid)
+		if _, err := os.Stat(srcHintPath); err == nil {
+			if err := os.Rename(srcHintPath, data.GetHintFileName(db.options.DirPath, fid)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 确保目录变更已经持久化，再删除merge目录
+	if err := syncDir(db.options.DirPath); err != nil {
+		return err
+	}
+	return os.RemoveAll(mergePath)
+}
+
+// key引用了整条记录的缓冲区，拷贝一份避免value常驻内存
+func copyKey(key []byte) []byte {
+	newKey := make([]byte, len(key))
+	copy(newKey, key)
+	return newKey
+}
+
+// 写入merge完成的标识文件，记录未参与merge的最小文件id、merge生成的第一个文件id和文件数量
+func writeMergeFinished(mergePath string, nonMergeFileId, firstMergeFileId, mergedCount uint32) error {
+	finishedFile, err := data.OpenMergeFinishedFile(mergePath, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = finishedFile.Close()
+	}()
+
+	logRecord := &data.LogRecord{
+		Key:   []byte(mergeFinishedKey),
+		Value: []byte(fmt.Sprintf("%d %d %d", nonMergeFileId, firstMergeFileId, mergedCount)),
+	}
+	encRecord, _ := data.EncodeLogRecord(logRecord)
+	if err := finishedFile.Write(encRecord); err != nil {
+		return err
+	}
+	return finishedFile.Sync()
+}
+
+// 读取merge完成的标识文件，标识不存在或不完整时finished为false
+func readMergeFinished(mergePath string) (nonMergeFileId, firstMergeFileId, mergedCount uint32, finished bool, err error) {
+	if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); os.IsNotExist(err) {
+		return 0, 0, 0, false, nil
+	}
+	finishedFile, err := data.OpenMergeFinishedFile(mergePath, fio.ReadOnlyFIO)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	defer func() {
+		_ = finishedFile.Close()
+	}()
+
+	logRecord, _, err := finishedFile.ReadLogRecord(0)
+	if err != nil {
+		// 标识写入时崩溃，merge视为未完成
+		if err == io.EOF || data.IsCorrupted(err) {
+			return 0, 0, 0, false, nil
+		}
+		return 0, 0, 0, false, err
+	}
+	if string(logRecord.Key) != mergeFinishedKey {
+		return 0, 0, 0, false, ErrDataDirectoryCorrupted
+	}
+	value := string(logRecord.Value)
+	if _, err := fmt.Sscanf(value, "%d %d %d", &nonMergeFileId, &firstMergeFileId, &mergedCount); err != nil {
+		// 旧版本的标识只记录了两个字段，merge生成的文件id从0开始
+		firstMergeFileId = 0
+		if _, err := fmt.Sscanf(value, "%d %d", &nonMergeFileId, &mergedCount); err != nil {
+			return 0, 0, 0, false, ErrDataDirectoryCorrupted
+		}
+	}
+	return nonMergeFileId, firstMergeFileId, mergedCount, true, nil
+}
+
+// 持久化目录项的变更
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Sync()
+}
@@ -0,0 +1,507 @@
+package kv_bitcask
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"kv-bitcask/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 统计数据目录下数据文件的总大小
+func dataFilesSize(t *testing.T, dirPath string) int64 {
+	matches, err := filepath.Glob(filepath.Join(dirPath, "*"+data.DataFileNameSuffix))
+	assert.Nil(t, err)
+	var size int64
+	for _, name := range matches {
+		stat, err := os.Stat(name)
+		assert.Nil(t, err)
+		size += stat.Size()
+	}
+	return size
+}
+
+// 没有任何数据的情况下进行 merge
+func TestDB_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+}
+
+// 全部都是有效的数据
+func TestDB_Merge2(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	for i := 0; i < 20000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	for i := 0; i < 20000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+// 有失效的数据，和被重复 Put 的数据
+func TestDB_Merge3(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-3")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	values := make(map[int][]byte)
+	for i := 10000; i < 15000; i++ {
+		values[i] = utils.RandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+
+	sizeBefore := dataFilesSize(t, dir)
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Less(t, dataFilesSize(t, dir), sizeBefore)
+
+	// merge 目录已被清理
+	_, err = os.Stat(filepath.Join(dir, mergeDirName))
+	assert.True(t, os.IsNotExist(err))
+
+	check := func(db *DB) {
+		for i := 0; i < 10000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := 10000; i < 15000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+		for i := 15000; i < 20000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+	}
+	check(db)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+}
+
+// merge 的过程中有新的数据写入或删除
+func TestDB_Merge4(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-4")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		for i := 20000; i < 30000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			assert.Nil(t, err)
+		}
+	}()
+	err = db.Merge()
+	assert.Nil(t, err)
+	wg.Wait()
+
+	check := func(db *DB) {
+		for i := 0; i < 10000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := 10000; i < 30000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+	}
+	check(db)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+}
+
+// merge 中途崩溃，重启后的处理
+func TestDB_Merge5(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-5")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 1.merge 没有完成，旧文件仍然有效
+	mergePath := filepath.Join(dir, mergeDirName)
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	assert.Nil(t, os.WriteFile(data.GetDataFileName(mergePath, 0), []byte("broken"), 0644))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	for i := 10000; i < 20000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+
+	// 2.merge 已经写入完成标识，但还没有替换旧文件
+	db2.mu.Lock()
+	mergeFiles, firstMergeFileId, nonMergeFileId, err := db2.rotateMergeFiles()
+	db2.mu.Unlock()
+	assert.Nil(t, err)
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	_, mergedCount, _, err := db2.rewriteMergeFiles(mergePath, mergeFiles, firstMergeFileId, nonMergeFileId)
+	assert.Nil(t, err)
+	assert.Nil(t, writeMergeFinished(mergePath, nonMergeFileId, firstMergeFileId, mergedCount))
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	sizeBefore := dataFilesSize(t, dir)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	assert.Less(t, dataFilesSize(t, dir), sizeBefore)
+	for i := 0; i < 10000; i++ {
+		_, err := db3.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 10000; i < 20000; i++ {
+		val, err := db3.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+// merge 扫描到之前，key 已经在新的 active 文件中被删除
+func TestDB_Merge6(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-6")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(24))
+	assert.Nil(t, err)
+
+	// merge 开始时转换 active 文件
+	db.mu.Lock()
+	mergeFiles, firstMergeFileId, nonMergeFileId, err := db.rotateMergeFiles()
+	db.mu.Unlock()
+	assert.Nil(t, err)
+
+	// 扫描之前删除 key
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	mergePath := filepath.Join(dir, mergeDirName)
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	entries, mergedCount, corrupted, err := db.rewriteMergeFiles(mergePath, mergeFiles, firstMergeFileId, nonMergeFileId)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Nil(t, writeMergeFinished(mergePath, nonMergeFileId, firstMergeFileId, mergedCount))
+	db.mu.Lock()
+	assert.Nil(t, db.swapMergeFiles(nonMergeFileId, firstMergeFileId, mergedCount, entries, corrupted))
+	db.mu.Unlock()
+
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+// merge 生成的新文件使用新的 id，merge 之前获取的位置不会读到新文件中的其他记录
+func TestDB_Merge7(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-7")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	oldPos := db.index.Get(utils.GetTestKey(1500))
+	oldActiveFileId := db.activeFile.FileId
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 旧的文件都已经被删除，新文件的 id 都大于旧文件
+	_, err = db.getValueByPosition(oldPos)
+	assert.Equal(t, ErrDataFileNotFound, err)
+	for fid := range db.olderFiles {
+		assert.Greater(t, fid, oldActiveFileId)
+	}
+	assert.Greater(t, db.activeFile.FileId, oldActiveFileId)
+
+	check := func(db *DB) {
+		for i := 0; i < 2000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i < 1000 {
+				assert.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+	}
+	check(db)
+
+	// 新的写入在merge生成的文件之后，重启后仍然是最新的数据
+	err = db.Put(utils.GetTestKey(1500), []byte("new-value"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+	val, err := db2.Get(utils.GetTestKey(1500))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), val)
+}
+
+// 旧版本的 merge 完成标识只有两个字段，生成的文件 id 从 0 开始
+func TestReadMergeFinished_Legacy(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-legacy")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	finishedFile, err := data.OpenMergeFinishedFile(dir, fio.StandardFIO)
+	assert.Nil(t, err)
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte(mergeFinishedKey), Value: []byte("5 2")})
+	assert.Nil(t, finishedFile.Write(encRecord))
+	assert.Nil(t, finishedFile.Close())
+
+	nonMergeFileId, firstMergeFileId, mergedCount, finished, err := readMergeFinished(dir)
+	assert.Nil(t, err)
+	assert.True(t, finished)
+	assert.Equal(t, uint32(5), nonMergeFileId)
+	assert.Equal(t, uint32(0), firstMergeFileId)
+	assert.Equal(t, uint32(2), mergedCount)
+}
+
+// older 文件中的记录在加载 hint 文件之后损坏，没有开启 Salvage 时 merge 返回错误，开启后跳过损坏的记录
+func TestDB_MergeCorrupted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-corrupted")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	pos := db.index.Get(utils.GetTestKey(100))
+	assert.Equal(t, uint32(0), pos.Fid)
+	err = db.Close()
+	assert.Nil(t, err)
+	corruptDataFile(t, dir, 0, pos.Offset+int64(pos.Size)-1)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	err = db2.Merge()
+	assert.True(t, errors.Is(err, ErrDataDirectoryCorrupted))
+	assert.Contains(t, err.Error(), "Repair")
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	opts.Salvage = true
+	check := func(db *DB) {
+		for i := 0; i < 2000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i == 100 {
+				assert.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+	}
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	err = db3.Merge()
+	assert.Nil(t, err)
+	check(db3)
+	err = db3.Close()
+	assert.Nil(t, err)
+
+	db4, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db4.Close()
+	}()
+	check(db4)
+}
+
+// 过期的数据在 merge 时被清理
+func TestDB_MergeExpired(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-expired")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		if i%2 == 0 {
+			err = db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(24), 100*time.Millisecond)
+		} else {
+			err = db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(24), time.Hour)
+		}
+		assert.Nil(t, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	sizeBefore := dataFilesSize(t, dir)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Less(t, dataFilesSize(t, dir), sizeBefore)
+
+	check := func(db *DB) {
+		for i := 0; i < 2000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i%2 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+			ttl, err := db.TTL(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.True(t, ttl > 59*time.Minute)
+		}
+		assert.Equal(t, 1000, len(db.ListKeys()))
+	}
+	check(db)
+
+	// 重启后从 hint 文件加载，仍然保留过期时间
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+}
@@ -3,19 +3,84 @@ package kv_bitcask
 import (
 	"kv-bitcask/index"
 	"os"
+	"time"
 )
 
 // Options 实现用户可自选的一些选项
 type Options struct {
-	DirPath      string          // 数据库数据目录
-	DataFileSize int64           // 数据文件的大小
-	SyncWrites   bool            // 是否每次写数据都进行持久化
-	IndexType    index.IndexType // 索引类型
+	DirPath       string          // 数据库数据目录
+	DataFileSize  int64           // 数据文件的大小
+	SyncWrites    bool            // 是否每次写数据都进行持久化，并发的写入会合并为一次fsync
+	IndexType     index.IndexType // 索引类型
+	MMapAtStartup bool            // 启动时是否使用内存映射加载数据文件
+
+	// Salvage 数据文件中间有损坏时是否丢弃损坏之后的数据继续启动，默认直接返回错误
+	// active文件末尾写入到一半的记录不受影响，总是会被截断
+	// merge时遇到损坏的数据也会跳过，否则merge返回错误，需要先使用Repair修复
+	Salvage bool
+
+	// BytesPerSync 累计写入多少字节之后持久化一次，0表示不按写入量持久化
+	BytesPerSync uint
+
+	// SyncInterval 后台定期持久化active文件的间隔，0表示不定期持久化
+	SyncInterval time.Duration
+
+	// ReadOnly 以只读方式打开，不会修改数据目录中的任何文件，写入和merge返回ErrReadOnly
+	// 对数据目录加共享锁，可以和其他只读实例同时打开；持久化的B+树索引不会被使用，启动时在内存中重建索引
+	ReadOnly bool
+
+	// RecoveryCallback 启动时丢弃了损坏数据的回调，为空时输出日志
+	RecoveryCallback func(info RecoveryInfo)
+
+	// MergeCheckInterval 后台检查是否需要merge的间隔，0表示不自动merge
+	MergeCheckInterval time.Duration
+
+	// MergeRatio older文件中可以回收的数据比例达到该值时自动merge
+	MergeRatio float32
+
+	// MergeWindows 一天中允许自动merge的时间段，为空表示任何时间都可以
+	MergeWindows []MergeWindow
+
+	// MergeRateLimit merge时每秒最多读取的数据量，用于限制merge对正常读写的影响，0表示不限制
+	MergeRateLimit int64
+}
+
+// MergeWindow 一天中的一个时间段，Start和End是距离当天0点（本地时间）的时间
+// End小于Start时表示跨过0点，例如Start为23点、End为2点
+type MergeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// WriteBatchOptions 批量写入的配置项
+type WriteBatchOptions struct {
+	MaxBatchNum uint // 一个批次中最多的数据量
+	SyncWrites  bool // 提交时是否进行持久化
+}
+
+// IteratorOptions 迭代器的配置项
+type IteratorOptions struct {
+	Prefix  []byte // 只遍历指定前缀的key，默认为空
+	Reverse bool   // 是否反向遍历，默认false是正向
+	Start   []byte // 遍历范围的起始key（包含），默认为空表示不限制
+	End     []byte // 遍历范围的结束key（不包含），默认为空表示不限制
 }
 
 var DefaultOptions = Options{
-	DirPath:      os.TempDir(),
-	DataFileSize: 256 * 1024 * 1024,
-	SyncWrites:   false,
-	IndexType:    index.Btree,
+	DirPath:       os.TempDir(),
+	DataFileSize:  256 * 1024 * 1024,
+	SyncWrites:    false,
+	IndexType:     index.Btree,
+	MMapAtStartup: true,
+	MergeRatio:    0.5,
+}
+
+var DefaultWriteBatchOptions = WriteBatchOptions{
+	MaxBatchNum: 10000,
+	SyncWrites:  true,
+}
+
+var DefaultIteratorOptions = IteratorOptions{
+	Prefix:  nil,
+	Reverse: false,
 }
@@ -0,0 +1,108 @@
+package kv_bitcask
+
+import (
+	"fmt"
+	"io"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"log"
+	"os"
+)
+
+// RecoveryInfo 启动时丢弃的损坏数据
+type RecoveryInfo struct {
+	FileId       uint32 // 数据文件id
+	Offset       int64  // 损坏数据的起始位置，之前的数据都是有效的
+	DroppedBytes int64  // 丢弃的字节数
+	Truncated    bool   // 文件是否被截断到Offset，否则文件保持不变，只是不再读取损坏之后的数据
+	Err          error  // 读取时遇到的错误
+}
+
+// 加载数据文件时在offset处遇到了损坏的数据
+// active文件末尾写入到一半的记录直接截断，其他位置的损坏只有开启了Salvage才会丢弃，否则返回错误
+func (db *DB) recoverDataFile(dataFile *data.DataFile, offset, recordSize int64, readErr error) error {
+	fileSize, err := dataFile.IOManager.Size()
+	if err != nil {
+		return err
+	}
+
+	var torn bool
+	isActive := dataFile == db.activeFile
+	if isActive {
+		if torn, err = isTornWrite(dataFile, offset, recordSize, fileSize, readErr); err != nil {
+			return err
+		}
+	}
+	if !torn && !db.options.Salvage {
+		return fmt.Errorf("%w: data file %d offset %d: %v",
+			ErrDataDirectoryCorrupted, dataFile.FileId, offset, readErr)
+	}
+
+	info := RecoveryInfo{
+		FileId:       dataFile.FileId,
+		Offset:       offset,
+		DroppedBytes: fileSize - offset,
+		Truncated:    torn && !db.options.ReadOnly,
+		Err:          readErr,
+	}
+	// 只读模式下不修改文件，也不会写入新数据，只是不再读取损坏之后的数据
+	if !db.options.ReadOnly {
+		if torn {
+			if err := truncateDataFile(db.options.DirPath, dataFile.FileId, offset); err != nil {
+				return err
+			}
+		} else if isActive {
+			// 损坏的active文件保持原样，之后的数据写入新的文件，否则新数据会被损坏的数据挡住
+			db.olderFiles[dataFile.FileId] = dataFile
+			if err := db.setActiveDataFile(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if db.options.RecoveryCallback != nil {
+		db.options.RecoveryCallback(info)
+	} else {
+		log.Printf("bitcask: dropped %d bytes of data file %d from offset %d, truncated: %v, reason: %v",
+			info.DroppedBytes, info.FileId, info.Offset, info.Truncated, info.Err)
+	}
+	return nil
+}
+
+// 判断损坏的数据是否是写入到一半时崩溃导致的，即损坏的记录之后没有其他数据
+func isTornWrite(dataFile *data.DataFile, offset, recordSize, fileSize int64, readErr error) (bool, error) {
+	switch readErr {
+	case data.ErrLogRecordTruncated:
+		return true, nil
+	case data.ErrInvalidCRC:
+		return offset+recordSize == fileSize, nil
+	case io.EOF:
+		// 文件末尾只剩下空数据，文件系统已经分配了空间但数据还没有写入
+		buf, err := dataFile.ReadNBytes(fileSize-offset, offset)
+		if err != nil {
+			return false, err
+		}
+		for _, b := range buf {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// 将数据文件截断到指定的大小并持久化
+func truncateDataFile(dirPath string, fileId uint32, size int64) error {
+	fd, err := os.OpenFile(data.GetDataFileName(dirPath, fileId), os.O_RDWR, fio.DatafilePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fd.Close()
+	}()
+	if err := fd.Truncate(size); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
@@ -0,0 +1,197 @@
+package kv_bitcask
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/utils"
+	"os"
+	"testing"
+)
+
+// 在数据文件末尾追加数据，模拟写入到一半时崩溃
+func appendToDataFile(t *testing.T, dirPath string, fileId uint32, buf []byte) {
+	f, err := os.OpenFile(data.GetDataFileName(dirPath, fileId), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(buf)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+// 修改数据文件指定位置的一个字节
+func corruptDataFile(t *testing.T, dirPath string, fileId uint32, offset int64) {
+	f, err := os.OpenFile(data.GetDataFileName(dirPath, fileId), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	assert.Nil(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, offset)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func dataFileSize(t *testing.T, dirPath string, fileId uint32) int64 {
+	stat, err := os.Stat(data.GetDataFileName(dirPath, fileId))
+	assert.Nil(t, err)
+	return stat.Size()
+}
+
+func TestOpen_TornWrite(t *testing.T) {
+	record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn-key"), Value: utils.RandomValue(128)})
+	tails := map[string][]byte{
+		"truncated header": record[:3],
+		"truncated value":  record[:len(record)-10],
+		"invalid crc":      append(append([]byte{}, record[:len(record)-1]...), record[len(record)-1]^0xff),
+		"zero":             make([]byte, 4096),
+	}
+
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-recovery")
+			opts.DirPath = dir
+			var infos []RecoveryInfo
+			opts.RecoveryCallback = func(info RecoveryInfo) {
+				infos = append(infos, info)
+			}
+			db, err := Open(opts)
+			defer destroyDB(db)
+			assert.Nil(t, err)
+
+			for i := 0; i < 100; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+			err = db.Close()
+			assert.Nil(t, err)
+			validSize := dataFileSize(t, dir, 0)
+			appendToDataFile(t, dir, 0, tail)
+
+			// 末尾不完整的记录被截断
+			db2, err := Open(opts)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(infos))
+			assert.Equal(t, uint32(0), infos[0].FileId)
+			assert.Equal(t, validSize, infos[0].Offset)
+			assert.Equal(t, int64(len(tail)), infos[0].DroppedBytes)
+			assert.True(t, infos[0].Truncated)
+			assert.Equal(t, validSize, dataFileSize(t, dir, 0))
+
+			// 截断之后写入的数据重启后仍然有效
+			err = db2.Put(utils.GetTestKey(100), utils.GetTestKey(100))
+			assert.Nil(t, err)
+			err = db2.Close()
+			assert.Nil(t, err)
+
+			db3, err := Open(opts)
+			assert.Nil(t, err)
+			defer func() {
+				_ = db3.Close()
+			}()
+			assert.Equal(t, 1, len(infos))
+			for i := 0; i <= 100; i++ {
+				val, err := db3.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, utils.GetTestKey(i), val)
+			}
+		})
+	}
+}
+
+func TestOpen_CorruptedActiveFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-active")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 损坏的记录之后还有数据，不是写入到一半导致的
+	pos := db.index.Get(utils.GetTestKey(50))
+	corruptDataFile(t, dir, 0, pos.Offset+int64(pos.Size)-1)
+	_, err = Open(opts)
+	assert.True(t, errors.Is(err, ErrDataDirectoryCorrupted))
+
+	// 开启 Salvage 后丢弃损坏之后的数据，新数据写入新的文件
+	var infos []RecoveryInfo
+	opts.Salvage = true
+	opts.RecoveryCallback = func(info RecoveryInfo) {
+		infos = append(infos, info)
+	}
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(infos))
+	assert.Equal(t, pos.Offset, infos[0].Offset)
+	assert.False(t, infos[0].Truncated)
+	assert.Equal(t, uint32(1), db2.activeFile.FileId)
+	val, err := db2.Get(utils.GetTestKey(49))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(49), val)
+	_, err = db2.Get(utils.GetTestKey(50))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db2.Put(utils.GetTestKey(50), utils.GetTestKey(50))
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db3.Close()
+	}()
+	val, err = db3.Get(utils.GetTestKey(50))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(50), val)
+}
+
+func TestOpen_CorruptedOlderFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-older")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	assert.Greater(t, len(db.olderFiles), 0)
+
+	// 删除 hint 文件，从数据文件中加载索引；older 文件末尾的损坏也不会被截断
+	assert.Nil(t, os.Remove(data.GetHintFileName(dir, 0)))
+	size := dataFileSize(t, dir, 0)
+	corruptDataFile(t, dir, 0, size-1)
+	_, err = Open(opts)
+	assert.True(t, errors.Is(err, ErrDataDirectoryCorrupted))
+
+	opts.Salvage = true
+	var infos []RecoveryInfo
+	opts.RecoveryCallback = func(info RecoveryInfo) {
+		infos = append(infos, info)
+	}
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 1, len(infos))
+	assert.Equal(t, uint32(0), infos[0].FileId)
+	assert.False(t, infos[0].Truncated)
+	assert.Equal(t, size, dataFileSize(t, dir, 0))
+	val, err := db2.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
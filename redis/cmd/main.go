@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	bitcask "kv-bitcask"
+	"kv-bitcask/redis"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	addr := flag.String("addr", ":6380", "监听的TCP地址")
+	dir := flag.String("dir", "", "数据目录，默认使用临时目录")
+	flag.Parse()
+
+	opts := bitcask.DefaultOptions
+	if *dir != "" {
+		opts.DirPath = *dir
+	}
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+
+	server := redis.NewServer(db)
+	// 收到退出信号时先关闭服务，等待所有连接处理结束之后再关闭数据库
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		_ = server.Close()
+	}()
+
+	log.Printf("redis server listening on %s, data dir %s", *addr, opts.DirPath)
+	if err := server.ListenAndServe(*addr); err != redis.ErrServerClosed {
+		log.Printf("redis server stopped: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Fatalf("failed to close db: %v", err)
+	}
+}
@@ -0,0 +1,657 @@
+package redis
+
+import (
+	"bytes"
+	bitcask "kv-bitcask"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultScanCount = 10               // SCAN默认每次检查的key数量
+	maxScanCursors   = 64 * 1024        // 服务最多保存的SCAN游标数量，超过之后丢弃最早的游标
+	scanCursorTTL    = 10 * time.Minute // SCAN游标的有效时间
+)
+
+// conn 一个客户端连接及其状态
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *respReader
+	writer  *respWriter
+	quit    bool // 客户端发送了QUIT，回复之后关闭连接
+}
+
+func newConn(s *Server, netConn net.Conn) *conn {
+	return &conn{
+		server:  s,
+		netConn: netConn,
+		reader:  newRespReader(netConn),
+		writer:  newRespWriter(netConn),
+	}
+}
+
+// commandFunc 执行命令，args[0]是命令名，返回值按RESP协议写回客户端
+type commandFunc func(c *conn, args [][]byte) interface{}
+
+type command struct {
+	fn    commandFunc
+	arity int // 参数个数（包含命令名），负数表示至少需要-arity个参数
+}
+
+var commands = map[string]*command{
+	"ping":      {ping, -1},
+	"quit":      {quit, 1},
+	"select":    {selectDB, 2},
+	"command":   {commandInfo, -1},
+	"get":       {get, 2},
+	"set":       {set, -3},
+	"del":       {del, -2},
+	"exists":    {exists, -2},
+	"type":      {typeOf, 2},
+	"keys":      {keys, 2},
+	"scan":      {scan, -2},
+	"expire":    {expire, 3},
+	"ttl":       {ttl, 2},
+	"hset":      {hset, -4},
+	"hget":      {hget, 3},
+	"hdel":      {hdel, -3},
+	"sadd":      {sadd, -3},
+	"sismember": {sismember, 3},
+	"srem":      {srem, -3},
+	"lpush":     {lpush, -3},
+	"rpush":     {rpush, -3},
+	"lpop":      {lpop, 2},
+	"rpop":      {rpop, 2},
+	"zadd":      {zadd, -4},
+	"zscore":    {zscore, 3},
+	"zrange":    {zrange, -4},
+}
+
+// 执行一条命令
+func (c *conn) execute(args [][]byte) interface{} {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		return errorReply("ERR unknown command '" + string(args[0]) + "'")
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		return errorReply("ERR wrong number of arguments for '" + name + "' command")
+	}
+	return cmd.fn(c, args)
+}
+
+// 将DB返回的错误转换为错误回复
+func dbError(err error) errorReply {
+	if err == ErrWrongType {
+		return errorReply(err.Error())
+	}
+	return errorReply("ERR " + err.Error())
+}
+
+var (
+	okReply     = simpleString("OK")
+	syntaxError = errorReply("ERR syntax error")
+	notInteger  = errorReply("ERR value is not an integer or out of range")
+	notFloat    = errorReply("ERR value is not a valid float")
+)
+
+func ping(c *conn, args [][]byte) interface{} {
+	switch len(args) {
+	case 1:
+		return simpleString("PONG")
+	case 2:
+		return args[1]
+	default:
+		return errorReply("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func quit(c *conn, args [][]byte) interface{} {
+	c.quit = true
+	return okReply
+}
+
+// 只有一个数据库，只支持SELECT 0
+func selectDB(c *conn, args [][]byte) interface{} {
+	if string(args[1]) != "0" {
+		return errorReply("ERR DB index is out of range")
+	}
+	return okReply
+}
+
+// redis-cli连接时会查询命令的文档，返回空的结果
+func commandInfo(c *conn, args [][]byte) interface{} {
+	return []interface{}{}
+}
+
+func get(c *conn, args [][]byte) interface{} {
+	value, err := c.server.ds.Get(args[1])
+	if err == bitcask.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return value
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func set(c *conn, args [][]byte) interface{} {
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		unit := time.Second
+		switch strings.ToLower(string(args[i])) {
+		case "ex":
+		case "px":
+			unit = time.Millisecond
+		default:
+			return syntaxError
+		}
+		if ttl != 0 || i+1 >= len(args) {
+			return syntaxError
+		}
+		n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return notInteger
+		}
+		if n <= 0 {
+			return errorReply("ERR invalid expire time in 'set' command")
+		}
+		ttl = time.Duration(n) * unit
+		i++
+	}
+
+	if err := c.server.ds.Set(args[1], args[2], ttl); err != nil {
+		return dbError(err)
+	}
+	return okReply
+}
+
+// DEL key [key ...]，返回被删除的key的数量
+func del(c *conn, args [][]byte) interface{} {
+	return intReply(c.server.ds.Del(args[1:]...))
+}
+
+// EXISTS key [key ...]，返回存在的key的数量，重复的key会被重复计算
+func exists(c *conn, args [][]byte) interface{} {
+	return intReply(c.server.ds.Exists(args[1:]...))
+}
+
+func typeOf(c *conn, args [][]byte) interface{} {
+	name, err := c.server.ds.Type(args[1])
+	if err != nil {
+		return dbError(err)
+	}
+	return simpleString(name)
+}
+
+// KEYS pattern
+func keys(c *conn, args [][]byte) interface{} {
+	pattern := args[1]
+	iterator := c.keyIterator(pattern, nil)
+	defer iterator.Close()
+
+	result := []interface{}{}
+	for ; iterator.Valid(); iterator.Next() {
+		if matchPattern(pattern, iterator.Key()) {
+			result = append(result, iterator.Key())
+		}
+	}
+	return result
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+func scan(c *conn, args [][]byte) interface{} {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return errorReply("ERR invalid cursor")
+	}
+	var pattern []byte
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return syntaxError
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil {
+				return notInteger
+			}
+			if count < 1 {
+				return syntaxError
+			}
+		default:
+			return syntaxError
+		}
+	}
+
+	// 游标0表示从头开始遍历
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = c.server.cursors.get(cursor); !ok {
+			return errorReply("ERR invalid cursor")
+		}
+	}
+
+	iterator := c.keyIterator(pattern, start)
+	defer iterator.Close()
+	result := []interface{}{}
+	for i := 0; i < count && iterator.Valid(); i++ {
+		if pattern == nil || matchPattern(pattern, iterator.Key()) {
+			result = append(result, iterator.Key())
+		}
+		iterator.Next()
+	}
+
+	// 还有没有遍历的key，保存下一次开始的位置
+	nextCursor := "0"
+	if iterator.Valid() {
+		nextKey := make([]byte, len(iterator.Key()))
+		copy(nextKey, iterator.Key())
+		nextCursor = strconv.FormatUint(c.server.cursors.put(nextKey), 10)
+	}
+	return []interface{}{nextCursor, result}
+}
+
+// scanCursors SCAN的游标，游标id -> 下一次开始遍历的key
+// key是有序的，保存下一个key而不是遍历的数量，遍历期间删除其他key不会导致遗漏
+// 客户端使用连接池时同一次遍历的命令可能由不同的连接发送，游标由所有连接共享
+// 游标使用之后仍然保留，客户端重试时可以再次使用，直到过期或者数量超过上限被丢弃
+type scanCursors struct {
+	mu      *sync.Mutex
+	cursors map[uint64]*scanCursor
+	first   uint64 // 最早的还没有被丢弃的游标id
+	next    uint64 // 下一个分配的游标id
+}
+
+type scanCursor struct {
+	key      []byte
+	expireAt time.Time
+}
+
+func newScanCursors() *scanCursors {
+	return &scanCursors{
+		mu:      new(sync.Mutex),
+		cursors: make(map[uint64]*scanCursor),
+		first:   1,
+		next:    1,
+	}
+}
+
+// 保存下一次开始遍历的key，返回新的游标id，同时丢弃过期和超过数量上限的游标
+func (sc *scanCursors) put(key []byte) uint64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	// 所有游标的有效时间相同，id越小越早过期
+	now := time.Now()
+	for sc.first < sc.next {
+		cursor := sc.cursors[sc.first]
+		if len(sc.cursors) < maxScanCursors && now.Before(cursor.expireAt) {
+			break
+		}
+		delete(sc.cursors, sc.first)
+		sc.first++
+	}
+
+	id := sc.next
+	sc.next++
+	sc.cursors[id] = &scanCursor{key: key, expireAt: now.Add(scanCursorTTL)}
+	return id
+}
+
+// 获取游标对应的key，游标不存在或者已经过期时返回false
+func (sc *scanCursors) get(id uint64) ([]byte, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	cursor, ok := sc.cursors[id]
+	if !ok || !time.Now().Before(cursor.expireAt) {
+		return nil, false
+	}
+	return cursor.key, true
+}
+
+// EXPIRE key seconds，key存在时返回1，否则返回0，过期时间不是正数时直接删除key
+func expire(c *conn, args [][]byte) interface{} {
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return notInteger
+	}
+	ok, err := c.server.ds.Expire(args[1], time.Duration(seconds)*time.Second)
+	if err != nil {
+		return dbError(err)
+	}
+	if ok {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+// TTL key，key不存在时返回-2，没有设置过期时间时返回-1
+func ttl(c *conn, args [][]byte) interface{} {
+	remain, err := c.server.ds.TTL(args[1])
+	if err == bitcask.ErrKeyNotFound {
+		return int64(-2)
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	if remain == bitcask.NoExpiration {
+		return int64(-1)
+	}
+	return int64((remain + time.Second/2) / time.Second)
+}
+
+// HSET key field value [field value ...]，返回新增的字段数量
+func hset(c *conn, args [][]byte) interface{} {
+	if len(args)%2 != 0 {
+		return errorReply("ERR wrong number of arguments for 'hset' command")
+	}
+	fields := make([]HashField, 0, len(args)/2-1)
+	for i := 2; i < len(args); i += 2 {
+		fields = append(fields, HashField{Field: args[i], Value: args[i+1]})
+	}
+	return intReply(c.server.ds.HSet(args[1], fields...))
+}
+
+func hget(c *conn, args [][]byte) interface{} {
+	value, err := c.server.ds.HGet(args[1], args[2])
+	if err == bitcask.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return value
+}
+
+func hdel(c *conn, args [][]byte) interface{} {
+	return intReply(c.server.ds.HDel(args[1], args[2:]...))
+}
+
+func sadd(c *conn, args [][]byte) interface{} {
+	return intReply(c.server.ds.SAdd(args[1], args[2:]...))
+}
+
+func sismember(c *conn, args [][]byte) interface{} {
+	ok, err := c.server.ds.SIsMember(args[1], args[2])
+	if err != nil {
+		return dbError(err)
+	}
+	if ok {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func srem(c *conn, args [][]byte) interface{} {
+	return intReply(c.server.ds.SRem(args[1], args[2:]...))
+}
+
+func lpush(c *conn, args [][]byte) interface{} {
+	return intReply(c.server.ds.LPush(args[1], args[2:]...))
+}
+
+func rpush(c *conn, args [][]byte) interface{} {
+	return intReply(c.server.ds.RPush(args[1], args[2:]...))
+}
+
+func lpop(c *conn, args [][]byte) interface{} {
+	return popReply(c.server.ds.LPop(args[1]))
+}
+
+func rpop(c *conn, args [][]byte) interface{} {
+	return popReply(c.server.ds.RPop(args[1]))
+}
+
+func popReply(element []byte, err error) interface{} {
+	if err == bitcask.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return element
+}
+
+// ZADD key score member [score member ...]，返回新增的成员数量
+func zadd(c *conn, args [][]byte) interface{} {
+	if len(args)%2 != 0 {
+		return syntaxError
+	}
+	members := make([]ZMember, 0, len(args)/2-1)
+	for i := 2; i < len(args); i += 2 {
+		score, ok := parseScore(args[i])
+		if !ok {
+			return notFloat
+		}
+		members = append(members, ZMember{Score: score, Member: args[i+1]})
+	}
+	return intReply(c.server.ds.ZAdd(args[1], members...))
+}
+
+func zscore(c *conn, args [][]byte) interface{} {
+	score, err := c.server.ds.ZScore(args[1], args[2])
+	if err == bitcask.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return formatScore(score)
+}
+
+// ZRANGE key start stop [WITHSCORES]
+func zrange(c *conn, args [][]byte) interface{} {
+	start, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return notInteger
+	}
+	stop, err := strconv.Atoi(string(args[3]))
+	if err != nil {
+		return notInteger
+	}
+	var withScores bool
+	switch {
+	case len(args) == 5 && strings.ToLower(string(args[4])) == "withscores":
+		withScores = true
+	case len(args) > 4:
+		return syntaxError
+	}
+
+	members, err := c.server.ds.ZRange(args[1], start, stop)
+	if err != nil {
+		return dbError(err)
+	}
+	result := []interface{}{}
+	for _, member := range members {
+		result = append(result, member.Member)
+		if withScores {
+			result = append(result, formatScore(member.Score))
+		}
+	}
+	return result
+}
+
+// 按redis的格式解析score，支持inf、+inf和-inf
+func parseScore(buf []byte) (float64, bool) {
+	score, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+// 按redis的格式返回score，无穷大返回inf和-inf
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// 返回整数结果的命令
+func intReply(n int, err error) interface{} {
+	if err != nil {
+		return dbError(err)
+	}
+	return int64(n)
+}
+
+// 从start开始遍历可能匹配pattern的key
+func (c *conn) keyIterator(pattern []byte, start []byte) *keyIterator {
+	return newKeyIterator(c.server.db, patternPrefix(pattern), start)
+}
+
+// keyIterator 按顺序遍历用户的key，string保存在用户的key中，数据结构的key从元数据的key中得到，两者合并之后遍历
+// 在同一个快照中遍历，同一个key不会同时以两种类型出现
+type keyIterator struct {
+	snap    *bitcask.Snapshot
+	strings *bitcask.Iterator // 遍历string，跳过所有保留的key
+	metas   *bitcask.Iterator // 遍历数据结构的元数据
+}
+
+func newKeyIterator(db *bitcask.DB, prefix []byte, start []byte) *keyIterator {
+	snap := db.Snapshot()
+	it := &keyIterator{
+		snap:    snap,
+		strings: snap.NewIterator(bitcask.IteratorOptions{Prefix: prefix, Start: []byte{reservedKeyPrefix + 1}}),
+		metas:   snap.NewIterator(bitcask.IteratorOptions{Prefix: metaKey(prefix)}),
+	}
+	if start != nil {
+		it.strings.Seek(start)
+		it.metas.Seek(metaKey(start))
+	}
+	return it
+}
+
+func (it *keyIterator) Valid() bool {
+	return it.strings.Valid() || it.metas.Valid()
+}
+
+// Key 当前的key，两个迭代器中较小的一个
+func (it *keyIterator) Key() []byte {
+	if it.useMeta() {
+		return it.metas.Key()[2:]
+	}
+	return it.strings.Key()
+}
+
+func (it *keyIterator) Next() {
+	if it.useMeta() {
+		it.metas.Next()
+	} else {
+		it.strings.Next()
+	}
+}
+
+func (it *keyIterator) useMeta() bool {
+	if !it.metas.Valid() {
+		return false
+	}
+	return !it.strings.Valid() || bytes.Compare(it.metas.Key()[2:], it.strings.Key()) < 0
+}
+
+func (it *keyIterator) Close() {
+	it.strings.Close()
+	it.metas.Close()
+	it.snap.Release()
+}
+
+// 匹配模式中第一个通配符之前的部分，遍历时只需要查找以此为前缀的key
+func patternPrefix(pattern []byte) []byte {
+	i := bytes.IndexAny(pattern, "*?[\\")
+	if i < 0 {
+		return pattern
+	}
+	return pattern[:i]
+}
+
+// 按redis的规则匹配key，支持*、?、[abc]、[^abc]、[a-z]以及\转义
+func matchPattern(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// 连续的*等价于一个
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchPattern(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			var matched bool
+			if matched, pattern = matchClass(pattern[1:], key[0]); !matched {
+				return false
+			}
+			key = key[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// 匹配[]中的字符集合，pattern从[之后开始，返回是否匹配以及]之后剩余的模式
+func matchClass(pattern []byte, ch byte) (bool, []byte) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	var matched bool
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == ch
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (ch >= lo && ch <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == ch
+			pattern = pattern[1:]
+		}
+	}
+	// 跳过]
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != not, pattern
+}
@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		matched bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h**o", "ho", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"[\\]]", "]", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"abc", "abcd", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.matched, matchPattern([]byte(tt.pattern), []byte(tt.key)), tt.pattern+" "+tt.key)
+	}
+}
+
+func TestPatternPrefix(t *testing.T) {
+	assert.Equal(t, []byte("user:"), patternPrefix([]byte("user:*")))
+	assert.Equal(t, []byte("h"), patternPrefix([]byte("h?llo")))
+	assert.Equal(t, []byte("key"), patternPrefix([]byte("key")))
+	assert.Equal(t, []byte(""), patternPrefix([]byte("[ab]*")))
+	assert.Nil(t, patternPrefix(nil))
+}
+
+func TestScanCursors(t *testing.T) {
+	sc := newScanCursors()
+	id := sc.put([]byte("key"))
+	key, ok := sc.get(id)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("key"), key)
+	// 游标使用之后仍然可以再次使用
+	_, ok = sc.get(id)
+	assert.True(t, ok)
+	_, ok = sc.get(id + 1)
+	assert.False(t, ok)
+
+	// 超过数量上限时丢弃最早的游标
+	for i := 0; i < maxScanCursors; i++ {
+		sc.put([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	assert.Equal(t, maxScanCursors, len(sc.cursors))
+	_, ok = sc.get(id)
+	assert.False(t, ok)
+	_, ok = sc.get(id + 1)
+	assert.True(t, ok)
+
+	// 过期的游标不能使用，并在之后保存游标时被丢弃
+	last := sc.next - 1
+	sc.cursors[last].expireAt = time.Now()
+	_, ok = sc.get(last)
+	assert.False(t, ok)
+	for cid := sc.first; cid < sc.next; cid++ {
+		sc.cursors[cid].expireAt = time.Now()
+	}
+	sc.put([]byte("key"))
+	assert.Equal(t, 1, len(sc.cursors))
+}
@@ -0,0 +1,175 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// RESP2 协议中的数据类型前缀
+const (
+	respSimpleString = '+'
+	respError        = '-'
+	respInteger      = ':'
+	respBulkString   = '$'
+	respArray        = '*'
+)
+
+const (
+	maxBulkLen   = 512 * 1024 * 1024 // 单个参数的最大长度，和redis一致
+	maxArrayLen  = 1024 * 1024       // 一条命令中最多的参数个数
+	maxInlineLen = 64 * 1024         // inline命令一行的最大长度
+)
+
+// ErrProtocol 客户端发送的数据不符合RESP协议，之后无法再解析出完整的命令，需要关闭连接
+var ErrProtocol = errors.New("protocol error")
+
+// respReader 从连接中读取客户端发送的命令
+// 命令是由bulk string组成的数组，也支持telnet等工具发送的以空格分隔的inline命令
+type respReader struct {
+	rd *bufio.Reader
+}
+
+func newRespReader(rd io.Reader) *respReader {
+	return &respReader{rd: bufio.NewReader(rd)}
+}
+
+// 读取一条命令，返回命令名和参数，空行返回空的命令
+func (r *respReader) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != respArray {
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArrayLen {
+		return nil, ErrProtocol
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		if args[i], err = r.readBulkString(); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (r *respReader) readBulkString() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != respBulkString {
+		return nil, ErrProtocol
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxBulkLen {
+		return nil, ErrProtocol
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		return nil, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, ErrProtocol
+	}
+	return buf[:n], nil
+}
+
+// 读取以\r\n结尾的一行，兼容只以\n结尾的inline命令
+func (r *respReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.rd.ReadSlice('\n')
+		if err == nil || err == bufio.ErrBufferFull {
+			line = append(line, chunk...)
+			if len(line) > maxInlineLen {
+				return nil, ErrProtocol
+			}
+			if err == nil {
+				break
+			}
+			continue
+		}
+		if err == io.EOF && len(line)+len(chunk) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// 还没有处理的数据是否已经全部读取，客户端使用管道时可以在处理完一批命令之后再一起返回
+func (r *respReader) buffered() int {
+	return r.rd.Buffered()
+}
+
+// simpleString 以简单字符串返回的回复，例如OK
+type simpleString string
+
+// errorReply 错误回复
+type errorReply string
+
+// respWriter 将命令的执行结果按RESP协议写回客户端
+type respWriter struct {
+	wr *bufio.Writer
+}
+
+func newRespWriter(wr io.Writer) *respWriter {
+	return &respWriter{wr: bufio.NewWriter(wr)}
+}
+
+// 写入一个回复，支持的类型：nil（空的bulk string）、simpleString、errorReply、int64、int、[]byte、string和[]interface{}
+func (w *respWriter) writeReply(reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.wr.WriteString("$-1\r\n")
+	case simpleString:
+		w.writeLine(respSimpleString, string(v))
+	case errorReply:
+		w.writeLine(respError, string(v))
+	case int64:
+		w.writeLine(respInteger, strconv.FormatInt(v, 10))
+	case int:
+		w.writeLine(respInteger, strconv.Itoa(v))
+	case []byte:
+		w.writeBulkString(v)
+	case string:
+		w.writeBulkString([]byte(v))
+	case []interface{}:
+		w.writeLine(respArray, strconv.Itoa(len(v)))
+		for _, item := range v {
+			w.writeReply(item)
+		}
+	default:
+		panic("redis: unsupported reply type")
+	}
+}
+
+func (w *respWriter) writeLine(prefix byte, line string) {
+	w.wr.WriteByte(prefix)
+	w.wr.WriteString(line)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *respWriter) writeBulkString(buf []byte) {
+	w.writeLine(respBulkString, strconv.Itoa(len(buf)))
+	w.wr.Write(buf)
+	w.wr.WriteString("\r\n")
+}
+
+func (w *respWriter) flush() error {
+	return w.wr.Flush()
+}
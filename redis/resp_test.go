@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRespReader_ReadCommand(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$5\r\nk\r\ney\r\n" +
+		"*3\r\n$3\r\nSET\r\n$0\r\n\r\n$1\r\nv\r\n" +
+		"PING  hello\r\n" +
+		"\r\n" +
+		"ping\n"
+	r := newRespReader(strings.NewReader(input))
+
+	args, err := r.readCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("GET"), []byte("k\r\ney")}, args)
+
+	args, err = r.readCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("SET"), {}, []byte("v")}, args)
+
+	// inline 命令
+	args, err = r.readCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("PING"), []byte("hello")}, args)
+
+	args, err = r.readCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(args))
+
+	args, err = r.readCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("ping")}, args)
+
+	_, err = r.readCommand()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRespReader_ProtocolError(t *testing.T) {
+	inputs := []string{
+		"*x\r\n",
+		"*1\r\n:1\r\n",
+		"*1\r\n$-2\r\n",
+		"*1\r\n$3\r\nGETX\r\n",
+		strings.Repeat("a", maxInlineLen+1) + "\r\n",
+	}
+	for _, input := range inputs {
+		_, err := newRespReader(strings.NewReader(input)).readCommand()
+		assert.Equal(t, ErrProtocol, err, input)
+	}
+
+	// 命令不完整
+	_, err := newRespReader(strings.NewReader("*2\r\n$3\r\nGET\r\n")).readCommand()
+	assert.Equal(t, io.EOF, err)
+	_, err = newRespReader(strings.NewReader("*1\r\n$3\r\nGE")).readCommand()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestRespWriter_WriteReply(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newRespWriter(buf)
+	w.writeReply(simpleString("OK"))
+	w.writeReply(errorReply("ERR bad"))
+	w.writeReply(int64(-2))
+	w.writeReply(3)
+	w.writeReply(nil)
+	w.writeReply([]byte("bitcask"))
+	w.writeReply([]interface{}{"0", []interface{}{[]byte("a"), []byte("")}})
+	assert.Equal(t, 0, buf.Len())
+	assert.Nil(t, w.flush())
+
+	expected := "+OK\r\n-ERR bad\r\n:-2\r\n:3\r\n$-1\r\n$7\r\nbitcask\r\n" +
+		"*2\r\n$1\r\n0\r\n*2\r\n$1\r\na\r\n$0\r\n\r\n"
+	assert.Equal(t, expected, buf.String())
+}
@@ -0,0 +1,181 @@
+package redis
+
+import (
+	"errors"
+	"io"
+	bitcask "kv-bitcask"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed 服务已经关闭
+var ErrServerClosed = errors.New("redis: server closed")
+
+// 后台清理数据结构残留的子key的间隔
+const sweepInterval = 10 * time.Minute
+
+// Server 兼容redis RESP2协议的服务，将redis命令转换为对DB的操作
+// 每个连接由一个goroutine处理，支持客户端使用管道批量发送命令
+// 服务运行期间在后台定期清理被删除或者过期的数据结构残留的子key
+type Server struct {
+	db       *bitcask.DB
+	ds       *DataStructure
+	cursors  *scanCursors // 所有连接共享的SCAN游标
+	mu       *sync.Mutex
+	listener net.Listener
+	conns    map[*conn]struct{}
+	wg       *sync.WaitGroup // 等待所有连接处理和后台清理结束
+	closeCh  chan struct{}
+	closed   bool
+}
+
+// NewServer 基于已经打开的DB创建服务，关闭服务时不会关闭DB
+func NewServer(db *bitcask.DB) *Server {
+	return &Server{
+		db:      db,
+		ds:      NewDataStructure(db),
+		cursors: newScanCursors(),
+		mu:      new(sync.Mutex),
+		conns:   make(map[*conn]struct{}),
+		wg:      new(sync.WaitGroup),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// ListenAndServe 监听TCP地址并处理连接，直到服务被关闭
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve 在listener上接收连接并处理，直到服务被关闭，关闭之后返回ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	if s.listener == nil {
+		s.wg.Add(1)
+		go s.sweepPeriodically()
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		c := newConn(s, netConn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = netConn.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handleConn(c)
+	}
+}
+
+// Addr 服务监听的地址，还没有开始监听时返回nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close 停止接收新的连接，关闭所有连接并等待正在执行的命令结束
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closeCh)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for c := range s.conns {
+		_ = c.netConn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// 定期清理子key，直到服务关闭
+func (s *Server) sweepPeriodically() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.ds.Sweep(); err != nil {
+			log.Printf("redis: sweep failed: %v", err)
+		}
+	}
+}
+
+// 循环读取并执行命令，客户端已经发送的命令全部执行完之后再将结果一起写回
+func (s *Server) handleConn(c *conn) {
+	defer func() {
+		_ = c.netConn.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	for {
+		args, err := c.reader.readCommand()
+		if err != nil {
+			if err == ErrProtocol {
+				c.writer.writeReply(errorReply("ERR Protocol error"))
+				_ = c.writer.flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("redis: read from %s failed: %v", c.netConn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			c.writer.writeReply(c.execute(args))
+		}
+		if c.reader.buffered() == 0 || c.quit {
+			if err := c.writer.flush(); err != nil || c.quit {
+				return
+			}
+		}
+	}
+}
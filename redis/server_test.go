@@ -0,0 +1,292 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	bitcask "kv-bitcask"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 启动一个监听随机端口的服务，测试结束时关闭服务并删除数据
+func startServer(t *testing.T) (*Server, string) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis")
+	opts.DirPath = dir
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := NewServer(db)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		assert.Nil(t, server.Close())
+		assert.Equal(t, ErrServerClosed, <-done)
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return server, listener.Addr().String()
+}
+
+// testClient 按RESP协议发送命令并读取回复
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return &testClient{t: t, conn: conn, rd: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(args ...string) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.conn.Write([]byte(sb.String()))
+	assert.Nil(c.t, err)
+}
+
+// 读取一个回复，bulk string返回string，空的bulk string返回nil，数组返回[]interface{}
+func (c *testClient) read() interface{} {
+	line, err := c.rd.ReadString('\n')
+	assert.Nil(c.t, err)
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-':
+		return line
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		_, err := io.ReadFull(c.rd, buf)
+		assert.Nil(c.t, err)
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func (c *testClient) do(args ...string) interface{} {
+	c.send(args...)
+	return c.read()
+}
+
+func TestServer_Commands(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	assert.Equal(t, "+PONG", c.do("PING"))
+	assert.Equal(t, "hello", c.do("ping", "hello"))
+
+	assert.Equal(t, "+OK", c.do("SET", "name", "bitcask"))
+	assert.Equal(t, "bitcask", c.do("GET", "name"))
+	assert.Nil(t, c.do("GET", "missing"))
+	assert.Equal(t, int64(2), c.do("EXISTS", "name", "name", "missing"))
+
+	// 过期时间
+	assert.Equal(t, int64(-1), c.do("TTL", "name"))
+	assert.Equal(t, int64(-2), c.do("TTL", "missing"))
+	assert.Equal(t, "+OK", c.do("SET", "temp", "v", "EX", "100"))
+	assert.Equal(t, int64(100), c.do("TTL", "temp"))
+	assert.Equal(t, int64(1), c.do("EXPIRE", "name", "50"))
+	assert.Equal(t, int64(50), c.do("TTL", "name"))
+	assert.Equal(t, "bitcask", c.do("GET", "name"))
+	assert.Equal(t, int64(0), c.do("EXPIRE", "missing", "50"))
+	assert.Equal(t, "+OK", c.do("SET", "short", "v", "px", "50"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, c.do("GET", "short"))
+	assert.Equal(t, int64(1), c.do("EXPIRE", "temp", "0"))
+	assert.Equal(t, int64(0), c.do("EXISTS", "temp"))
+
+	assert.Equal(t, int64(1), c.do("DEL", "name", "missing"))
+	assert.Equal(t, int64(0), c.do("DEL", "name"))
+
+	// 错误
+	assert.Equal(t, "-ERR unknown command 'FOO'", c.do("FOO"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command", c.do("GET"))
+	assert.Equal(t, "-ERR syntax error", c.do("SET", "k", "v", "NX"))
+	assert.Equal(t, "-ERR syntax error", c.do("SET", "k", "v", "EX"))
+	assert.Equal(t, "-ERR invalid expire time in 'set' command", c.do("SET", "k", "v", "EX", "0"))
+	assert.Equal(t, "-ERR value is not an integer or out of range", c.do("EXPIRE", "k", "x"))
+	assert.Equal(t, "-ERR key is empty", c.do("SET", "", "v"))
+
+	assert.Equal(t, "+OK", c.do("QUIT"))
+	_, err := c.rd.ReadByte()
+	assert.NotNil(t, err)
+}
+
+func TestServer_KeysAndScan(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	for i := 0; i < 25; i++ {
+		assert.Equal(t, "+OK", c.do("SET", fmt.Sprintf("user:%02d", i), "v"))
+	}
+	assert.Equal(t, "+OK", c.do("SET", "order:1", "v"))
+
+	assert.Equal(t, 25, len(c.do("KEYS", "user:*").([]interface{})))
+	assert.Equal(t, []interface{}{"user:10", "user:11"}, c.do("KEYS", "user:1[01]"))
+	assert.Equal(t, []interface{}{"order:1"}, c.do("KEYS", "*:1"))
+
+	// 遍历期间删除的key不会导致遗漏其他key，游标可以在其他连接上继续使用
+	c2 := dial(t, addr)
+	var keys []interface{}
+	cursor := "0"
+	for i := 0; ; i++ {
+		client := c
+		if i%2 == 1 {
+			client = c2
+		}
+		reply := client.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "7").([]interface{})
+		cursor = reply[0].(string)
+		keys = append(keys, reply[1].([]interface{})...)
+		if len(keys) == 7 {
+			assert.Equal(t, int64(1), c.do("DEL", "user:20"))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 24, len(keys))
+	assert.Equal(t, "-ERR invalid cursor", c.do("SCAN", "12345"))
+	assert.Equal(t, "-ERR syntax error", c.do("SCAN", "0", "COUNT", "0"))
+}
+
+func TestServer_DataStructures(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	assert.Equal(t, int64(2), c.do("HSET", "user", "name", "tom", "age", "18"))
+	assert.Equal(t, "tom", c.do("HGET", "user", "name"))
+	assert.Nil(t, c.do("HGET", "user", "email"))
+	assert.Equal(t, int64(1), c.do("HDEL", "user", "age", "email"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'hset' command", c.do("HSET", "user", "name"))
+
+	assert.Equal(t, int64(2), c.do("SADD", "tags", "a", "b"))
+	assert.Equal(t, int64(1), c.do("SISMEMBER", "tags", "a"))
+	assert.Equal(t, int64(1), c.do("SREM", "tags", "a"))
+	assert.Equal(t, int64(0), c.do("SISMEMBER", "tags", "a"))
+
+	assert.Equal(t, int64(2), c.do("LPUSH", "queue", "b", "a"))
+	assert.Equal(t, int64(3), c.do("RPUSH", "queue", "c"))
+	assert.Equal(t, "a", c.do("LPOP", "queue"))
+	assert.Equal(t, "c", c.do("RPOP", "queue"))
+	assert.Equal(t, "b", c.do("RPOP", "queue"))
+	assert.Nil(t, c.do("LPOP", "queue"))
+
+	assert.Equal(t, int64(3), c.do("ZADD", "rank", "2.5", "b", "1", "a", "+inf", "c"))
+	assert.Equal(t, "2.5", c.do("ZSCORE", "rank", "b"))
+	assert.Equal(t, "inf", c.do("ZSCORE", "rank", "c"))
+	assert.Nil(t, c.do("ZSCORE", "rank", "d"))
+	assert.Equal(t, []interface{}{"a", "b", "c"}, c.do("ZRANGE", "rank", "0", "-1"))
+	assert.Equal(t, []interface{}{"b", "2.5"}, c.do("ZRANGE", "rank", "1", "1", "WITHSCORES"))
+	assert.Equal(t, "-ERR value is not a valid float", c.do("ZADD", "rank", "nan", "x"))
+
+	assert.Equal(t, "+hash", c.do("TYPE", "user"))
+	assert.Equal(t, "+zset", c.do("TYPE", "rank"))
+	assert.Equal(t, "+none", c.do("TYPE", "queue"))
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value", c.do("GET", "user"))
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value", c.do("LPUSH", "tags", "x"))
+
+	// 元数据和子key不会出现在KEYS和SCAN的结果中，string和数据结构的key按顺序合并
+	assert.Equal(t, "+OK", c.do("SET", "s1", "v"))
+	assert.Equal(t, "+OK", c.do("SET", "z1", "v"))
+	assert.Equal(t, []interface{}{"rank", "s1", "tags", "user", "z1"}, c.do("KEYS", "*"))
+	assert.Equal(t, []interface{}{"0", []interface{}{"rank", "s1", "tags", "user", "z1"}}, c.do("SCAN", "0"))
+	scanned := c.do("SCAN", "0", "COUNT", "3").([]interface{})
+	assert.Equal(t, []interface{}{"rank", "s1", "tags"}, scanned[1])
+	assert.Equal(t, []interface{}{"0", []interface{}{"user", "z1"}}, c.do("SCAN", scanned[0].(string)))
+	assert.Equal(t, []interface{}{"tags"}, c.do("KEYS", "t*"))
+	assert.Equal(t, []interface{}{}, c.do("KEYS", "\x00*"))
+	assert.Equal(t, "-ERR key is reserved for internal use", c.do("GET", "\x00"))
+
+	assert.Equal(t, int64(1), c.do("DEL", "user"))
+	assert.Nil(t, c.do("HGET", "user", "name"))
+}
+
+// 客户端一次发送多个命令，按顺序返回所有结果
+func TestServer_Pipeline(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "*3\r\n$3\r\nSET\r\n$%d\r\nkey-%d\r\n$1\r\nv\r\n", len(fmt.Sprintf("key-%d", i)), i)
+	}
+	sb.WriteString("PING\r\n")
+	_, err := c.conn.Write([]byte(sb.String()))
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, "+OK", c.read())
+	}
+	assert.Equal(t, "+PONG", c.read())
+	assert.Equal(t, 1000, len(c.do("KEYS", "key-*").([]interface{})))
+
+	// 协议错误时返回错误并关闭连接
+	_, err = c.conn.Write([]byte("*1\r\n:1\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Protocol error", c.read())
+	_, err = c.rd.ReadByte()
+	assert.NotNil(t, err)
+}
+
+func TestServer_ConcurrentClients(t *testing.T) {
+	s, addr := startServer(t)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := dial(t, addr)
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("client-%d-%d", i, j)
+				assert.Equal(t, "+OK", c.do("SET", key, key))
+				assert.Equal(t, key, c.do("GET", key))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c := dial(t, addr)
+	assert.Equal(t, 2000, len(c.do("KEYS", "client-*").([]interface{})))
+
+	// 关闭服务时断开所有连接
+	assert.Nil(t, s.Close())
+	_, err := c.rd.ReadByte()
+	assert.NotNil(t, err)
+	assert.Equal(t, addr, s.Addr().String())
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+}
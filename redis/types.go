@@ -0,0 +1,818 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	bitcask "kv-bitcask"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrWrongType key中保存的数据类型和命令不匹配
+	ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	// ErrReservedKey 以reservedKeyPrefix开头的key用于保存数据结构的元数据和元素，不能直接读写
+	ErrReservedKey = errors.New("key is reserved for internal use")
+	// ErrInvalidScore zset的score不能是NaN
+	ErrInvalidScore = errors.New("score is not a valid float")
+)
+
+// 数据结构的类型，保存在元数据的第一个字节
+const (
+	typeHash byte = iota + 1
+	typeSet
+	typeList
+	typeZSet
+)
+
+var typeNames = map[byte]string{
+	typeHash: "hash",
+	typeSet:  "set",
+	typeList: "list",
+	typeZSet: "zset",
+}
+
+const (
+	// 保留的key的前缀，排在所有用户的key之前，遍历用户的key时直接跳过
+	// string直接保存在用户的key中，数据结构的元数据和元素保存在保留的key中
+	reservedKeyPrefix byte = 0
+	metaKeySpace      byte = 'm' // 元数据的key：reservedKeyPrefix + metaKeySpace + key
+	subKeySpace       byte = 's' // 元素的key（子key）：reservedKeyPrefix + subKeySpace + ...
+
+	// Sweep一个批次中删除的子key数量
+	sweepBatchSize = 1000
+
+	// list新建时头尾的下标，从中间开始两端都可以push
+	listInitialIndex uint64 = math.MaxUint64 / 2
+
+	// zset的两种子key：member -> score，以及按score排序的score+member
+	zsetMemberPart byte = 'm'
+	zsetScorePart  byte = 's'
+)
+
+// HashField hash中的一个字段
+type HashField struct {
+	Field []byte
+	Value []byte
+}
+
+// ZMember zset中的一个成员
+type ZMember struct {
+	Score  float64
+	Member []byte
+}
+
+// metadata 数据结构的元数据，保存在metaKey中
+// 数据结构的元素保存在带有version的子key中，删除整个数据结构时只需要删除元数据，之后同名的数据结构使用新的version，旧的子key不会再被读取
+// 不再属于任何数据结构的子key由Sweep清理
+type metadata struct {
+	dataType byte
+	version  uint64
+	size     uint64 // 元素的数量
+	head     uint64 // list第一个元素的下标
+	tail     uint64 // list最后一个元素之后的下标
+}
+
+func (meta *metadata) encode() []byte {
+	buf := make([]byte, 1+4*binary.MaxVarintLen64)
+	buf[0] = meta.dataType
+	index := 1
+	index += binary.PutUvarint(buf[index:], meta.version)
+	index += binary.PutUvarint(buf[index:], meta.size)
+	if meta.dataType == typeList {
+		index += binary.PutUvarint(buf[index:], meta.head)
+		index += binary.PutUvarint(buf[index:], meta.tail)
+	}
+	return buf[:index]
+}
+
+func decodeMetadata(buf []byte) *metadata {
+	meta := &metadata{dataType: buf[0]}
+	index := 1
+	var n int
+	meta.version, n = binary.Uvarint(buf[index:])
+	index += n
+	meta.size, n = binary.Uvarint(buf[index:])
+	index += n
+	if meta.dataType == typeList {
+		meta.head, n = binary.Uvarint(buf[index:])
+		index += n
+		meta.tail, _ = binary.Uvarint(buf[index:])
+	}
+	return meta
+}
+
+// 保存key的元数据的key
+func metaKey(key []byte) []byte {
+	buf := make([]byte, 2, 2+len(key))
+	buf[0], buf[1] = reservedKeyPrefix, metaKeySpace
+	return append(buf, key...)
+}
+
+// 子key的格式：reservedKeyPrefix + subKeySpace + key的长度 + key + version + parts
+// 带上key的长度，不同key的子key不会有相同的前缀
+func subKey(key []byte, version uint64, parts ...[]byte) []byte {
+	buf := make([]byte, 2+binary.MaxVarintLen64, 2+binary.MaxVarintLen64+len(key)+8)
+	buf[0], buf[1] = reservedKeyPrefix, subKeySpace
+	n := binary.PutUvarint(buf[2:], uint64(len(key)))
+	buf = append(buf[:2+n], key...)
+	buf = binary.BigEndian.AppendUint64(buf, version)
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+// 从子key中解析出所属的key和version，不是合法的子key时返回false
+func parseSubKey(buf []byte) ([]byte, uint64, bool) {
+	if len(buf) < 2 || buf[0] != reservedKeyPrefix || buf[1] != subKeySpace {
+		return nil, 0, false
+	}
+	keyLen, n := binary.Uvarint(buf[2:])
+	if n <= 0 || keyLen > uint64(len(buf)-2-n) || uint64(len(buf)-2-n)-keyLen < 8 {
+		return nil, 0, false
+	}
+	key := buf[2+n : 2+n+int(keyLen)]
+	return key, binary.BigEndian.Uint64(buf[2+n+int(keyLen):]), true
+}
+
+func listIndex(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, index)
+}
+
+// 将score编码为按字节比较时和数值大小顺序一致的8个字节
+func encodeScore(score float64) []byte {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return binary.BigEndian.AppendUint64(nil, bits)
+}
+
+func decodeScore(buf []byte) float64 {
+	bits := binary.BigEndian.Uint64(buf)
+	if bits&(1<<63) != 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+// getter 事务和快照都可以读取数据
+type getter interface {
+	Get(key []byte) ([]byte, error)
+}
+
+// DataStructure 基于DB实现的redis数据结构：string、hash、set、list和zset
+// string原样保存在用户的key中，和直接通过DB写入的数据一致；其他类型的元数据保存在metaKey中，元素保存在子key中
+// 同一个key只会有一种类型，string和元数据不会同时存在
+// 修改数据结构的操作在一个事务中完成，和其他写入冲突时自动重试
+// 删除、覆盖或者过期的数据结构，子key不会被立即清理，只是不能再被读取，之后由Sweep删除
+type DataStructure struct {
+	db          *bitcask.DB
+	lastVersion uint64 // 最近一次分配的version
+}
+
+// NewDataStructure 基于已经打开的DB创建数据结构
+func NewDataStructure(db *bitcask.DB) *DataStructure {
+	return &DataStructure{db: db}
+}
+
+// 分配新的数据结构的version，使用当前时间，保证单调递增
+func (ds *DataStructure) newVersion() uint64 {
+	for {
+		last := atomic.LoadUint64(&ds.lastVersion)
+		version := uint64(time.Now().UnixNano())
+		if version <= last {
+			version = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&ds.lastVersion, last, version) {
+			return version
+		}
+	}
+}
+
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrKeyIsEmpty
+	}
+	if key[0] == reservedKeyPrefix {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+// 在事务中执行fn，提交时和其他写入冲突则重试
+func (ds *DataStructure) update(fn func(txn *bitcask.Txn) error) error {
+	for {
+		txn := ds.db.Begin()
+		if err := fn(txn); err != nil {
+			txn.Rollback()
+			return err
+		}
+		if err := txn.Commit(); err != bitcask.ErrTxnConflict {
+			return err
+		}
+	}
+}
+
+// 读取key的元数据，key不存在时返回nil，类型不一致或者key是string时返回ErrWrongType
+func findMetadata(g getter, key []byte, dataType byte) (*metadata, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	meta, err := readMetadata(g, key)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		// 在事务中读取时，string的写入会和创建数据结构冲突
+		if _, err := g.Get(key); err != bitcask.ErrKeyNotFound {
+			if err == nil {
+				err = ErrWrongType
+			}
+			return nil, err
+		}
+		return nil, nil
+	}
+	if meta.dataType != dataType {
+		return nil, ErrWrongType
+	}
+	return meta, nil
+}
+
+// 读取key的元数据，不是数据结构时返回nil
+func readMetadata(g getter, key []byte) (*metadata, error) {
+	value, err := g.Get(metaKey(key))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetadata(value), nil
+}
+
+// 在事务中读取key的元数据，key不存在时创建新的元数据
+func (ds *DataStructure) getMetadata(txn *bitcask.Txn, key []byte, dataType byte) (*metadata, error) {
+	meta, err := findMetadata(txn, key, dataType)
+	if err != nil || meta != nil {
+		return meta, err
+	}
+	meta = &metadata{dataType: dataType, version: ds.newVersion()}
+	if dataType == typeList {
+		meta.head, meta.tail = listInitialIndex, listInitialIndex
+	}
+	return meta, nil
+}
+
+// 写入元数据，保留原来的过期时间，没有元素时删除整个数据结构
+func putMetadata(txn *bitcask.Txn, key []byte, meta *metadata) error {
+	if meta.size == 0 {
+		return txn.Delete(metaKey(key))
+	}
+	return txn.PutKeepTTL(metaKey(key), meta.encode())
+}
+
+// 在快照中读取，快照保证元数据和元素是同一时刻的数据，只用于需要一致视图的多个元素的读取
+// 读取单个元素时直接从DB中读取：元素的key包含元数据的版本，元数据被删除或者重建之后旧版本的元素不会再被修改，
+// 先读取元数据再读取元素，得到的结果是两次读取之间某一时刻的数据
+func (ds *DataStructure) view(fn func(snap *bitcask.Snapshot) error) error {
+	snap := ds.db.Snapshot()
+	defer snap.Release()
+	return fn(snap)
+}
+
+// =================== 通用命令 ===================
+
+// Type 获取key的数据类型，key不存在时返回none
+func (ds *DataStructure) Type(key []byte) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	meta, err := readMetadata(ds.db, key)
+	if err != nil {
+		return "", err
+	}
+	if meta != nil {
+		return typeNames[meta.dataType], nil
+	}
+	_, err = ds.db.Get(key)
+	switch err {
+	case nil:
+		return "string", nil
+	case bitcask.ErrKeyNotFound:
+		return "none", nil
+	}
+	return "", err
+}
+
+// Del 删除key，数据结构只需要删除元数据，返回被删除的key的数量
+func (ds *DataStructure) Del(keys ...[]byte) (int, error) {
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return 0, err
+		}
+	}
+	var count int
+	err := ds.update(func(txn *bitcask.Txn) error {
+		count = 0
+		for _, key := range keys {
+			deleted, err := deleteKey(txn, key)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// 在事务中删除key，string删除key本身，数据结构删除元数据，返回key是否存在
+func deleteKey(txn *bitcask.Txn, key []byte) (bool, error) {
+	for _, k := range [][]byte{metaKey(key), key} {
+		if _, err := txn.Get(k); err == bitcask.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		return true, txn.Delete(k)
+	}
+	return false, nil
+}
+
+// Exists 返回存在的key的数量，重复的key会被重复计算
+func (ds *DataStructure) Exists(keys ...[]byte) (int, error) {
+	var count int
+	for _, key := range keys {
+		if _, err := ds.TTL(key); err != nil {
+			if err == bitcask.ErrKeyNotFound {
+				continue
+			}
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Expire 设置key的过期时间，ttl不是正数时直接删除key，key不存在时返回false
+// 数据结构的过期时间设置在元数据上
+func (ds *DataStructure) Expire(key []byte, ttl time.Duration) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	var exist bool
+	err := ds.update(func(txn *bitcask.Txn) error {
+		exist = false
+		for _, k := range [][]byte{metaKey(key), key} {
+			value, err := txn.Get(k)
+			if err == bitcask.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			exist = true
+			if ttl <= 0 {
+				return txn.Delete(k)
+			}
+			return txn.PutWithTTL(k, value, ttl)
+		}
+		return nil
+	})
+	return exist, err
+}
+
+// TTL 获取key剩余的存活时间，没有设置过期时间时返回bitcask.NoExpiration
+func (ds *DataStructure) TTL(key []byte) (time.Duration, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	ttl, err := ds.db.TTL(metaKey(key))
+	if err == bitcask.ErrKeyNotFound {
+		return ds.db.TTL(key)
+	}
+	return ttl, err
+}
+
+// Sweep 删除所有不再属于任何数据结构的子key，即version和当前元数据不一致的子key，返回删除的数量
+// 包括被删除、覆盖为string以及过期的数据结构的元素，可以在读写的同时执行
+func (ds *DataStructure) Sweep() (int, error) {
+	iterator := ds.db.NewIterator(bitcask.IteratorOptions{Prefix: []byte{reservedKeyPrefix, subKeySpace}})
+	defer iterator.Close()
+
+	var swept int
+	var lastKey []byte
+	var lastVersion uint64
+	var live bool
+	wb := ds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
+	pending := 0
+	for ; iterator.Valid(); iterator.Next() {
+		key, version, ok := parseSubKey(iterator.Key())
+		if !ok {
+			continue
+		}
+		// 子key按key和version排序，同一个数据结构的子key只需要读取一次元数据
+		// 子key和元数据在同一个批次中写入，能遍历到的子key对应的元数据一定已经写入，元数据不存在说明已经被删除或者过期
+		if lastKey == nil || !bytes.Equal(key, lastKey) || version != lastVersion {
+			meta, err := readMetadata(ds.db, key)
+			if err != nil {
+				return swept, err
+			}
+			live = meta != nil && meta.version == version
+			lastKey, lastVersion = append(lastKey[:0], key...), version
+		}
+		if live {
+			continue
+		}
+
+		staleKey := make([]byte, len(iterator.Key()))
+		copy(staleKey, iterator.Key())
+		if err := wb.Delete(staleKey); err != nil {
+			return swept, err
+		}
+		pending++
+		if pending == sweepBatchSize {
+			if err := wb.Commit(); err != nil {
+				return swept, err
+			}
+			swept += pending
+			wb, pending = ds.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions), 0
+		}
+	}
+	if pending > 0 {
+		if err := wb.Commit(); err != nil {
+			return swept, err
+		}
+		swept += pending
+	}
+	return swept, nil
+}
+
+// =================== String ===================
+
+// Set 写入string，ttl为0表示不过期，key原来是数据结构时覆盖为string
+// string原样写入，和DB.Put写入的数据可以互相读取
+func (ds *DataStructure) Set(key []byte, value []byte, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return ds.update(func(txn *bitcask.Txn) error {
+		if _, err := txn.Get(metaKey(key)); err == nil {
+			if err := txn.Delete(metaKey(key)); err != nil {
+				return err
+			}
+		} else if err != bitcask.ErrKeyNotFound {
+			return err
+		}
+		if ttl > 0 {
+			return txn.PutWithTTL(key, value, ttl)
+		}
+		return txn.Put(key, value)
+	})
+}
+
+// Get 读取string，key是数据结构时返回ErrWrongType
+func (ds *DataStructure) Get(key []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	meta, err := readMetadata(ds.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		return nil, ErrWrongType
+	}
+	return ds.db.Get(key)
+}
+
+// =================== Hash ===================
+
+// HSet 写入hash的字段，返回新增的字段数量
+func (ds *DataStructure) HSet(key []byte, fields ...HashField) (int, error) {
+	var added int
+	err := ds.update(func(txn *bitcask.Txn) error {
+		added = 0
+		meta, err := ds.getMetadata(txn, key, typeHash)
+		if err != nil {
+			return err
+		}
+		for _, field := range fields {
+			fieldKey := subKey(key, meta.version, field.Field)
+			if _, err := txn.Get(fieldKey); err == bitcask.ErrKeyNotFound {
+				added++
+			} else if err != nil {
+				return err
+			}
+			if err := txn.Put(fieldKey, field.Value); err != nil {
+				return err
+			}
+		}
+		if added == 0 {
+			return nil
+		}
+		meta.size += uint64(added)
+		return putMetadata(txn, key, meta)
+	})
+	return added, err
+}
+
+// HGet 读取hash的字段，key或者字段不存在时返回bitcask.ErrKeyNotFound
+func (ds *DataStructure) HGet(key []byte, field []byte) ([]byte, error) {
+	meta, err := findMetadata(ds.db, key, typeHash)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, bitcask.ErrKeyNotFound
+	}
+	return ds.db.Get(subKey(key, meta.version, field))
+}
+
+// HDel 删除hash的字段，返回被删除的字段数量
+func (ds *DataStructure) HDel(key []byte, fields ...[]byte) (int, error) {
+	return ds.removeElements(key, typeHash, fields)
+}
+
+// 删除hash或者set中的元素，返回被删除的元素数量
+func (ds *DataStructure) removeElements(key []byte, dataType byte, elements [][]byte) (int, error) {
+	var removed int
+	err := ds.update(func(txn *bitcask.Txn) error {
+		removed = 0
+		meta, err := findMetadata(txn, key, dataType)
+		if err != nil || meta == nil {
+			return err
+		}
+		for _, element := range elements {
+			elementKey := subKey(key, meta.version, element)
+			if _, err := txn.Get(elementKey); err == bitcask.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := txn.Delete(elementKey); err != nil {
+				return err
+			}
+			removed++
+		}
+		if removed == 0 {
+			return nil
+		}
+		meta.size -= uint64(removed)
+		return putMetadata(txn, key, meta)
+	})
+	return removed, err
+}
+
+// =================== Set ===================
+
+// SAdd 向set中添加成员，返回新增的成员数量
+func (ds *DataStructure) SAdd(key []byte, members ...[]byte) (int, error) {
+	var added int
+	err := ds.update(func(txn *bitcask.Txn) error {
+		added = 0
+		meta, err := ds.getMetadata(txn, key, typeSet)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			memberKey := subKey(key, meta.version, member)
+			if _, err := txn.Get(memberKey); err == nil {
+				continue
+			} else if err != bitcask.ErrKeyNotFound {
+				return err
+			}
+			if err := txn.Put(memberKey, nil); err != nil {
+				return err
+			}
+			added++
+		}
+		if added == 0 {
+			return nil
+		}
+		meta.size += uint64(added)
+		return putMetadata(txn, key, meta)
+	})
+	return added, err
+}
+
+// SIsMember 判断成员是否在set中
+func (ds *DataStructure) SIsMember(key []byte, member []byte) (bool, error) {
+	meta, err := findMetadata(ds.db, key, typeSet)
+	if err != nil || meta == nil {
+		return false, err
+	}
+	_, err = ds.db.Get(subKey(key, meta.version, member))
+	if err == bitcask.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SRem 从set中删除成员，返回被删除的成员数量
+func (ds *DataStructure) SRem(key []byte, members ...[]byte) (int, error) {
+	return ds.removeElements(key, typeSet, members)
+}
+
+// =================== List ===================
+
+// LPush 从list头部依次插入元素，返回插入之后list的长度
+func (ds *DataStructure) LPush(key []byte, elements ...[]byte) (int, error) {
+	return ds.push(key, elements, true)
+}
+
+// RPush 从list尾部依次插入元素，返回插入之后list的长度
+func (ds *DataStructure) RPush(key []byte, elements ...[]byte) (int, error) {
+	return ds.push(key, elements, false)
+}
+
+func (ds *DataStructure) push(key []byte, elements [][]byte, isLeft bool) (int, error) {
+	var size int
+	err := ds.update(func(txn *bitcask.Txn) error {
+		meta, err := ds.getMetadata(txn, key, typeList)
+		if err != nil {
+			return err
+		}
+		for _, element := range elements {
+			var index uint64
+			if isLeft {
+				meta.head--
+				index = meta.head
+			} else {
+				index = meta.tail
+				meta.tail++
+			}
+			if err := txn.Put(subKey(key, meta.version, listIndex(index)), element); err != nil {
+				return err
+			}
+		}
+		meta.size += uint64(len(elements))
+		size = int(meta.size)
+		return putMetadata(txn, key, meta)
+	})
+	return size, err
+}
+
+// LPop 弹出list头部的元素，list不存在时返回bitcask.ErrKeyNotFound
+func (ds *DataStructure) LPop(key []byte) ([]byte, error) {
+	return ds.pop(key, true)
+}
+
+// RPop 弹出list尾部的元素，list不存在时返回bitcask.ErrKeyNotFound
+func (ds *DataStructure) RPop(key []byte) ([]byte, error) {
+	return ds.pop(key, false)
+}
+
+func (ds *DataStructure) pop(key []byte, isLeft bool) ([]byte, error) {
+	var element []byte
+	err := ds.update(func(txn *bitcask.Txn) error {
+		meta, err := findMetadata(txn, key, typeList)
+		if err != nil {
+			return err
+		}
+		if meta == nil {
+			return bitcask.ErrKeyNotFound
+		}
+		var index uint64
+		if isLeft {
+			index = meta.head
+			meta.head++
+		} else {
+			meta.tail--
+			index = meta.tail
+		}
+		elementKey := subKey(key, meta.version, listIndex(index))
+		if element, err = txn.Get(elementKey); err != nil {
+			return err
+		}
+		if err := txn.Delete(elementKey); err != nil {
+			return err
+		}
+		meta.size--
+		return putMetadata(txn, key, meta)
+	})
+	return element, err
+}
+
+// =================== Sorted Set ===================
+
+// ZAdd 向zset中添加成员，已经存在的成员更新score，返回新增的成员数量
+func (ds *DataStructure) ZAdd(key []byte, members ...ZMember) (int, error) {
+	for _, member := range members {
+		if math.IsNaN(member.Score) {
+			return 0, ErrInvalidScore
+		}
+	}
+	var added int
+	err := ds.update(func(txn *bitcask.Txn) error {
+		added = 0
+		meta, err := ds.getMetadata(txn, key, typeZSet)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			// -0和0视为同一个score
+			score := member.Score
+			if score == 0 {
+				score = 0
+			}
+			memberKey := subKey(key, meta.version, []byte{zsetMemberPart}, member.Member)
+			oldScore, err := txn.Get(memberKey)
+			switch {
+			case err == bitcask.ErrKeyNotFound:
+				added++
+			case err != nil:
+				return err
+			case bytes.Equal(oldScore, encodeScore(score)):
+				continue
+			default:
+				oldScoreKey := subKey(key, meta.version, []byte{zsetScorePart}, oldScore, member.Member)
+				if err := txn.Delete(oldScoreKey); err != nil {
+					return err
+				}
+			}
+			encoded := encodeScore(score)
+			if err := txn.Put(memberKey, encoded); err != nil {
+				return err
+			}
+			scoreKey := subKey(key, meta.version, []byte{zsetScorePart}, encoded, member.Member)
+			if err := txn.Put(scoreKey, nil); err != nil {
+				return err
+			}
+		}
+		if added == 0 {
+			return nil
+		}
+		meta.size += uint64(added)
+		return putMetadata(txn, key, meta)
+	})
+	return added, err
+}
+
+// ZScore 获取zset成员的score，key或者成员不存在时返回bitcask.ErrKeyNotFound
+func (ds *DataStructure) ZScore(key []byte, member []byte) (float64, error) {
+	meta, err := findMetadata(ds.db, key, typeZSet)
+	if err != nil {
+		return 0, err
+	}
+	if meta == nil {
+		return 0, bitcask.ErrKeyNotFound
+	}
+	encoded, err := ds.db.Get(subKey(key, meta.version, []byte{zsetMemberPart}, member))
+	if err != nil {
+		return 0, err
+	}
+	return decodeScore(encoded), nil
+}
+
+// ZRange 按score从小到大返回排名在[start, stop]之间的成员，负数表示从末尾开始计算的排名
+func (ds *DataStructure) ZRange(key []byte, start, stop int) ([]ZMember, error) {
+	var members []ZMember
+	err := ds.view(func(snap *bitcask.Snapshot) error {
+		meta, err := findMetadata(snap, key, typeZSet)
+		if err != nil || meta == nil {
+			return err
+		}
+		size := int(meta.size)
+		if start < 0 {
+			start += size
+		}
+		if stop < 0 {
+			stop += size
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= size {
+			stop = size - 1
+		}
+		if start > stop {
+			return nil
+		}
+
+		prefix := subKey(key, meta.version, []byte{zsetScorePart})
+		iterator := snap.NewIterator(bitcask.IteratorOptions{Prefix: prefix})
+		defer iterator.Close()
+		for rank := 0; iterator.Valid() && rank <= stop; rank++ {
+			if rank >= start {
+				scoreKey := iterator.Key()[len(prefix):]
+				member := make([]byte, len(scoreKey)-8)
+				copy(member, scoreKey[8:])
+				members = append(members, ZMember{Score: decodeScore(scoreKey[:8]), Member: member})
+			}
+			iterator.Next()
+		}
+		return nil
+	})
+	return members, err
+}
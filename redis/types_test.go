@@ -0,0 +1,394 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	bitcask "kv-bitcask"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openDataStructure(t *testing.T) (*DataStructure, *bitcask.DB, string) {
+	opts := bitcask.DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-types")
+	opts.DirPath = dir
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return NewDataStructure(db), db, dir
+}
+
+func TestDataStructure_String(t *testing.T) {
+	ds, db, _ := openDataStructure(t)
+
+	assert.Nil(t, ds.Set([]byte("k"), []byte("v"), 0))
+	val, err := ds.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	typ, err := ds.Type([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, "string", typ)
+	typ, err = ds.Type([]byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, "none", typ)
+
+	// 空的value
+	assert.Nil(t, ds.Set([]byte("empty"), nil, 0))
+	val, err = ds.Get([]byte("empty"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(val))
+
+	assert.Nil(t, ds.Set([]byte("tmp"), []byte("v"), 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+	_, err = ds.Get([]byte("tmp"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	// string原样保存，和直接通过DB读写的数据一致
+	stored, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), stored)
+	assert.Nil(t, db.Put([]byte("raw"), []byte("raw-value")))
+	val, err = ds.Get([]byte("raw"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("raw-value"), val)
+	_, err = ds.HSet([]byte("raw"), HashField{Field: []byte("f")})
+	assert.Equal(t, ErrWrongType, err)
+
+	// 覆盖数据结构，元数据被删除
+	_, err = ds.SAdd([]byte("set"), []byte("m"))
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Set([]byte("set"), []byte("v"), 0))
+	typ, err = ds.Type([]byte("set"))
+	assert.Nil(t, err)
+	assert.Equal(t, "string", typ)
+	_, err = db.Get(metaKey([]byte("set")))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	// 保留的前缀不能作为用户的key
+	assert.Equal(t, ErrReservedKey, ds.Set([]byte{reservedKeyPrefix, 'a'}, []byte("v"), 0))
+	_, err = ds.HSet([]byte{reservedKeyPrefix}, HashField{Field: []byte("f")})
+	assert.Equal(t, ErrReservedKey, err)
+}
+
+func TestDataStructure_Hash(t *testing.T) {
+	ds, _, _ := openDataStructure(t)
+	key := []byte("hash")
+
+	added, err := ds.HSet(key, HashField{[]byte("f1"), []byte("v1")}, HashField{[]byte("f2"), []byte("v2")}, HashField{[]byte("f1"), []byte("v1-new")})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, added)
+	added, err = ds.HSet(key, HashField{[]byte("f2"), []byte("v2-new")})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, added)
+
+	val, err := ds.HGet(key, []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-new"), val)
+	val, err = ds.HGet(key, []byte("f2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2-new"), val)
+	_, err = ds.HGet(key, []byte("f3"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	_, err = ds.HGet([]byte("missing"), []byte("f1"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	// 类型不一致
+	_, err = ds.Get(key)
+	assert.Equal(t, ErrWrongType, err)
+	_, err = ds.SAdd(key, []byte("m"))
+	assert.Equal(t, ErrWrongType, err)
+
+	removed, err := ds.HDel(key, []byte("f1"), []byte("f3"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	removed, err = ds.HDel(key, []byte("f2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+
+	// 删除最后一个字段之后key不存在
+	n, err := ds.Exists(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestDataStructure_Set(t *testing.T) {
+	ds, _, _ := openDataStructure(t)
+	key := []byte("set")
+
+	added, err := ds.SAdd(key, []byte("a"), []byte("b"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, added)
+	added, err = ds.SAdd(key, []byte("b"), []byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+
+	for _, member := range []string{"a", "b", "c"} {
+		ok, err := ds.SIsMember(key, []byte(member))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	ok, err := ds.SIsMember(key, []byte("d"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = ds.SIsMember([]byte("missing"), []byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	removed, err := ds.SRem(key, []byte("a"), []byte("d"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	ok, _ = ds.SIsMember(key, []byte("a"))
+	assert.False(t, ok)
+	removed, err = ds.SRem([]byte("missing"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestDataStructure_List(t *testing.T) {
+	ds, _, _ := openDataStructure(t)
+	key := []byte("list")
+
+	size, err := ds.LPush(key, []byte("b"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, size)
+	size, err = ds.RPush(key, []byte("c"), []byte("d"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, size)
+
+	// a b c d
+	val, err := ds.LPop(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), val)
+	val, err = ds.RPop(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("d"), val)
+	val, err = ds.RPop(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c"), val)
+	val, err = ds.RPop(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+
+	_, err = ds.LPop(key)
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	typ, _ := ds.Type(key)
+	assert.Equal(t, "none", typ)
+}
+
+func TestDataStructure_ZSet(t *testing.T) {
+	ds, _, _ := openDataStructure(t)
+	key := []byte("zset")
+
+	added, err := ds.ZAdd(key,
+		ZMember{Score: 3, Member: []byte("c")},
+		ZMember{Score: -1.5, Member: []byte("a")},
+		ZMember{Score: math.Inf(1), Member: []byte("e")},
+		ZMember{Score: 2, Member: []byte("b")},
+		ZMember{Score: math.Copysign(0, -1), Member: []byte("z")},
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, added)
+
+	// 更新已有成员的score
+	added, err = ds.ZAdd(key, ZMember{Score: 10, Member: []byte("a")}, ZMember{Score: 0, Member: []byte("z")})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, added)
+	_, err = ds.ZAdd(key, ZMember{Score: math.NaN(), Member: []byte("n")})
+	assert.Equal(t, ErrInvalidScore, err)
+
+	score, err := ds.ZScore(key, []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(10), score)
+	_, err = ds.ZScore(key, []byte("x"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	members, err := ds.ZRange(key, 0, -1)
+	assert.Nil(t, err)
+	var names []string
+	for _, member := range members {
+		names = append(names, string(member.Member))
+	}
+	assert.Equal(t, []string{"z", "b", "c", "a", "e"}, names)
+	assert.Equal(t, float64(0), members[0].Score)
+	assert.True(t, math.IsInf(members[4].Score, 1))
+
+	members, err = ds.ZRange(key, 1, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []ZMember{{Score: 2, Member: []byte("b")}, {Score: 3, Member: []byte("c")}}, members)
+	members, err = ds.ZRange(key, -2, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(members))
+	members, err = ds.ZRange(key, 3, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(members))
+}
+
+func TestEncodeScore(t *testing.T) {
+	scores := []float64{math.Inf(-1), -math.MaxFloat64, -100, -1.5, -math.SmallestNonzeroFloat64, 0,
+		math.SmallestNonzeroFloat64, 1, 1.5, 100, math.MaxFloat64, math.Inf(1)}
+	encoded := make([]string, len(scores))
+	for i, score := range scores {
+		encoded[i] = string(encodeScore(score))
+		assert.Equal(t, score, decodeScore([]byte(encoded[i])))
+	}
+	assert.True(t, sort.StringsAreSorted(encoded))
+}
+
+// 删除整个数据结构之后重新创建，不会读到之前的元素
+func TestDataStructure_DeleteAndRecreate(t *testing.T) {
+	ds, db, dir := openDataStructure(t)
+	key := []byte("hash")
+
+	for i := 0; i < 100; i++ {
+		_, err := ds.HSet(key, HashField{[]byte(fmt.Sprintf("f%d", i)), []byte("v")})
+		assert.Nil(t, err)
+	}
+	n, err := ds.Del(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	_, err = ds.HGet(key, []byte("f1"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	added, err := ds.HSet(key, HashField{[]byte("f1"), []byte("new")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+	_, err = ds.HGet(key, []byte("f2"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	removed, err := ds.HDel(key, []byte("f1"), []byte("f2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+
+	// 覆盖为string
+	_, err = ds.SAdd(key, []byte("m"))
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Set(key, []byte("str"), 0))
+	ok, err := ds.SIsMember(key, []byte("m"))
+	assert.Equal(t, ErrWrongType, err)
+	assert.False(t, ok)
+
+	// 过期时间在修改数据结构之后保留
+	_, err = ds.RPush([]byte("list"), []byte("a"))
+	assert.Nil(t, err)
+	ok, err = ds.Expire([]byte("list"), time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = ds.RPush([]byte("list"), []byte("b"))
+	assert.Nil(t, err)
+	ttl, err := ds.TTL([]byte("list"))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 50*time.Second)
+	ok, err = ds.Expire([]byte("missing"), time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 重启之后数据不变
+	opts := bitcask.DefaultOptions
+	opts.DirPath = dir
+	assert.Nil(t, db.Close())
+	db2, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	ds2 := NewDataStructure(db2)
+	val, err := ds2.LPop([]byte("list"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), val)
+	val, err = ds2.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("str"), val)
+}
+
+// 并发修改同一个数据结构，每次写入都原子地生效
+func TestDataStructure_Concurrent(t *testing.T) {
+	ds, _, _ := openDataStructure(t)
+	key := []byte("list")
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := ds.RPush(key, []byte(fmt.Sprintf("%d-%d", i, j)))
+				assert.Nil(t, err)
+				_, err = ds.SAdd([]byte("set"), []byte(fmt.Sprintf("%d-%d", i, j)))
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for {
+		val, err := ds.LPop(key)
+		if err == bitcask.ErrKeyNotFound {
+			break
+		}
+		assert.Nil(t, err)
+		seen[string(val)] = true
+	}
+	assert.Equal(t, 400, len(seen))
+
+	removed, err := ds.SRem([]byte("set"), []byte("0-0"), []byte("7-49"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+}
+
+// 删除、覆盖和过期的数据结构残留的子key由Sweep清理，正在使用的数据结构不受影响
+func TestDataStructure_Sweep(t *testing.T) {
+	ds, db, _ := openDataStructure(t)
+	countSubKeys := func() int {
+		iterator := db.NewIterator(bitcask.IteratorOptions{Prefix: []byte{reservedKeyPrefix, subKeySpace}})
+		defer iterator.Close()
+		var n int
+		for ; iterator.Valid(); iterator.Next() {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < 1500; i++ {
+		_, err := ds.HSet([]byte("deleted"), HashField{[]byte(fmt.Sprintf("f%d", i)), []byte("v")})
+		assert.Nil(t, err)
+	}
+	_, err := ds.SAdd([]byte("overwritten"), []byte("a"), []byte("b"))
+	assert.Nil(t, err)
+	_, err = ds.RPush([]byte("expired"), []byte("a"), []byte("b"), []byte("c"))
+	assert.Nil(t, err)
+	_, err = ds.ZAdd([]byte("live"), ZMember{Score: 1, Member: []byte("a")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1500+2+3+2, countSubKeys())
+
+	n, err := ds.Del([]byte("deleted"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Nil(t, ds.Set([]byte("overwritten"), []byte("v"), 0))
+	_, err = ds.Expire([]byte("expired"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = ds.HSet([]byte("deleted"), HashField{[]byte("f1"), []byte("new")})
+	assert.Nil(t, err)
+
+	swept, err := ds.Sweep()
+	assert.Nil(t, err)
+	assert.Equal(t, 1500+2+3, swept)
+	assert.Equal(t, 1+2, countSubKeys())
+	val, err := ds.HGet([]byte("deleted"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	score, err := ds.ZScore([]byte("live"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), score)
+
+	swept, err = ds.Sweep()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, swept)
+}
@@ -0,0 +1,187 @@
+package kv_bitcask
+
+import (
+	"bufio"
+	"fmt"
+	"kv-bitcask/data"
+	"kv-bitcask/fio"
+	"kv-bitcask/index"
+	"kv-bitcask/utils"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	repairDirPrefix      = "repair-"
+	repairReportFileName = "report.txt"
+	repairTmpFileSuffix  = ".repair"
+)
+
+// RepairReport 修复的结果
+type RepairReport struct {
+	Files     []uint32       // 被重写的数据文件id
+	Records   int64          // 被重写的文件中保留下来的记录数量
+	LostBytes int64          // 丢弃的数据总大小
+	Lost      []CheckProblem // 丢弃的数据范围，原始文件保存在BackupDir中，可以按范围找回数据
+	Skipped   []CheckProblem // 无法自动修复的问题，例如不符合格式的文件名，需要手动处理
+	BackupDir string         // 保存原始数据文件和报告的目录，没有需要修复的文件时为空
+}
+
+// Repair 离线修复数据目录，跳过损坏的数据，把损坏的数据文件中完好的记录重写到新文件中
+// 原始文件和丢弃的数据范围报告保存在数据目录下的repair-<时间>目录中，确认无误后可以手动删除
+// 修复期间会对数据目录加锁，数据库不能处于打开状态
+func Repair(dirPath string) (*RepairReport, error) {
+	fileLock := utils.NewFileLock(filepath.Join(dirPath, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	checkReport, err := Check(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// 文件名不符合格式的文件无法按id替换，只报告不修复
+	report := &RepairReport{}
+	skipped := make(map[string]bool)
+	for _, problem := range checkReport.Problems {
+		if problem.Offset < 0 {
+			skipped[problem.FileName] = true
+			report.Skipped = append(report.Skipped, problem)
+		}
+	}
+	var fileIds []uint32
+	for _, problem := range checkReport.Problems {
+		if skipped[problem.FileName] {
+			continue
+		}
+		if len(fileIds) == 0 || fileIds[len(fileIds)-1] != problem.FileId {
+			fileIds = append(fileIds, problem.FileId)
+		}
+	}
+	if len(fileIds) == 0 {
+		return report, nil
+	}
+
+	report.BackupDir = filepath.Join(dirPath, repairDirPrefix+time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(report.BackupDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	for _, fileId := range fileIds {
+		if err := repairDataFile(dirPath, report.BackupDir, fileId, report); err != nil {
+			return nil, err
+		}
+		report.Files = append(report.Files, fileId)
+	}
+
+	// 数据的位置发生了变化，持久化的索引需要重建
+	if err := os.Remove(filepath.Join(dirPath, index.BPTreeFileName)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := syncDir(dirPath); err != nil {
+		return nil, err
+	}
+	return report, writeRepairReport(report)
+}
+
+// 把数据文件中完好的记录写入临时文件，原始文件硬链接到备份目录后，再用临时文件原子地替换原始文件
+func repairDataFile(dirPath, backupDir string, fileId uint32, report *RepairReport) error {
+	fileName := data.GetDataFileName(dirPath, fileId)
+	tmpFileName := fileName + repairTmpFileSuffix
+	if err := rewriteDataFile(fileName, tmpFileName, fileId, report); err != nil {
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+
+	if err := os.Link(fileName, filepath.Join(backupDir, filepath.Base(fileName))); err != nil {
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	if err := os.Rename(tmpFileName, fileName); err != nil {
+		return err
+	}
+	// hint文件中记录的位置已经失效
+	err := os.Remove(data.GetHintFileName(dirPath, fileId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 读取原始文件，完好的记录原样写入到新文件中，丢弃的数据范围记录到report中
+func rewriteDataFile(fileName, tmpFileName string, fileId uint32, report *RepairReport) error {
+	ioManager, err := fio.NewIOManager(fileName, fio.MemoryMap)
+	if err != nil {
+		return err
+	}
+	dataFile := &data.DataFile{FileId: fileId, IOManager: ioManager}
+	defer dataFile.Close()
+	fileSize, err := ioManager.Size()
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DatafilePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmpFile.Close()
+	}()
+	writer := bufio.NewWriter(tmpFile)
+
+	onRecord := func(offset, size int64) error {
+		buf, err := dataFile.ReadNBytes(size, offset)
+		if err != nil {
+			return err
+		}
+		report.Records++
+		_, err = writer.Write(buf)
+		return err
+	}
+	onProblem := func(offset, length int64, err error) {
+		report.LostBytes += length
+		report.Lost = append(report.Lost, CheckProblem{
+			FileName: filepath.Base(fileName), FileId: fileId, Offset: offset, Length: length, Err: err,
+		})
+	}
+	if err := scanDataFile(dataFile, fileSize, onRecord, onProblem); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return tmpFile.Sync()
+}
+
+// 在备份目录中写入丢弃的数据范围，每行一个：文件名 起始位置 长度 原因
+func writeRepairReport(report *RepairReport) error {
+	file, err := os.Create(filepath.Join(report.BackupDir, repairReportFileName))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "# file offset length reason\n")
+	for _, lost := range report.Lost {
+		fmt.Fprintf(writer, "%s %d %d %v\n", lost.FileName, lost.Offset, lost.Length, lost.Err)
+	}
+	for _, skipped := range report.Skipped {
+		fmt.Fprintf(writer, "# skipped %s: %v\n", skipped.FileName, skipped.Err)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
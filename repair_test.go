@@ -0,0 +1,94 @@
+package kv_bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-repair")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%04d", i))))
+	}
+	assert.Nil(t, db.Close())
+
+	// 损坏older文件中的两条记录，文件0有hint文件，打开时不会发现损坏
+	offsets := recordOffsets(t, dir, 0)
+	corruptDataFile(t, dir, 0, offsets[11]-1)
+	corruptDataFile(t, dir, 0, offsets[101]-1)
+	corrupted, err := os.ReadFile(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	_, err = os.Stat(data.GetHintFileName(dir, 0))
+	assert.Nil(t, err)
+
+	report, err := Repair(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{0}, report.Files)
+	assert.Equal(t, int64(len(offsets)-2), report.Records)
+	assert.Equal(t, []CheckProblem{
+		{FileName: "000000000.data", Offset: offsets[10], Length: offsets[11] - offsets[10], Err: data.ErrInvalidCRC},
+		{FileName: "000000000.data", Offset: offsets[100], Length: offsets[101] - offsets[100], Err: data.ErrInvalidCRC},
+	}, report.Lost)
+	assert.Equal(t, offsets[11]-offsets[10]+offsets[101]-offsets[100], report.LostBytes)
+
+	// 原始文件和报告保存在备份目录中，hint文件被删除
+	backup, err := os.ReadFile(filepath.Join(report.BackupDir, "000000000.data"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(corrupted, backup))
+	reportFile, err := os.ReadFile(filepath.Join(report.BackupDir, repairReportFileName))
+	assert.Nil(t, err)
+	assert.Contains(t, string(reportFile), fmt.Sprintf("000000000.data %d %d invalid crc\n", offsets[10], offsets[11]-offsets[10]))
+	_, err = os.Stat(data.GetHintFileName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+
+	checkReport, err := Check(dir)
+	assert.Nil(t, err)
+	assert.True(t, checkReport.OK())
+
+	// 损坏的记录丢失，其他数据都可以正常读取
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 3000; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%04d", i)))
+		if i == 10 || i == 100 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%04d", i), string(value))
+	}
+}
+
+func TestRepair_Clean(t *testing.T) {
+	dir := prepareCheckDir(t)
+	defer os.RemoveAll(dir)
+
+	report, err := Repair(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Files)
+	assert.Empty(t, report.BackupDir)
+	assert.Equal(t, int64(0), report.LostBytes)
+}
+
+func TestRepair_DatabaseIsUsing(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-repair")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = Repair(dir)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+}
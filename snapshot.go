@@ -0,0 +1,396 @@
+package kv_bitcask
+
+import (
+	"bytes"
+	"github.com/google/btree"
+	"kv-bitcask/data"
+	"kv-bitcask/index"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Snapshot 数据库在某一时刻的只读视图，Get和迭代器读取的都是创建快照时的数据
+// 快照存活期间被覆盖或删除的旧版本会保留在内存中，merge也不会清理这些版本对应的记录
+// 使用完毕后需要调用Release释放，否则旧版本会一直占用内存和磁盘空间
+type Snapshot struct {
+	db       *DB
+	seqNo    uint64 // 创建快照时的提交序列号
+	released bool   // 是否已经释放，由db.mu保护
+}
+
+// Snapshot 创建当前时刻的快照
+func (db *DB) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.snapshots[db.seqNo]++
+	return &Snapshot{db: db, seqNo: db.seqNo}
+}
+
+// Get 读取key在快照中的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	if s.db.isClosed {
+		return nil, ErrDBClosed
+	}
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	pos := s.position(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return s.db.getValueByPosition(pos)
+}
+
+// NewIterator 创建遍历快照数据的迭代器，快照释放之后迭代器也不能再读取value
+// 数据库已经关闭时返回的迭代器没有任何数据
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	var indexIter index.Iterator = closedIterator{}
+	if !s.db.isClosed {
+		indexIter = newSnapshotIterator(s, s.db.index.Iterator(opts.Reverse), opts.Reverse)
+	}
+	it := newIterator(s.db, indexIter, opts)
+	it.snapshot = s
+	return it
+}
+
+// Release 释放快照，之后快照不能再读取数据，重复释放直接返回
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.release()
+}
+
+// 释放快照并清理不再被任何快照引用的旧版本，调用方需持有db.mu写锁
+func (s *Snapshot) release() {
+	if s.released {
+		return
+	}
+	s.released = true
+
+	db := s.db
+	if db.snapshots[s.seqNo]--; db.snapshots[s.seqNo] == 0 {
+		delete(db.snapshots, s.seqNo)
+	}
+	if len(db.snapshots) == 0 {
+		db.versions.clear()
+		return
+	}
+	// 只有早于变化发生时的快照才需要旧版本
+	var minSeqNo uint64 = math.MaxUint64
+	for seqNo := range db.snapshots {
+		if seqNo < minSeqNo {
+			minSeqNo = seqNo
+		}
+	}
+	db.versions.prune(minSeqNo)
+}
+
+// 获取key在快照中的位置，key在快照中不存在时返回nil
+func (s *Snapshot) position(key []byte) *data.LogRecordPos {
+	if version := s.db.versions.get(key, s.seqNo); version != nil {
+		return version.pos
+	}
+	return s.db.index.Get(key)
+}
+
+// 在写入seqNo时保存key之前的版本oldPos，只有存在快照时才需要保存，调用方需持有db.mu写锁
+func (db *DB) saveVersion(key []byte, seqNo uint64, oldPos *data.LogRecordPos) {
+	if len(db.snapshots) == 0 {
+		return
+	}
+	db.versions.add(key, seqNo, oldPos)
+}
+
+// keyVersion key在某次提交中发生变化之前的版本
+type keyVersion struct {
+	changedAt uint64             // 发生变化时的提交序列号
+	pos       *data.LogRecordPos // 变化之前的位置，nil表示变化之前key不存在
+}
+
+// versionItem 一个key被保存的所有旧版本
+type versionItem struct {
+	key      []byte
+	versions []*keyVersion // 按changedAt从小到大排列
+}
+
+func (a *versionItem) Less(b btree.Item) bool {
+	return bytes.Compare(a.key, b.(*versionItem).key) == -1
+}
+
+// versionStore 快照存活期间被覆盖或删除的旧版本
+// 快照读取key时，如果key在快照之后发生过变化，第一次变化之前的版本就是快照中的版本
+type versionStore struct {
+	tree *btree.BTree
+	lock *sync.RWMutex // merge时会在不持有db.mu的情况下读取
+}
+
+func newVersionStore() *versionStore {
+	return &versionStore{
+		tree: btree.New(32),
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (vs *versionStore) add(key []byte, changedAt uint64, pos *data.LogRecordPos) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	version := &keyVersion{changedAt: changedAt, pos: pos}
+	if it := vs.tree.Get(&versionItem{key: key}); it != nil {
+		item := it.(*versionItem)
+		item.versions = append(item.versions, version)
+		return
+	}
+	vs.tree.ReplaceOrInsert(&versionItem{key: key, versions: []*keyVersion{version}})
+}
+
+// 获取key在seqNo之后第一次变化之前的版本，seqNo之后没有变化过时返回nil
+func (vs *versionStore) get(key []byte, seqNo uint64) *keyVersion {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	it := vs.tree.Get(&versionItem{key: key})
+	if it == nil {
+		return nil
+	}
+	versions := it.(*versionItem).versions
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].changedAt > seqNo
+	})
+	if i == len(versions) {
+		return nil
+	}
+	return versions[i]
+}
+
+// 是否有旧版本位于数据文件fid的offset处
+func (vs *versionStore) contains(key []byte, fid uint32, offset int64) bool {
+	return len(vs.find(key, fid, offset)) > 0
+}
+
+// 获取位于数据文件fid的offset处的旧版本
+func (vs *versionStore) find(key []byte, fid uint32, offset int64) []*keyVersion {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	it := vs.tree.Get(&versionItem{key: key})
+	if it == nil {
+		return nil
+	}
+	var versions []*keyVersion
+	for _, version := range it.(*versionItem).versions {
+		if version.pos != nil && version.pos.Fid == fid && version.pos.Offset == offset {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// 每个数据文件中被旧版本引用的数据大小
+func (vs *versionStore) pinnedSize() map[uint32]int64 {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	sizes := make(map[uint32]int64)
+	vs.tree.Ascend(func(it btree.Item) bool {
+		for _, version := range it.(*versionItem).versions {
+			if version.pos != nil {
+				sizes[version.pos.Fid] += int64(version.pos.Size)
+			}
+		}
+		return true
+	})
+	return sizes
+}
+
+// merge之后将旧版本更新到新的位置，newPos为nil表示记录已过期被清理
+func (vs *versionStore) setPos(version *keyVersion, newPos *data.LogRecordPos) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	if newPos != nil {
+		// 数据本身没有变化，保留原来的版本
+		newPos = &data.LogRecordPos{
+			Fid:     newPos.Fid,
+			Offset:  newPos.Offset,
+			Size:    newPos.Size,
+			Expire:  newPos.Expire,
+			Version: version.pos.Version,
+		}
+	}
+	version.pos = newPos
+}
+
+// 清理在seqNo及之前发生的变化，这些变化之前的版本不会再被任何快照读取
+func (vs *versionStore) prune(seqNo uint64) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	var emptyItems []btree.Item
+	vs.tree.Ascend(func(it btree.Item) bool {
+		item := it.(*versionItem)
+		i := sort.Search(len(item.versions), func(i int) bool {
+			return item.versions[i].changedAt > seqNo
+		})
+		item.versions = item.versions[i:]
+		if len(item.versions) == 0 {
+			emptyItems = append(emptyItems, item)
+		}
+		return true
+	})
+	for _, item := range emptyItems {
+		vs.tree.Delete(item)
+	}
+}
+
+func (vs *versionStore) clear() {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	vs.tree.Clear(false)
+}
+
+// 按遍历方向查找从from开始第一个在seqNo之后发生过变化的key，inclusive表示是否包含from本身，from为nil时从头开始
+func (vs *versionStore) nextChangedKey(seqNo uint64, from []byte, inclusive, reverse bool) []byte {
+	vs.lock.RLock()
+	defer vs.lock.RUnlock()
+	var key []byte
+	findKey := func(it btree.Item) bool {
+		item := it.(*versionItem)
+		if !inclusive && bytes.Equal(item.key, from) {
+			return true
+		}
+		if item.versions[len(item.versions)-1].changedAt > seqNo {
+			key = item.key
+			return false
+		}
+		return true
+	}
+	switch {
+	case from == nil && reverse:
+		vs.tree.Descend(findKey)
+	case from == nil:
+		vs.tree.Ascend(findKey)
+	case reverse:
+		vs.tree.DescendLessOrEqual(&versionItem{key: from}, findKey)
+	default:
+		vs.tree.AscendGreaterOrEqual(&versionItem{key: from}, findKey)
+	}
+	return key
+}
+
+// snapshotIterator 遍历快照中的key
+// 快照中的key要么仍在索引中，要么在快照之后发生过变化，遍历时合并这两部分，跳过在快照中不存在的key
+// B+树的索引迭代器读取的是实时的索引，迭代器创建之后删除的key会从索引中消失，
+// 所以发生过变化的key每次都从versionStore中实时查找，而不是在创建迭代器时保存下来
+type snapshotIterator struct {
+	snapshot  *Snapshot
+	indexIter index.Iterator // 索引迭代器
+	from      []byte         // 查找发生过变化的key的起始位置，nil表示从头开始
+	inclusive bool           // 查找时是否包含from本身
+	reverse   bool
+	key       []byte             // 当前遍历位置的key，nil表示遍历结束
+	pos       *data.LogRecordPos // 当前key在快照中的位置
+}
+
+func newSnapshotIterator(s *Snapshot, indexIter index.Iterator, reverse bool) *snapshotIterator {
+	si := &snapshotIterator{
+		snapshot:  s,
+		indexIter: indexIter,
+		reverse:   reverse,
+	}
+	si.Rewind()
+	return si
+}
+
+func (si *snapshotIterator) Rewind() {
+	si.indexIter.Rewind()
+	si.from, si.inclusive = nil, true
+	si.findValid()
+}
+
+func (si *snapshotIterator) Seek(key []byte) {
+	si.indexIter.Seek(key)
+	si.from, si.inclusive = key, true
+	si.findValid()
+}
+
+func (si *snapshotIterator) Next() {
+	if si.key == nil {
+		return
+	}
+	si.advance(si.key, si.indexIter.Valid() && bytes.Equal(si.key, si.indexIter.Key()))
+	si.findValid()
+}
+
+// 两部分中按遍历方向排在前面的key，inIndex表示索引迭代器当前是否位于该key，两部分都遍历结束时返回nil
+func (si *snapshotIterator) current() (key []byte, inIndex bool) {
+	if si.indexIter.Valid() {
+		key, inIndex = si.indexIter.Key(), true
+	}
+	changedKey := si.snapshot.db.versions.nextChangedKey(si.snapshot.seqNo, si.from, si.inclusive, si.reverse)
+	if changedKey == nil {
+		return key, inIndex
+	}
+	if key != nil {
+		cmp := bytes.Compare(changedKey, key)
+		if si.reverse {
+			cmp = -cmp
+		}
+		if cmp >= 0 {
+			return key, inIndex
+		}
+	}
+	return changedKey, false
+}
+
+// 跳过key，之后只查找key之后发生过变化的key
+func (si *snapshotIterator) advance(key []byte, inIndex bool) {
+	if inIndex {
+		si.indexIter.Next()
+	}
+	si.from, si.inclusive = key, false
+}
+
+// 从当前位置开始找到第一个在快照中存在的key
+func (si *snapshotIterator) findValid() {
+	for {
+		key, inIndex := si.current()
+		if key == nil {
+			si.key, si.pos = nil, nil
+			return
+		}
+		if version := si.snapshot.db.versions.get(key, si.snapshot.seqNo); version != nil {
+			si.pos = version.pos
+		} else if inIndex {
+			si.pos = si.indexIter.Value()
+		} else {
+			si.pos = nil
+		}
+		if si.pos != nil {
+			si.key = key
+			return
+		}
+		si.advance(key, inIndex)
+	}
+}
+
+func (si *snapshotIterator) Valid() bool {
+	return si.key != nil
+}
+
+func (si *snapshotIterator) Key() []byte {
+	return si.key
+}
+
+func (si *snapshotIterator) Value() *data.LogRecordPos {
+	return si.pos
+}
+
+func (si *snapshotIterator) Close() {
+	si.indexIter.Close()
+}
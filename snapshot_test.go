@@ -0,0 +1,282 @@
+package kv_bitcask
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/data"
+	"kv-bitcask/index"
+	"kv-bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("v1")))
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("v2")))
+
+	snap := db.Snapshot()
+
+	// 快照之后的覆盖、删除和新写入
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("v1-new")))
+	assert.Nil(t, db.Delete(utils.GetTestKey(2)))
+	assert.Nil(t, db.Put(utils.GetTestKey(3), []byte("v3")))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put(utils.GetTestKey(2), []byte("v2-batch")))
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("v1-batch")))
+	assert.Nil(t, wb.Commit())
+
+	val, err := snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	val, err = snap.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = snap.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 第二个快照看到的是创建时的数据
+	snap2 := db.Snapshot()
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+	val, err = snap2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-batch"), val)
+	val, err = snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// 释放之后不能再读取，旧版本被清理
+	snap.Release()
+	snap.Release()
+	_, err = snap.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrSnapshotReleased, err)
+	val, err = snap2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-batch"), val)
+	assert.Equal(t, 1, db.versions.tree.Len())
+
+	snap2.Release()
+	assert.Equal(t, 0, db.versions.tree.Len())
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_SnapshotIterator(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.Btree, index.ART, index.BPTree} {
+		t.Run(fmt.Sprintf("index-%d", indexType), func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-2")
+			opts.DirPath = dir
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			defer destroyDB(db)
+			assert.Nil(t, err)
+
+			for _, key := range []string{"aa", "ab", "ba", "bb", "ca"} {
+				assert.Nil(t, db.Put([]byte(key), []byte(key)))
+			}
+			snap := db.Snapshot()
+			defer snap.Release()
+
+			assert.Nil(t, db.Delete([]byte("ab")))
+			assert.Nil(t, db.Delete([]byte("ca")))
+			assert.Nil(t, db.Put([]byte("aa"), []byte("new")))
+			assert.Nil(t, db.Put([]byte("ac"), []byte("new")))
+			assert.Nil(t, db.Put([]byte("cb"), []byte("new")))
+
+			it := snap.NewIterator(DefaultIteratorOptions)
+			var keys []string
+			for ; it.Valid(); it.Next() {
+				val, err := it.Value()
+				assert.Nil(t, err)
+				assert.Equal(t, it.Key(), val)
+				keys = append(keys, string(it.Key()))
+			}
+			it.Close()
+			assert.Equal(t, []string{"aa", "ab", "ba", "bb", "ca"}, keys)
+
+			// 迭代器创建之后的写入不影响遍历
+			it = snap.NewIterator(IteratorOptions{Reverse: true})
+			assert.Nil(t, db.Delete([]byte("bb")))
+			assert.Equal(t, []string{"ca", "bb", "ba", "ab", "aa"}, iterKeys(it))
+			it.Close()
+
+			it = snap.NewIterator(IteratorOptions{Prefix: []byte("a")})
+			assert.Equal(t, []string{"aa", "ab"}, iterKeys(it))
+			it.Seek([]byte("ab"))
+			assert.Equal(t, []string{"ab"}, iterKeys(it))
+			it.Close()
+
+			// 当前数据不受影响
+			it = db.NewIterator(DefaultIteratorOptions)
+			assert.Equal(t, []string{"aa", "ac", "ba", "cb"}, iterKeys(it))
+			it.Close()
+
+			// 快照释放之后不能再读取value
+			it = snap.NewIterator(DefaultIteratorOptions)
+			snap.Release()
+			_, err = it.Value()
+			assert.Equal(t, ErrSnapshotReleased, err)
+			it.Close()
+		})
+	}
+}
+
+// 遍历快照期间删除和写入还没有遍历到的key，遍历的仍然是快照中的数据
+func TestDB_SnapshotIteratorConcurrentWrite(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.Btree, index.ART, index.BPTree} {
+		t.Run(fmt.Sprintf("index-%d", indexType), func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-5")
+			opts.DirPath = dir
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			defer destroyDB(db)
+			assert.Nil(t, err)
+
+			for i := 0; i < 1000; i += 2 {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+			}
+			snap := db.Snapshot()
+			defer snap.Release()
+
+			for _, reverse := range []bool{false, true} {
+				it := snap.NewIterator(IteratorOptions{Reverse: reverse})
+				var count int
+				for ; it.Valid(); it.Next() {
+					val, err := it.Value()
+					assert.Nil(t, err)
+					assert.Equal(t, it.Key(), val)
+					count++
+					if count == 100 {
+						// 删除所有的key，并写入新的key
+						for i := 0; i < 1000; i++ {
+							if i%2 == 0 {
+								assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+							} else {
+								assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+							}
+						}
+					}
+				}
+				it.Close()
+				assert.Equal(t, 500, count)
+
+				for i := 0; i < 1000; i++ {
+					assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+				}
+			}
+		})
+	}
+}
+
+// merge 保留快照仍会读取的旧版本，重启之后旧版本不会被加载
+func TestDB_SnapshotMerge(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.Btree, index.BPTree} {
+		t.Run(fmt.Sprintf("index-%d", indexType), func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-3")
+			opts.DirPath = dir
+			opts.DataFileSize = 32 * 1024
+			opts.IndexType = indexType
+			db, err := Open(opts)
+			defer destroyDB(db)
+			assert.Nil(t, err)
+
+			for i := 0; i < 1000; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("old-%d", i))))
+			}
+			snap := db.Snapshot()
+			for i := 0; i < 1000; i++ {
+				if i%2 == 0 {
+					assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+				} else {
+					assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("new-%d", i))))
+				}
+			}
+
+			assert.Nil(t, db.Merge())
+			for i := 0; i < 1000; i++ {
+				val, err := snap.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("old-%d", i)), val)
+			}
+			it := snap.NewIterator(DefaultIteratorOptions)
+			var count int
+			for ; it.Valid(); it.Next() {
+				_, err := it.Value()
+				assert.Nil(t, err)
+				count++
+			}
+			it.Close()
+			assert.Equal(t, 1000, count)
+
+			// 释放快照之后再次merge，旧版本被清理
+			snap.Release()
+			assert.Nil(t, db.Merge())
+			assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("after-merge")))
+
+			// 重启之后只有最新的数据
+			assert.Nil(t, db.Close())
+			db2, err := Open(opts)
+			assert.Nil(t, err)
+			defer func() {
+				_ = db2.Close()
+			}()
+			for i := 0; i < 1000; i++ {
+				val, err := db2.Get(utils.GetTestKey(i))
+				switch {
+				case i == 1:
+					assert.Equal(t, []byte("after-merge"), val)
+				case i%2 == 0:
+					assert.Equal(t, ErrKeyNotFound, err)
+				default:
+					assert.Equal(t, []byte(fmt.Sprintf("new-%d", i)), val)
+				}
+			}
+		})
+	}
+}
+
+// 快照存活期间 merge 之后重启，被保留的旧版本不会被加载
+func TestDB_SnapshotMergeRestart(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-4")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+	}
+	snap := db.Snapshot()
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	val, err := snap.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), val)
+
+	// 删除 hint 文件，重启时回放数据文件
+	assert.Nil(t, db.Close())
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+data.HintFileNameSuffix))
+	for _, name := range matches {
+		assert.Nil(t, os.Remove(name))
+	}
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Equal(t, 0, len(db2.ListKeys()))
+}
@@ -0,0 +1,70 @@
+package kv_bitcask
+
+import (
+	"kv-bitcask/data"
+	"kv-bitcask/utils"
+	"sort"
+)
+
+// Stat 数据库的统计信息
+type Stat struct {
+	KeyNum          uint       // key的数量，包括已经过期但还没有被清理的key
+	DataFileNum     uint       // 数据文件的数量
+	ReclaimableSize int64      // 可以通过merge回收的数据大小，是估计值
+	DiskSize        int64      // 数据目录占用的磁盘空间
+	Files           []FileStat // 每个数据文件的统计信息，按文件id从小到大排列
+}
+
+// FileStat 数据文件的统计信息
+type FileStat struct {
+	FileId          uint32
+	Size            int64   // 文件中数据的大小
+	ReclaimableSize int64   // 文件中被覆盖、删除的数据和墓碑值等可以被回收的数据大小
+	DeadRatio       float64 // 可以被回收的数据占文件大小的比例
+}
+
+// Stat 获取数据库的统计信息
+// 可以被回收的数据大小在写入、删除和启动加载索引时统计，使用持久化的索引时不包括检查点之前的数据
+func (db *DB) Stat() (*Stat, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.isClosed {
+		return nil, ErrDBClosed
+	}
+
+	stat := &Stat{KeyNum: uint(db.index.Size())}
+	addFile := func(dataFile *data.DataFile, size int64) {
+		fileStat := FileStat{
+			FileId:          dataFile.FileId,
+			Size:            size,
+			ReclaimableSize: db.reclaimSize[dataFile.FileId],
+		}
+		if size > 0 {
+			fileStat.DeadRatio = float64(fileStat.ReclaimableSize) / float64(size)
+		}
+		stat.Files = append(stat.Files, fileStat)
+		stat.ReclaimableSize += fileStat.ReclaimableSize
+	}
+	for _, dataFile := range db.olderFiles {
+		size, err := dataFile.IOManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		addFile(dataFile, size)
+	}
+	if db.activeFile != nil {
+		addFile(db.activeFile, db.activeFile.WriteOff)
+	}
+	sort.Slice(stat.Files, func(i, j int) bool {
+		return stat.Files[i].FileId < stat.Files[j].FileId
+	})
+	stat.DataFileNum = uint(len(stat.Files))
+
+	diskSize, err := utils.DirSize(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	stat.DiskSize = diskSize
+	return stat, nil
+}
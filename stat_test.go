@@ -0,0 +1,83 @@
+package kv_bitcask
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_Stat(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stat")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 数据库为空
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), stat.KeyNum)
+	assert.Equal(t, uint(0), stat.DataFileNum)
+	assert.Equal(t, int64(0), stat.ReclaimableSize)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2000), stat.KeyNum)
+	assert.True(t, stat.DataFileNum > 1)
+	assert.Equal(t, int64(0), stat.ReclaimableSize)
+	assert.True(t, stat.DiskSize > 0)
+
+	// 覆盖和删除
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 1000; i < 1200; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1200; i < 1300; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, wb.Delete(utils.GetTestKey(1300)))
+	assert.Nil(t, wb.Commit())
+
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1799), stat.KeyNum)
+	assert.True(t, stat.ReclaimableSize > 0)
+	var reclaimSize int64
+	for _, fileStat := range stat.Files {
+		reclaimSize += fileStat.ReclaimableSize
+		assert.True(t, fileStat.DeadRatio >= 0 && fileStat.DeadRatio <= 1)
+	}
+	assert.Equal(t, stat.ReclaimableSize, reclaimSize)
+	// 最早的文件中的数据都已经被覆盖
+	assert.True(t, stat.Files[0].DeadRatio > 0.9)
+
+	// 重启之后统计的结果一致
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	stat2, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.KeyNum, stat2.KeyNum)
+	assert.Equal(t, stat.DataFileNum, stat2.DataFileNum)
+	assert.Equal(t, stat.ReclaimableSize, stat2.ReclaimableSize)
+
+	// merge之后没有可以回收的数据
+	assert.Nil(t, db2.Merge())
+	stat3, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.KeyNum, stat3.KeyNum)
+	assert.Equal(t, int64(0), stat3.ReclaimableSize)
+	assert.True(t, stat3.DataFileNum < stat.DataFileNum)
+}
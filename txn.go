@@ -0,0 +1,217 @@
+package kv_bitcask
+
+import (
+	"kv-bitcask/data"
+	"sync"
+	"time"
+)
+
+// Txn 乐观事务，读取的是事务开始时的快照，提交时如果读取过的key已经被其他写入修改则提交失败
+// 事务中的写入先暂存在内存中，提交时和WriteBatch一样以一个批次原子地写入
+// 事务持有一个快照，结束时需要调用Commit或Rollback释放
+type Txn struct {
+	db            *DB
+	mu            *sync.Mutex
+	snapshot      *Snapshot                  // 事务开始时的快照
+	pendingWrites map[string]*data.LogRecord // 暂存事务中的写入
+	reads         map[string]*txnRead        // 事务中读取过的key及读取时的版本
+	finished      bool                       // 是否已经提交或回滚
+}
+
+// 读取key时看到的版本
+type txnRead struct {
+	exist   bool
+	version uint64
+}
+
+// Begin 开始一个事务
+func (db *DB) Begin() *Txn {
+	return &Txn{
+		db:            db,
+		mu:            new(sync.Mutex),
+		snapshot:      db.Snapshot(),
+		pendingWrites: make(map[string]*data.LogRecord),
+		reads:         make(map[string]*txnRead),
+	}
+}
+
+// Get 读取key在事务快照中的数据，事务中写入过的key返回写入的数据
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+
+	// 先读取事务自己的写入
+	if record, ok := txn.pendingWrites[string(key)]; ok {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+
+	txn.db.mu.RLock()
+	defer txn.db.mu.RUnlock()
+	pos, err := txn.readPosition(key)
+	if err != nil {
+		return nil, err
+	}
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return txn.db.getValueByPosition(pos)
+}
+
+// 读取key在事务快照中的位置，并记录读取时的版本用于提交时检测冲突，调用方需持有db.mu读锁
+func (txn *Txn) readPosition(key []byte) (*data.LogRecordPos, error) {
+	if txn.db.isClosed {
+		return nil, ErrDBClosed
+	}
+	pos := txn.snapshot.position(key)
+	read := &txnRead{exist: pos != nil}
+	if pos != nil {
+		read.version = pos.Version
+	}
+	txn.reads[string(key)] = read
+	return pos, nil
+}
+
+// Put 在事务中写入数据
+func (txn *Txn) Put(key []byte, value []byte) error {
+	return txn.put(key, value, 0)
+}
+
+// PutWithTTL 在事务中写入数据，并设置过期时间
+func (txn *Txn) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return txn.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// PutKeepTTL 在事务中写入数据，保留key原来的过期时间，key不存在时不设置过期时间
+// 和Get一样会记录读取的版本，key的过期时间在事务开始之后被修改时提交失败
+func (txn *Txn) PutKeepTTL(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if err := txn.db.checkKeySize(key); err != nil {
+		return err
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+
+	var expire int64
+	if record, ok := txn.pendingWrites[string(key)]; ok {
+		if record.Type != data.LogRecordDeleted {
+			expire = record.Expire
+		}
+	} else {
+		txn.db.mu.RLock()
+		pos, err := txn.readPosition(key)
+		txn.db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if pos != nil && !pos.IsExpired(time.Now().UnixNano()) {
+			expire = pos.Expire
+		}
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Value: value, Expire: expire}
+	return nil
+}
+
+func (txn *Txn) put(key []byte, value []byte, expire int64) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if err := txn.db.checkKeySize(key); err != nil {
+		return err
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Value: value, Expire: expire}
+	return nil
+}
+
+// Delete 在事务中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	return nil
+}
+
+// Commit 提交事务，读取过的key在事务开始之后被修改过时返回ErrTxnConflict，事务中的写入全部不生效
+// 无论提交是否成功，事务都会结束
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.finished = true
+
+	written, err := txn.commit()
+	if err != nil || written == 0 || !txn.db.options.SyncWrites {
+		return err
+	}
+	// 释放锁之后再等待持久化，并发提交的事务可以共享同一次fsync
+	return txn.db.syncer.wait(written)
+}
+
+// 冲突检测并写入，返回写入的位置，没有写入时返回0
+func (txn *Txn) commit() (uint64, error) {
+	// 加锁保证冲突检测和写入之间没有其他写入
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+	defer txn.snapshot.release()
+
+	if txn.db.isClosed {
+		return 0, ErrDBClosed
+	}
+
+	// 读取过的key和读取时的版本不一致，说明被其他写入修改过
+	for key, read := range txn.reads {
+		pos := txn.db.index.Get([]byte(key))
+		if (pos != nil) != read.exist || (pos != nil && pos.Version != read.version) {
+			return 0, ErrTxnConflict
+		}
+	}
+
+	if len(txn.pendingWrites) == 0 {
+		return 0, nil
+	}
+	return txn.db.commitBatch(txn.pendingWrites)
+}
+
+// Rollback 回滚事务，丢弃事务中所有的写入
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	txn.finished = true
+	txn.snapshot.Release()
+	txn.pendingWrites = nil
+	txn.reads = nil
+}
@@ -0,0 +1,240 @@
+package kv_bitcask
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-bitcask/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_Txn(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+
+	txn := db.Begin()
+	val, err := txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	_, err = txn.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 读取事务自己的写入
+	err = txn.Put(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	err = txn.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val, err = txn.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = txn.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 提交之前对外不可见
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = txn.Commit()
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 事务已经结束
+	err = txn.Commit()
+	assert.Equal(t, ErrTxnFinished, err)
+	err = txn.Put(utils.GetTestKey(3), []byte("v3"))
+	assert.Equal(t, ErrTxnFinished, err)
+
+	// 回滚
+	txn2 := db.Begin()
+	err = txn2.Put(utils.GetTestKey(3), []byte("v3"))
+	assert.Nil(t, err)
+	txn2.Rollback()
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 重启后事务的写入仍然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+}
+
+func TestDB_TxnConflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+
+	// 读取之后 key 被修改
+	txn1 := db.Begin()
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = txn1.Put(utils.GetTestKey(1), []byte("txn1"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	err = txn1.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 读取之后 key 被删除
+	txn2 := db.Begin()
+	_, err = txn2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = txn2.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+
+	// 读取时不存在，之后被其他事务写入
+	txn3 := db.Begin()
+	txn4 := db.Begin()
+	_, err = txn3.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = txn4.Put(utils.GetTestKey(2), []byte("txn4"))
+	assert.Nil(t, err)
+	err = txn4.Commit()
+	assert.Nil(t, err)
+	err = txn3.Put(utils.GetTestKey(3), []byte("txn3"))
+	assert.Nil(t, err)
+	err = txn3.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 事务开始之后被修改的 key 读取到的是快照中的数据，提交时冲突
+	txn5 := db.Begin()
+	err = db.Put(utils.GetTestKey(2), []byte("v3"))
+	assert.Nil(t, err)
+	val, err = txn5.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn4"), val)
+	err = txn5.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+
+	// 只写不读的事务不会冲突
+	txn6 := db.Begin()
+	err = db.Put(utils.GetTestKey(2), []byte("v4"))
+	assert.Nil(t, err)
+	err = txn6.Put(utils.GetTestKey(2), []byte("txn6"))
+	assert.Nil(t, err)
+	err = txn6.Commit()
+	assert.Nil(t, err)
+}
+
+// 并发地对同一个计数器加一，冲突的事务重试，最终结果正确
+func TestDB_TxnConcurrentIncrement(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-3")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	key := []byte("counter")
+	err = db.Put(key, []byte("0"))
+	assert.Nil(t, err)
+
+	increment := func() error {
+		txn := db.Begin()
+		val, err := txn.Get(key)
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+		n, _ := strconv.Atoi(string(val))
+		if err := txn.Put(key, []byte(strconv.Itoa(n+1))); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for increment() == ErrTxnConflict {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "400", string(val))
+}
+
+func TestDB_TxnPutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-4")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	txn := db.Begin()
+	assert.Equal(t, ErrInvalidTTL, txn.PutWithTTL(utils.GetTestKey(1), []byte("v1"), 0))
+	assert.Nil(t, txn.PutWithTTL(utils.GetTestKey(1), []byte("v1"), time.Minute))
+	assert.Nil(t, txn.PutWithTTL(utils.GetTestKey(2), []byte("v2"), 50*time.Millisecond))
+	assert.Nil(t, txn.Commit())
+
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 50*time.Second && ttl <= time.Minute)
+
+	// 保留原来的过期时间
+	txn = db.Begin()
+	assert.Nil(t, txn.PutKeepTTL(utils.GetTestKey(1), []byte("v1-new")))
+	assert.Nil(t, txn.PutKeepTTL(utils.GetTestKey(3), []byte("v3")))
+	assert.Nil(t, txn.Commit())
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-new"), val)
+	newTTL, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, newTTL > 50*time.Second && newTTL <= ttl)
+	ttl, err = db.TTL(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	// 过期时间被其他写入修改时提交失败
+	txn = db.Begin()
+	assert.Nil(t, txn.PutKeepTTL(utils.GetTestKey(1), []byte("v1-txn")))
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("v1-put")))
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
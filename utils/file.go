@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DirSize 获取目录下所有文件的总大小，统计期间被删除的文件直接跳过
+func DirSize(dirPath string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
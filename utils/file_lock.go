@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileLock 基于flock的进程间文件锁，属于建议锁
+type FileLock struct {
+	path string   // 锁文件路径
+	fd   *os.File // 锁文件描述符，加锁成功后持有
+}
+
+// NewFileLock 新建文件锁，此时并不加锁
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// TryLock 尝试加排他锁，不阻塞，锁已被其他进程持有时返回false
+func (fl *FileLock) TryLock() (bool, error) {
+	return fl.tryLock(syscall.LOCK_EX, os.O_CREATE|os.O_RDWR)
+}
+
+// TryRLock 尝试加共享锁，不阻塞，可以和其他共享锁共存，排他锁已被其他进程持有时返回false
+// 以只读方式打开锁文件，锁文件不存在时返回错误
+func (fl *FileLock) TryRLock() (bool, error) {
+	return fl.tryLock(syscall.LOCK_SH, os.O_RDONLY)
+}
+
+func (fl *FileLock) tryLock(how int, flag int) (bool, error) {
+	if fl.fd != nil {
+		return true, nil
+	}
+	fd, err := os.OpenFile(fl.path, flag, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(fd.Fd()), how|syscall.LOCK_NB); err != nil {
+		_ = fd.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	fl.fd = fd
+	return true, nil
+}
+
+// Unlock 释放锁，关闭锁文件
+func (fl *FileLock) Unlock() error {
+	if fl.fd == nil {
+		return nil
+	}
+	if err := syscall.Flock(int(fl.fd.Fd()), syscall.LOCK_UN); err != nil {
+		return err
+	}
+	err := fl.fd.Close()
+	fl.fd = nil
+	return err
+}